@@ -18,6 +18,7 @@ import (
 const (
 	useOfClosedConn = "use of closed network connection"
 	statInterval    = time.Second * 5
+	reportInterval  = time.Minute
 )
 
 var (
@@ -29,6 +30,8 @@ type PairedConnection struct {
 	id       int
 	cliConn  net.Conn
 	svrConn  net.Conn
+	interop  protocol.Interop
+	order    *decodeOrder
 	once     sync.Once
 	stopChan chan struct{}
 }
@@ -37,6 +40,8 @@ func NewPairedConnection(id int, cliConn net.Conn) *PairedConnection {
 	return &PairedConnection{
 		id:       id,
 		cliConn:  cliConn,
+		interop:  protocol.CreateInterop(settings.Protocol, cliConn.RemoteAddr().String()),
+		order:    newDecodeOrder(),
 		stopChan: make(chan struct{}),
 	}
 }
@@ -66,8 +71,10 @@ func (c *PairedConnection) handleClientMessage() {
 	defer c.stop()
 
 	r, w := io.Pipe()
-	tee := io.MultiWriter(c.svrConn, w)
-	go protocol.CreateInterop(settings.Protocol).Dump(r, protocol.ClientSide, c.id, settings.Quiet)
+	// let the decoder see EOF when the connection is closed.
+	defer w.Close()
+	tee := io.MultiWriter(c.order.sender(c.svrConn), w)
+	go c.interop.Dump(c.order.reader(r), protocol.ClientSide, c.id, settings.Quiet)
 	c.copyDataWithRateLimit(tee, c.cliConn, protocol.ClientSide, settings.UpLimit)
 }
 
@@ -76,8 +83,11 @@ func (c *PairedConnection) handleServerMessage() {
 	defer c.stop()
 
 	r, w := io.Pipe()
-	tee := io.MultiWriter(newDelayedWriter(c.cliConn, settings.Delay, c.stopChan), w)
-	go protocol.CreateInterop(settings.Protocol).Dump(r, protocol.ServerSide, c.id, settings.Quiet)
+	defer w.Close()
+	// the responses are decoded after their requests, so that the interop can pair them.
+	tee := io.MultiWriter(newDelayedWriter(c.cliConn, settings.Delay, c.stopChan),
+		c.order.writer(w, decodeOrderTimeout))
+	go c.interop.Dump(r, protocol.ServerSide, c.id, settings.Quiet)
 	c.copyDataWithRateLimit(tee, c.svrConn, protocol.ServerSide, settings.DownLimit)
 }
 
@@ -116,7 +126,7 @@ func (c *PairedConnection) stop() {
 }
 
 func startListener() error {
-	stat = NewStater(NewConnCounter(), NewStatPrinter(statInterval))
+	stat = NewStater(NewConnCounter(), NewProtocolReporter(reportInterval), NewStatPrinter(statInterval))
 	go stat.Start()
 
 	conn, err := net.Listen("tcp", fmt.Sprintf("%s:%d", settings.LocalHost, settings.LocalPort))
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// the longest time that the server side decoder waits for the client side decoder.
+const decodeOrderTimeout = time.Millisecond * 100
+
+// decodeOrder lets the server side decoder wait for the client side decoder of a connection.
+// The bytes are relayed before they are decoded, and the two directions are decoded concurrently,
+// so a fast response could be decoded before its request, and the interop could not pair them.
+type decodeOrder struct {
+	// the client bytes written to the server, and the ones read by the decoder.
+	sent     int64
+	consumed int64
+	// the client side decoder is waiting for more bytes, all the ones it read are decoded.
+	waiting bool
+	// the client side decoder stopped reading.
+	done    bool
+	changed chan struct{}
+	lock    sync.Mutex
+}
+
+type (
+	orderedSender struct {
+		order  *decodeOrder
+		writer io.Writer
+	}
+
+	orderedReader struct {
+		order  *decodeOrder
+		reader io.Reader
+	}
+
+	orderedWriter struct {
+		order   *decodeOrder
+		writer  io.Writer
+		timeout time.Duration
+	}
+)
+
+func newDecodeOrder() *decodeOrder {
+	return &decodeOrder{
+		changed: make(chan struct{}),
+	}
+}
+
+// sender wraps the writer to the server, to count the client bytes that could be responded.
+func (o *decodeOrder) sender(writer io.Writer) io.Writer {
+	return orderedSender{
+		order:  o,
+		writer: writer,
+	}
+}
+
+// reader wraps the reader of the client side decoder, to tell when it has decoded the bytes sent.
+func (o *decodeOrder) reader(reader io.Reader) io.Reader {
+	return orderedReader{
+		order:  o,
+		reader: reader,
+	}
+}
+
+// writer wraps the writer to the server side decoder, the bytes are written after the client side
+// decoder has decoded the client bytes sent so far, or after the timeout if it's slow.
+func (o *decodeOrder) writer(writer io.Writer, timeout time.Duration) io.Writer {
+	return orderedWriter{
+		order:   o,
+		writer:  writer,
+		timeout: timeout,
+	}
+}
+
+// update changes the state under the lock, and wakes up the waiting writer.
+func (o *decodeOrder) update(fn func()) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	fn()
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+// wait waits until the client side decoder has decoded the sent bytes, or the timeout.
+func (o *decodeOrder) wait(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	o.lock.Lock()
+	sent := o.sent
+	for !o.done && !(o.waiting && o.consumed >= sent) {
+		changed := o.changed
+		o.lock.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		}
+		o.lock.Lock()
+	}
+	o.lock.Unlock()
+}
+
+func (s orderedSender) Write(p []byte) (int, error) {
+	// counted before written, the response can't be read before the request is sent.
+	s.order.update(func() {
+		s.order.sent += int64(len(p))
+	})
+
+	return s.writer.Write(p)
+}
+
+func (r orderedReader) Read(p []byte) (int, error) {
+	r.order.update(func() {
+		r.order.waiting = true
+	})
+
+	n, err := r.reader.Read(p)
+	r.order.update(func() {
+		r.order.waiting = false
+		r.order.consumed += int64(n)
+		if err != nil {
+			r.order.done = true
+		}
+	})
+
+	return n, err
+}
+
+func (w orderedWriter) Write(p []byte) (int, error) {
+	w.order.wait(w.timeout)
+	return w.writer.Write(p)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	events []string
+	lock   sync.Mutex
+}
+
+func (r *eventRecorder) add(event string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) Write(p []byte) (int, error) {
+	r.add(string(p))
+	return len(p), nil
+}
+
+func (r *eventRecorder) String() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return strings.Join(r.events, ",")
+}
+
+func TestDecodeOrderWaitsForRequests(t *testing.T) {
+	order := newDecodeOrder()
+	recorder := new(eventRecorder)
+	r, w := io.Pipe()
+	defer w.Close()
+	go func() {
+		reader := order.reader(r)
+		buf := make([]byte, 16)
+		for {
+			n, err := reader.Read(buf)
+			if err != nil {
+				return
+			}
+			// a slow decoder, the response arrives while the request is decoded.
+			time.Sleep(time.Millisecond * 50)
+			recorder.add(string(buf[:n]))
+		}
+	}()
+
+	client := io.MultiWriter(order.sender(io.Discard), w)
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := order.writer(recorder, time.Second).Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+
+	if events := recorder.String(); events != "request,response" {
+		t.Fatalf("expected the request decoded before the response, got %s", events)
+	}
+}
+
+func TestDecodeOrderTimeout(t *testing.T) {
+	order := newDecodeOrder()
+	recorder := new(eventRecorder)
+	// the decoder never reads the request.
+	if _, err := order.sender(io.Discard).Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := order.writer(recorder, time.Millisecond*50).Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Fatalf("expected to wait for the timeout, waited %s", elapsed)
+	}
+	if events := recorder.String(); events != "response" {
+		t.Fatalf("expected the response written after the timeout, got %s", events)
+	}
+}
+
+func TestDecodeOrderDecoderDone(t *testing.T) {
+	order := newDecodeOrder()
+	if _, err := order.sender(io.Discard).Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	// the decoder stops at EOF, the responses don't wait for it anymore.
+	if _, err := order.reader(strings.NewReader("")).Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	start := time.Now()
+	if _, err := order.writer(io.Discard, time.Second).Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Fatalf("expected not to wait for a stopped decoder, waited %s", elapsed)
+	}
+}
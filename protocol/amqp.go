@@ -0,0 +1,644 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+)
+
+const (
+	amqpFrameHeaderLen = 7
+	amqpFrameEnd       = 0xce
+	amqpMaxFrameSize   = 128 << 20
+	amqpProtocolHeader = "AMQP"
+	amqpPreviewLen     = 64
+	// the max nesting of field tables and arrays, deeper ones are invalid.
+	amqpMaxNesting = 16
+
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+)
+
+var (
+	errAmqpShortBuffer = errors.New("short buffer")
+	errAmqpTooDeep     = errors.New("field tables nested too deep")
+
+	amqpMethodNames = map[uint32]string{
+		amqpMethod(10, 10):  "connection.start",
+		amqpMethod(10, 11):  "connection.start-ok",
+		amqpMethod(10, 20):  "connection.secure",
+		amqpMethod(10, 21):  "connection.secure-ok",
+		amqpMethod(10, 30):  "connection.tune",
+		amqpMethod(10, 31):  "connection.tune-ok",
+		amqpMethod(10, 40):  "connection.open",
+		amqpMethod(10, 41):  "connection.open-ok",
+		amqpMethod(10, 50):  "connection.close",
+		amqpMethod(10, 51):  "connection.close-ok",
+		amqpMethod(10, 60):  "connection.blocked",
+		amqpMethod(10, 61):  "connection.unblocked",
+		amqpMethod(10, 70):  "connection.update-secret",
+		amqpMethod(10, 71):  "connection.update-secret-ok",
+		amqpMethod(20, 10):  "channel.open",
+		amqpMethod(20, 11):  "channel.open-ok",
+		amqpMethod(20, 20):  "channel.flow",
+		amqpMethod(20, 21):  "channel.flow-ok",
+		amqpMethod(20, 40):  "channel.close",
+		amqpMethod(20, 41):  "channel.close-ok",
+		amqpMethod(40, 10):  "exchange.declare",
+		amqpMethod(40, 11):  "exchange.declare-ok",
+		amqpMethod(40, 20):  "exchange.delete",
+		amqpMethod(40, 21):  "exchange.delete-ok",
+		amqpMethod(40, 30):  "exchange.bind",
+		amqpMethod(40, 31):  "exchange.bind-ok",
+		amqpMethod(40, 40):  "exchange.unbind",
+		amqpMethod(40, 51):  "exchange.unbind-ok",
+		amqpMethod(50, 10):  "queue.declare",
+		amqpMethod(50, 11):  "queue.declare-ok",
+		amqpMethod(50, 20):  "queue.bind",
+		amqpMethod(50, 21):  "queue.bind-ok",
+		amqpMethod(50, 30):  "queue.purge",
+		amqpMethod(50, 31):  "queue.purge-ok",
+		amqpMethod(50, 40):  "queue.delete",
+		amqpMethod(50, 41):  "queue.delete-ok",
+		amqpMethod(50, 50):  "queue.unbind",
+		amqpMethod(50, 51):  "queue.unbind-ok",
+		amqpMethod(60, 10):  "basic.qos",
+		amqpMethod(60, 11):  "basic.qos-ok",
+		amqpMethod(60, 20):  "basic.consume",
+		amqpMethod(60, 21):  "basic.consume-ok",
+		amqpMethod(60, 30):  "basic.cancel",
+		amqpMethod(60, 31):  "basic.cancel-ok",
+		amqpMethod(60, 40):  "basic.publish",
+		amqpMethod(60, 50):  "basic.return",
+		amqpMethod(60, 60):  "basic.deliver",
+		amqpMethod(60, 70):  "basic.get",
+		amqpMethod(60, 71):  "basic.get-ok",
+		amqpMethod(60, 72):  "basic.get-empty",
+		amqpMethod(60, 80):  "basic.ack",
+		amqpMethod(60, 90):  "basic.reject",
+		amqpMethod(60, 100): "basic.recover-async",
+		amqpMethod(60, 110): "basic.recover",
+		amqpMethod(60, 111): "basic.recover-ok",
+		amqpMethod(60, 120): "basic.nack",
+		amqpMethod(85, 10):  "confirm.select",
+		amqpMethod(85, 11):  "confirm.select-ok",
+		amqpMethod(90, 10):  "tx.select",
+		amqpMethod(90, 11):  "tx.select-ok",
+		amqpMethod(90, 20):  "tx.commit",
+		amqpMethod(90, 21):  "tx.commit-ok",
+		amqpMethod(90, 30):  "tx.rollback",
+		amqpMethod(90, 31):  "tx.rollback-ok",
+	}
+
+	amqpReplyCodes = map[uint16]string{
+		200: "REPLY_SUCCESS",
+		311: "CONTENT_TOO_LARGE",
+		312: "NO_ROUTE",
+		313: "NO_CONSUMERS",
+		320: "CONNECTION_FORCED",
+		402: "INVALID_PATH",
+		403: "ACCESS_REFUSED",
+		404: "NOT_FOUND",
+		405: "RESOURCE_LOCKED",
+		406: "PRECONDITION_FAILED",
+		501: "FRAME_ERROR",
+		502: "SYNTAX_ERROR",
+		503: "COMMAND_INVALID",
+		504: "CHANNEL_ERROR",
+		505: "UNEXPECTED_FRAME",
+		506: "RESOURCE_ERROR",
+		530: "NOT_ALLOWED",
+		540: "NOT_IMPLEMENTED",
+		541: "INTERNAL_ERROR",
+	}
+
+	amqpMethodDecoders = map[uint32]func(r *amqpReader) string{
+		amqpMethod(10, 10):  decodeAmqpConnectionStart,
+		amqpMethod(10, 11):  decodeAmqpConnectionStartOk,
+		amqpMethod(10, 30):  decodeAmqpConnectionTune,
+		amqpMethod(10, 31):  decodeAmqpConnectionTune,
+		amqpMethod(10, 40):  decodeAmqpConnectionOpen,
+		amqpMethod(10, 50):  decodeAmqpClose,
+		amqpMethod(10, 60):  decodeAmqpConnectionBlocked,
+		amqpMethod(20, 20):  decodeAmqpChannelFlow,
+		amqpMethod(20, 21):  decodeAmqpChannelFlow,
+		amqpMethod(20, 40):  decodeAmqpClose,
+		amqpMethod(40, 10):  decodeAmqpExchangeDeclare,
+		amqpMethod(50, 10):  decodeAmqpQueueDeclare,
+		amqpMethod(50, 11):  decodeAmqpQueueDeclareOk,
+		amqpMethod(50, 20):  decodeAmqpQueueBind,
+		amqpMethod(60, 10):  decodeAmqpBasicQos,
+		amqpMethod(60, 20):  decodeAmqpBasicConsume,
+		amqpMethod(60, 21):  decodeAmqpConsumerTag,
+		amqpMethod(60, 30):  decodeAmqpConsumerTag,
+		amqpMethod(60, 31):  decodeAmqpConsumerTag,
+		amqpMethod(60, 40):  decodeAmqpBasicPublish,
+		amqpMethod(60, 50):  decodeAmqpBasicReturn,
+		amqpMethod(60, 60):  decodeAmqpBasicDeliver,
+		amqpMethod(60, 70):  decodeAmqpBasicGet,
+		amqpMethod(60, 71):  decodeAmqpBasicGetOk,
+		amqpMethod(60, 80):  decodeAmqpBasicAck,
+		amqpMethod(60, 90):  decodeAmqpBasicReject,
+		amqpMethod(60, 120): decodeAmqpBasicNack,
+	}
+
+	amqpPropertyNames = []string{
+		"content-type",
+		"content-encoding",
+		"headers",
+		"delivery-mode",
+		"priority",
+		"correlation-id",
+		"reply-to",
+		"expiration",
+		"message-id",
+		"timestamp",
+		"type",
+		"user-id",
+		"app-id",
+		"cluster-id",
+	}
+)
+
+type amqpInterop struct{}
+
+func (a *amqpInterop) Dump(r io.Reader, source string, id int, quiet bool) {
+	reader := bufio.NewReader(r)
+	if header, err := reader.Peek(len(amqpProtocolHeader)); err == nil && string(header) == amqpProtocolHeader {
+		protocolHeader := make([]byte, len(amqpProtocolHeader)+4)
+		if _, err := io.ReadFull(reader, protocolHeader); err != nil {
+			drain(reader)
+			return
+		}
+		if !quiet {
+			display.PrintfWithTime("[%s-%d] %s %d-%d-%d\n", source, id, color.HiYellowString("protocol header"),
+				protocolHeader[5], protocolHeader[6], protocolHeader[7])
+		}
+	}
+
+	// the method that carries the content, indexed by channel.
+	contents := make(map[uint16]string)
+	header := make([]byte, amqpFrameHeaderLen)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				display.PrintfWithTime("[%s-%d] unable to read amqp frame: %v\n", source, id, err)
+			}
+			drain(reader)
+			return
+		}
+
+		frameType := header[0]
+		channel := binary.BigEndian.Uint16(header[1:3])
+		size := binary.BigEndian.Uint32(header[3:7])
+		if size > amqpMaxFrameSize {
+			display.PrintfWithTime(color.HiRedString("[%s-%d] invalid amqp frame size %d, stop decoding\n",
+				source, id, size))
+			drain(reader)
+			return
+		}
+
+		// payload followed by the frame end octet
+		payload := make([]byte, size+1)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			drain(reader)
+			return
+		}
+		if payload[size] != amqpFrameEnd {
+			display.PrintfWithTime(color.HiRedString("[%s-%d] invalid amqp frame end 0x%02x, stop decoding\n",
+				source, id, payload[size]))
+			drain(reader)
+			return
+		}
+		payload = payload[:size]
+
+		var info string
+		switch frameType {
+		case amqpFrameMethod:
+			var name string
+			name, info = explainAmqpMethod(payload)
+			switch name {
+			case "basic.publish", "basic.deliver", "basic.get-ok", "basic.return":
+				contents[channel] = name
+			}
+		case amqpFrameHeader:
+			info = explainAmqpContentHeader(contents[channel], payload)
+		case amqpFrameBody:
+			info = fmt.Sprintf("%s len:%d %q", color.HiYellowString("%s body", contents[channel]),
+				len(payload), amqpPreview(payload))
+		case amqpFrameHeartbeat:
+			info = color.HiYellowString("heartbeat")
+		default:
+			info = fmt.Sprintf("%s len:%d", color.HiYellowString("frame type %d", frameType), len(payload))
+		}
+
+		if !quiet {
+			display.PrintfWithTime("[%s-%d] ch:%d %s\n", source, id, channel, info)
+		}
+	}
+}
+
+func explainAmqpMethod(payload []byte) (string, string) {
+	r := &amqpReader{b: payload}
+	classID := r.uint16()
+	methodID := r.uint16()
+	if r.err != nil {
+		return "", color.HiRedString("invalid method frame")
+	}
+
+	key := amqpMethod(classID, methodID)
+	name, ok := amqpMethodNames[key]
+	if !ok {
+		name = fmt.Sprintf("%d.%d", classID, methodID)
+	}
+
+	decoder, ok := amqpMethodDecoders[key]
+	if !ok {
+		return name, color.HiYellowString(name)
+	}
+
+	args := decoder(r)
+	if r.err != nil {
+		args += " (truncated)"
+	}
+
+	return name, fmt.Sprintf("%s %s", color.HiYellowString(name), args)
+}
+
+func explainAmqpContentHeader(method string, payload []byte) string {
+	r := &amqpReader{b: payload}
+	r.uint16() // class-id
+	r.uint16() // weight
+	size := r.uint64()
+
+	var flags []uint16
+	for {
+		flag := r.uint16()
+		flags = append(flags, flag)
+		if flag&1 == 0 || r.err != nil {
+			break
+		}
+	}
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("%s body_size:%d", color.HiYellowString("%s header", method), size))
+	for i, name := range amqpPropertyNames {
+		// 15 properties per flag word, the lowest bit marks a continuation.
+		if i/15 >= len(flags) || flags[i/15]&(1<<(15-uint(i%15))) == 0 {
+			continue
+		}
+
+		var value any
+		switch name {
+		case "headers":
+			value = r.table()
+		case "delivery-mode", "priority":
+			value = r.uint8()
+		case "timestamp":
+			value = time.Unix(int64(r.uint64()), 0).Format(time.RFC3339)
+		default:
+			value = r.shortString()
+		}
+		builder.WriteString(fmt.Sprintf(" %s:%v", name, value))
+	}
+	if r.err != nil {
+		builder.WriteString(" (truncated)")
+	}
+
+	return builder.String()
+}
+
+func decodeAmqpConnectionStart(r *amqpReader) string {
+	major, minor := r.uint8(), r.uint8()
+	properties := r.table()
+	mechanisms := r.longString()
+	return fmt.Sprintf("version:%d-%d server:%v mechanisms:%s", major, minor, properties, mechanisms)
+}
+
+func decodeAmqpConnectionStartOk(r *amqpReader) string {
+	properties := r.table()
+	mechanism := r.shortString()
+	r.longString() // response, carries the credentials
+	locale := r.shortString()
+	return fmt.Sprintf("client:%v mechanism:%s locale:%s", properties, mechanism, locale)
+}
+
+func decodeAmqpConnectionTune(r *amqpReader) string {
+	return fmt.Sprintf("channel_max:%d frame_max:%d heartbeat:%ds", r.uint16(), r.uint32(), r.uint16())
+}
+
+func decodeAmqpConnectionOpen(r *amqpReader) string {
+	return "vhost:" + r.shortString()
+}
+
+func decodeAmqpConnectionBlocked(r *amqpReader) string {
+	return "reason:" + r.shortString()
+}
+
+func decodeAmqpClose(r *amqpReader) string {
+	code := r.uint16()
+	text := r.shortString()
+	classID := r.uint16()
+	methodID := r.uint16()
+
+	codeName, ok := amqpReplyCodes[code]
+	if !ok {
+		codeName = "UNKNOWN"
+	}
+
+	desc := fmt.Sprintf("reply_code:%d(%s) reply_text:%q", code, codeName, text)
+	if classID > 0 {
+		method, ok := amqpMethodNames[amqpMethod(classID, methodID)]
+		if !ok {
+			method = fmt.Sprintf("%d.%d", classID, methodID)
+		}
+		desc += " failed_method:" + method
+	}
+
+	return desc
+}
+
+func decodeAmqpChannelFlow(r *amqpReader) string {
+	return fmt.Sprintf("active:%t", r.bits(1)[0])
+}
+
+func decodeAmqpExchangeDeclare(r *amqpReader) string {
+	r.uint16() // reserved
+	exchange := r.shortString()
+	kind := r.shortString()
+	bits := r.bits(5)
+	return fmt.Sprintf("exchange:%s type:%s passive:%t durable:%t auto_delete:%t internal:%t no_wait:%t args:%v",
+		exchange, kind, bits[0], bits[1], bits[2], bits[3], bits[4], r.table())
+}
+
+func decodeAmqpQueueDeclare(r *amqpReader) string {
+	r.uint16() // reserved
+	queue := r.shortString()
+	bits := r.bits(5)
+	return fmt.Sprintf("queue:%s passive:%t durable:%t exclusive:%t auto_delete:%t no_wait:%t args:%v",
+		queue, bits[0], bits[1], bits[2], bits[3], bits[4], r.table())
+}
+
+func decodeAmqpQueueDeclareOk(r *amqpReader) string {
+	return fmt.Sprintf("queue:%s messages:%d consumers:%d", r.shortString(), r.uint32(), r.uint32())
+}
+
+func decodeAmqpQueueBind(r *amqpReader) string {
+	r.uint16() // reserved
+	return fmt.Sprintf("queue:%s exchange:%s routing_key:%s", r.shortString(), r.shortString(), r.shortString())
+}
+
+func decodeAmqpBasicQos(r *amqpReader) string {
+	size := r.uint32()
+	count := r.uint16()
+	return fmt.Sprintf("prefetch_size:%d prefetch_count:%d global:%t", size, count, r.bits(1)[0])
+}
+
+func decodeAmqpBasicConsume(r *amqpReader) string {
+	r.uint16() // reserved
+	queue := r.shortString()
+	tag := r.shortString()
+	bits := r.bits(4)
+	return fmt.Sprintf("queue:%s consumer_tag:%s no_local:%t no_ack:%t exclusive:%t no_wait:%t args:%v",
+		queue, tag, bits[0], bits[1], bits[2], bits[3], r.table())
+}
+
+func decodeAmqpConsumerTag(r *amqpReader) string {
+	return "consumer_tag:" + r.shortString()
+}
+
+func decodeAmqpBasicPublish(r *amqpReader) string {
+	r.uint16() // reserved
+	exchange := r.shortString()
+	key := r.shortString()
+	bits := r.bits(2)
+	return fmt.Sprintf("exchange:%s routing_key:%s mandatory:%t immediate:%t", exchange, key, bits[0], bits[1])
+}
+
+func decodeAmqpBasicReturn(r *amqpReader) string {
+	code := r.uint16()
+	text := r.shortString()
+	codeName, ok := amqpReplyCodes[code]
+	if !ok {
+		codeName = "UNKNOWN"
+	}
+	return fmt.Sprintf("reply_code:%d(%s) reply_text:%q exchange:%s routing_key:%s",
+		code, codeName, text, r.shortString(), r.shortString())
+}
+
+func decodeAmqpBasicDeliver(r *amqpReader) string {
+	tag := r.shortString()
+	deliveryTag := r.uint64()
+	redelivered := r.bits(1)[0]
+	return fmt.Sprintf("consumer_tag:%s delivery_tag:%d redelivered:%t exchange:%s routing_key:%s",
+		tag, deliveryTag, redelivered, r.shortString(), r.shortString())
+}
+
+func decodeAmqpBasicGet(r *amqpReader) string {
+	r.uint16() // reserved
+	queue := r.shortString()
+	return fmt.Sprintf("queue:%s no_ack:%t", queue, r.bits(1)[0])
+}
+
+func decodeAmqpBasicGetOk(r *amqpReader) string {
+	deliveryTag := r.uint64()
+	redelivered := r.bits(1)[0]
+	return fmt.Sprintf("delivery_tag:%d redelivered:%t exchange:%s routing_key:%s messages:%d",
+		deliveryTag, redelivered, r.shortString(), r.shortString(), r.uint32())
+}
+
+func decodeAmqpBasicAck(r *amqpReader) string {
+	deliveryTag := r.uint64()
+	return fmt.Sprintf("delivery_tag:%d multiple:%t", deliveryTag, r.bits(1)[0])
+}
+
+func decodeAmqpBasicReject(r *amqpReader) string {
+	deliveryTag := r.uint64()
+	return fmt.Sprintf("delivery_tag:%d requeue:%t", deliveryTag, r.bits(1)[0])
+}
+
+func decodeAmqpBasicNack(r *amqpReader) string {
+	deliveryTag := r.uint64()
+	bits := r.bits(2)
+	return fmt.Sprintf("delivery_tag:%d multiple:%t requeue:%t", deliveryTag, bits[0], bits[1])
+}
+
+func amqpMethod(classID, methodID uint16) uint32 {
+	return uint32(classID)<<16 | uint32(methodID)
+}
+
+func amqpPreview(b []byte) string {
+	if len(b) > amqpPreviewLen {
+		return toPrintableASCII(b[:amqpPreviewLen]) + "..."
+	}
+
+	return toPrintableASCII(b)
+}
+
+// amqpReader reads the amqp 0-9-1 data types, the first error sticks.
+type amqpReader struct {
+	b   []byte
+	err error
+	// the nesting of the field table or array being read.
+	depth int
+}
+
+func (r *amqpReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errAmqpShortBuffer
+		return nil
+	}
+
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *amqpReader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *amqpReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *amqpReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (r *amqpReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+// bits reads n consecutive bit fields, which are packed into octets.
+func (r *amqpReader) bits(n int) []bool {
+	values := make([]bool, n)
+	var octet byte
+	for i := 0; i < n; i++ {
+		if i%8 == 0 {
+			octet = r.uint8()
+		}
+		values[i] = octet&(1<<uint(i%8)) != 0
+	}
+
+	return values
+}
+
+func (r *amqpReader) shortString() string {
+	return string(r.next(int(r.uint8())))
+}
+
+func (r *amqpReader) longString() string {
+	return string(r.next(int(r.uint32())))
+}
+
+func (r *amqpReader) table() string {
+	t := r.nested()
+	var fields []string
+	for len(t.b) > 0 && t.err == nil {
+		name := t.shortString()
+		fields = append(fields, fmt.Sprintf("%s=%v", name, t.value()))
+	}
+	if t.err != nil {
+		r.err = t.err
+	}
+
+	sort.Strings(fields)
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// nested returns the reader of a field table or array, which starts with its length.
+func (r *amqpReader) nested() *amqpReader {
+	b := r.next(int(r.uint32()))
+	if r.err == nil && r.depth >= amqpMaxNesting {
+		r.err = errAmqpTooDeep
+	}
+	if r.err != nil {
+		return &amqpReader{err: r.err}
+	}
+
+	return &amqpReader{b: b, depth: r.depth + 1}
+}
+
+func (r *amqpReader) value() any {
+	switch kind := r.uint8(); kind {
+	case 't':
+		return r.uint8() != 0
+	case 'b':
+		return int8(r.uint8())
+	case 'B':
+		return r.uint8()
+	case 's':
+		return int16(r.uint16())
+	case 'u':
+		return r.uint16()
+	case 'I':
+		return int32(r.uint32())
+	case 'i':
+		return r.uint32()
+	case 'l':
+		return int64(r.uint64())
+	case 'f':
+		return math.Float32frombits(r.uint32())
+	case 'd':
+		return math.Float64frombits(r.uint64())
+	case 'D':
+		scale := r.uint8()
+		return float64(int32(r.uint32())) / math.Pow10(int(scale))
+	case 'S':
+		return r.longString()
+	case 'x':
+		return fmt.Sprintf("<%d bytes>", len(r.next(int(r.uint32()))))
+	case 'A':
+		a := r.nested()
+		var values []any
+		for len(a.b) > 0 && a.err == nil {
+			values = append(values, a.value())
+		}
+		if a.err != nil {
+			r.err = a.err
+		}
+		return values
+	case 'T':
+		return time.Unix(int64(r.uint64()), 0).Format(time.RFC3339)
+	case 'F':
+		return r.table()
+	case 'V':
+		return nil
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown field type %q", kind)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestAmqpReaderNestedTables(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+		err   error
+	}{
+		{name: "flat", depth: 1},
+		{name: "max", depth: amqpMaxNesting},
+		{name: "too deep", depth: amqpMaxNesting + 1, err: errAmqpTooDeep},
+		{name: "crafted", depth: 1000, err: errAmqpTooDeep},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &amqpReader{b: amqpNestedTable(test.depth)}
+			r.table()
+			if r.err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, r.err)
+			}
+		})
+	}
+}
+
+// amqpNestedTable builds a field table with depth levels, each one holds the next in field "t".
+func amqpNestedTable(depth int) []byte {
+	body := []byte{1, 'v', 't', 1}
+	for i := 1; i < depth; i++ {
+		body = append([]byte{1, 't', 'F'}, amqpLongBytes(body)...)
+	}
+
+	return amqpLongBytes(body)
+}
+
+func amqpLongBytes(b []byte) []byte {
+	buf := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
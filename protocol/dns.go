@@ -0,0 +1,311 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsLengthLen = 2
+	dnsTypeIXFR  = dnsmessage.Type(251)
+)
+
+var dnsRCodes = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+type (
+	dnsQuery struct {
+		question string
+		transfer bool
+		// an incremental transfer, which ends differently from a full one.
+		ixfr     bool
+		messages int
+		records  int
+		soas     int
+		// the serial of the first SOA record, the current one of the zone.
+		serial uint32
+		start  time.Time
+	}
+
+	// dnsInterop is shared by both directions of a connection,
+	// so that responses can be paired with queries by id.
+	dnsInterop struct {
+		queries map[uint16]*dnsQuery
+		lock    sync.Mutex
+	}
+)
+
+func newDnsInterop() *dnsInterop {
+	return &dnsInterop{
+		queries: make(map[uint16]*dnsQuery),
+	}
+}
+
+func (d *dnsInterop) Dump(r io.Reader, source string, id int, quiet bool) {
+	length := make([]byte, dnsLengthLen)
+	for {
+		if _, err := io.ReadFull(r, length); err != nil {
+			if err != io.EOF {
+				display.PrintfWithTime("[%s-%d] unable to read dns message: %v\n", source, id, err)
+			}
+			drain(r)
+			return
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			drain(r)
+			return
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(payload); err != nil {
+			if !quiet {
+				display.PrintfWithTime(color.HiRedString("[%s-%d] invalid dns message: %v\n", source, id, err))
+			}
+			continue
+		}
+
+		if msg.Header.Response {
+			d.dumpResponse(&msg, source, id, len(payload), quiet)
+		} else {
+			d.dumpQuery(&msg, source, id, len(payload), quiet)
+		}
+	}
+}
+
+func (d *dnsInterop) dumpQuery(msg *dnsmessage.Message, source string, id, size int, quiet bool) {
+	var questions []string
+	var transfer, ixfr bool
+	for _, q := range msg.Questions {
+		questions = append(questions, explainDnsQuestion(q))
+		if q.Type == dnsmessage.TypeAXFR || q.Type == dnsTypeIXFR {
+			transfer = true
+			ixfr = q.Type == dnsTypeIXFR
+		}
+	}
+	question := strings.Join(questions, ", ")
+
+	d.lock.Lock()
+	d.queries[msg.Header.ID] = &dnsQuery{
+		question: question,
+		transfer: transfer,
+		ixfr:     ixfr,
+		start:    time.Now(),
+	}
+	d.lock.Unlock()
+
+	if quiet {
+		return
+	}
+
+	display.PrintfWithTime("[%s-%d] %s id:%d flags:%s len:%d%s\n", source, id,
+		color.HiYellowString("query %s", question), msg.Header.ID, explainDnsFlags(msg.Header),
+		size, explainDnsResources(msg))
+}
+
+func (d *dnsInterop) dumpResponse(msg *dnsmessage.Message, source string, id, size int, quiet bool) {
+	d.lock.Lock()
+	query, ok := d.queries[msg.Header.ID]
+	var latency time.Duration
+	var question string
+	var progress string
+	if ok {
+		latency = time.Since(query.start)
+		question = query.question
+		// a zone transfer spans several messages.
+		if query.transfer && msg.Header.RCode == dnsmessage.RCodeSuccess {
+			done := query.addTransfer(msg)
+			progress = fmt.Sprintf(" message:%d records:%d", query.messages, query.records)
+			if done {
+				progress += " complete"
+				delete(d.queries, msg.Header.ID)
+			}
+		} else {
+			delete(d.queries, msg.Header.ID)
+		}
+	}
+	d.lock.Unlock()
+
+	if quiet {
+		return
+	}
+
+	if !ok {
+		var questions []string
+		for _, q := range msg.Questions {
+			questions = append(questions, explainDnsQuestion(q))
+		}
+		question = strings.Join(questions, ", ")
+	}
+
+	rcode := explainDnsRCode(msg.Header.RCode)
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		rcode = color.HiRedString(rcode)
+	}
+
+	var timing string
+	if ok {
+		timing = fmt.Sprintf(" latency:%s", latency)
+	}
+	display.PrintfWithTime("[%s-%d] %s %s id:%d flags:%s len:%d%s%s%s\n", source, id,
+		color.HiYellowString("response %s", question), rcode, msg.Header.ID, explainDnsFlags(msg.Header),
+		size, timing, progress, explainDnsResources(msg))
+}
+
+// addTransfer accounts a message of a zone transfer, and tells whether the transfer is complete.
+// A full transfer ends with the second SOA record. An incremental one is a sequence of diffs,
+// each one starts with the SOA of the old version and the SOA of the new version,
+// so it ends with an SOA of the current serial in place of an old version,
+// or with the first SOA alone if the client is up to date.
+func (q *dnsQuery) addTransfer(msg *dnsmessage.Message) bool {
+	q.messages++
+	q.records += len(msg.Answers)
+	if len(msg.Answers) == 0 {
+		return true
+	}
+
+	done := false
+	for _, answer := range msg.Answers {
+		soa, ok := answer.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+
+		q.soas++
+		switch {
+		case q.soas == 1:
+			q.serial = soa.Serial
+		case !q.ixfr:
+			done = true
+		case q.soas%2 == 0 && soa.Serial == q.serial:
+			// the SOAs after the first one are old, new, old, new..., the last one is in place of an old one.
+			done = true
+		}
+	}
+
+	return done || q.ixfr && q.messages == 1 && q.records == 1 && q.soas == 1
+}
+
+func explainDnsFlags(h dnsmessage.Header) string {
+	var flags []string
+	if h.Response {
+		flags = append(flags, "qr")
+	}
+	if h.OpCode != 0 {
+		flags = append(flags, fmt.Sprintf("opcode=%d", h.OpCode))
+	}
+	if h.Authoritative {
+		flags = append(flags, "aa")
+	}
+	if h.Truncated {
+		flags = append(flags, "tc")
+	}
+	if h.RecursionDesired {
+		flags = append(flags, "rd")
+	}
+	if h.RecursionAvailable {
+		flags = append(flags, "ra")
+	}
+	if h.AuthenticData {
+		flags = append(flags, "ad")
+	}
+	if h.CheckingDisabled {
+		flags = append(flags, "cd")
+	}
+
+	return strings.Join(flags, ",")
+}
+
+func explainDnsQuestion(q dnsmessage.Question) string {
+	return fmt.Sprintf("%s %s %s", q.Name, explainDnsClass(q.Class), explainDnsType(q.Type))
+}
+
+func explainDnsResources(msg *dnsmessage.Message) string {
+	var builder strings.Builder
+	sections := []struct {
+		name      string
+		resources []dnsmessage.Resource
+	}{
+		{"answer", msg.Answers},
+		{"authority", msg.Authorities},
+		{"additional", msg.Additionals},
+	}
+	for _, section := range sections {
+		for _, res := range section.resources {
+			builder.WriteString(fmt.Sprintf("\n  %s: %s", section.name, explainDnsResource(res)))
+		}
+	}
+
+	return builder.String()
+}
+
+func explainDnsResource(res dnsmessage.Resource) string {
+	h := res.Header
+	if body, ok := res.Body.(*dnsmessage.OPTResource); ok {
+		// the class of an OPT record is the udp payload size
+		return fmt.Sprintf("OPT udp_size:%d options:%d", h.Class, len(body.Options))
+	}
+
+	var data string
+	switch body := res.Body.(type) {
+	case *dnsmessage.AResource:
+		data = net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		data = net.IP(body.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		data = body.CNAME.String()
+	case *dnsmessage.NSResource:
+		data = body.NS.String()
+	case *dnsmessage.PTRResource:
+		data = body.PTR.String()
+	case *dnsmessage.MXResource:
+		data = fmt.Sprintf("%d %s", body.Pref, body.MX)
+	case *dnsmessage.TXTResource:
+		data = fmt.Sprintf("%q", body.TXT)
+	case *dnsmessage.SRVResource:
+		data = fmt.Sprintf("%d %d %d %s", body.Priority, body.Weight, body.Port, body.Target)
+	case *dnsmessage.SOAResource:
+		data = fmt.Sprintf("%s %s serial:%d refresh:%d retry:%d expire:%d min_ttl:%d",
+			body.NS, body.MBox, body.Serial, body.Refresh, body.Retry, body.Expire, body.MinTTL)
+	case *dnsmessage.UnknownResource:
+		data = fmt.Sprintf("<%d bytes>", len(body.Data))
+	}
+
+	return fmt.Sprintf("%s %d %s %s %s", h.Name, h.TTL, explainDnsClass(h.Class), explainDnsType(h.Type), data)
+}
+
+func explainDnsClass(class dnsmessage.Class) string {
+	if class == dnsmessage.ClassINET {
+		return "IN"
+	}
+
+	return strings.TrimPrefix(class.String(), "Class")
+}
+
+func explainDnsRCode(rcode dnsmessage.RCode) string {
+	if name, ok := dnsRCodes[rcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("RCODE(%d)", rcode)
+}
+
+func explainDnsType(tp dnsmessage.Type) string {
+	return strings.TrimPrefix(tp.String(), "Type")
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDnsQueryAddTransfer(t *testing.T) {
+	// the records of each message, a number is the serial of an SOA, 0 is another record.
+	tests := []struct {
+		name     string
+		ixfr     bool
+		messages [][]uint32
+		done     []bool
+	}{
+		{
+			name:     "axfr",
+			messages: [][]uint32{{5, 0, 0}, {0, 0}, {0, 5}},
+			done:     []bool{false, false, true},
+		},
+		{
+			name:     "ixfr up to date",
+			ixfr:     true,
+			messages: [][]uint32{{5}},
+			done:     []bool{true},
+		},
+		{
+			name:     "ixfr full",
+			ixfr:     true,
+			messages: [][]uint32{{5, 0}, {0, 5}},
+			done:     []bool{false, true},
+		},
+		{
+			name: "ixfr diffs",
+			ixfr: true,
+			// 3 -> 4 deletes and adds a record, 4 -> 5 too, the SOAs of the diffs don't end it.
+			messages: [][]uint32{{5, 3, 0, 4, 0}, {4, 0, 5}, {0}, {5}},
+			done:     []bool{false, false, false, true},
+		},
+		{
+			name:     "empty",
+			ixfr:     true,
+			messages: [][]uint32{{}},
+			done:     []bool{true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := &dnsQuery{transfer: true, ixfr: test.ixfr}
+			for i, records := range test.messages {
+				msg := &dnsmessage.Message{}
+				for _, serial := range records {
+					var body dnsmessage.ResourceBody = &dnsmessage.AResource{}
+					if serial > 0 {
+						body = &dnsmessage.SOAResource{Serial: serial}
+					}
+					msg.Answers = append(msg.Answers, dnsmessage.Resource{Body: body})
+				}
+				if done := query.addTransfer(msg); done != test.done[i] {
+					t.Fatalf("message %d: expected done %t, got %t", i, test.done[i], done)
+				}
+			}
+		})
+	}
+}
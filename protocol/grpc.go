@@ -4,36 +4,228 @@ import (
 	"encoding/binary"
 	"fmt"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
-const grpcHeaderLen = 5
+const (
+	grpcHeaderLen = 5
+	// the max size of a message that we buffer, the larger ones are skipped.
+	grpcMaxMessageSize = 64 << 20
+)
 
-type grpcExplainer struct{}
+type (
+	grpcExplainer struct {
+		schema    *grpcSchema
+		reflector *grpcReflector
+		streams   map[grpcStreamKey]*grpcStream
+		lock      sync.Mutex
+	}
 
-func (g *grpcExplainer) explain(b []byte) string {
-	if len(b) < grpcHeaderLen {
-		return ""
+	grpcStreamKey struct {
+		source string
+		id     uint32
 	}
 
-	if int(b[0]) == 1 {
-		return ""
+	// grpcStream buffers the DATA of a stream in one direction,
+	// until the length-prefixed messages are complete.
+	grpcStream struct {
+		buf      []byte
+		messages int
+		// the bytes left of a message that is too large to buffer, they are discarded.
+		skip int
+	}
+
+	// grpcMessage is a length-prefixed message, index counts from 1 in the stream.
+	grpcMessage struct {
+		index      int
+		compressed bool
+		data       []byte
+	}
+)
+
+func newGrpcExplainer(schema *grpcSchema, reflector *grpcReflector) *grpcExplainer {
+	return &grpcExplainer{
+		schema:    schema,
+		reflector: reflector,
+		streams:   make(map[grpcStreamKey]*grpcStream),
 	}
+}
+
+func (g *grpcExplainer) explain(source string, stream uint32, path, encoding string, b []byte) string {
+	var builder strings.Builder
+	for _, msg := range g.readMessages(source, stream, b, &builder) {
+		if msg.compressed {
+			data, err := decompressGrpcMessage(encoding, msg.data)
+			if err != nil {
+				builder.WriteString(fmt.Sprintf("message #%d len:%d compressed:%s, %v\n",
+					msg.index, len(msg.data), encoding, err))
+				continue
+			}
+
+			builder.WriteString(fmt.Sprintf("message #%d len:%d compressed:%s uncompressed_len:%d\n",
+				msg.index, len(msg.data), encoding, len(data)))
+			msg.data = data
+		} else {
+			builder.WriteString(fmt.Sprintf("message #%d len:%d\n", msg.index, len(msg.data)))
+		}
+		builder.WriteString(g.explainMessage(path, source, msg.data))
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// readMessages appends b to the buffer of the stream, and returns the complete messages.
+// The buffer is shared with closeStream, which is called by the other direction on reset,
+// so it's only touched with the lock held, the messages are decoded after.
+func (g *grpcExplainer) readMessages(source string, stream uint32, b []byte, builder *strings.Builder) []grpcMessage {
+	key := grpcStreamKey{source: source, id: stream}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	s, ok := g.streams[key]
+	if !ok {
+		s = new(grpcStream)
+		g.streams[key] = s
+	}
+	if s.skip > 0 {
+		n := min(s.skip, len(b))
+		s.skip -= n
+		b = b[n:]
+	}
+	s.buf = append(s.buf, b...)
+
+	var messages []grpcMessage
+	for len(s.buf) >= grpcHeaderLen {
+		compressed := s.buf[0] == 1
+		// 4 bytes as the pb message length
+		size := int(binary.BigEndian.Uint32(s.buf[1:grpcHeaderLen]))
+		if size > grpcMaxMessageSize {
+			s.messages++
+			builder.WriteString(fmt.Sprintf("message #%d too large, len:%d, skipped\n", s.messages, size))
+			if len(s.buf) < grpcHeaderLen+size {
+				s.skip = grpcHeaderLen + size - len(s.buf)
+				s.buf = nil
+				break
+			}
+			s.buf = s.buf[grpcHeaderLen+size:]
+			continue
+		}
+		if len(s.buf) < grpcHeaderLen+size {
+			break
+		}
+
+		s.messages++
+		messages = append(messages, grpcMessage{
+			index:      s.messages,
+			compressed: compressed,
+			data:       s.buf[grpcHeaderLen : grpcHeaderLen+size],
+		})
+		s.buf = s.buf[grpcHeaderLen+size:]
+	}
+
+	// keep the unconsumed bytes only, not the whole underlying array.
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+
+	return messages
+}
+
+// closeStream reports the incomplete message of a direction,
+// the stream is kept to count the messages until the summary.
+func (g *grpcExplainer) closeStream(source string, stream uint32) string {
+	key := grpcStreamKey{source: source, id: stream}
+	g.lock.Lock()
+	defer g.lock.Unlock()
 
-	b = b[1:]
-	// 4 bytes as the pb message length
-	size := binary.BigEndian.Uint32(b)
-	b = b[4:]
-	if len(b) < int(size) {
+	s, ok := g.streams[key]
+	if !ok {
 		return ""
 	}
+	s.skip = 0
+	if len(s.buf) == 0 {
+		return ""
+	}
+
+	left := len(s.buf)
+	s.buf = nil
+	return fmt.Sprintf("incomplete message, %d bytes left at the end of the stream\n", left)
+}
+
+func (g *grpcExplainer) summary(stream *http2Stream) string {
+	var messages [2]int
+	g.lock.Lock()
+	for i, source := range []string{ClientSide, ServerSide} {
+		key := grpcStreamKey{source: source, id: stream.id}
+		if s, ok := g.streams[key]; ok {
+			messages[i] = s.messages
+			delete(g.streams, key)
+		}
+	}
+	g.lock.Unlock()
+
+	return explainGrpcCall(stream, messages[0], messages[1], grpcDetailTypes{schema: g.schema})
+}
+
+func (g *grpcExplainer) explainMessage(path, source string, b []byte) string {
+	if desc, schema := g.findMessage(path, source); desc != nil {
+		if info, ok := g.explainWithSchema(schema, desc, b); ok {
+			return info
+		}
+	}
 
 	var builder strings.Builder
-	g.explainFields(b[:size], &builder, 0)
+	g.explainFields(b, &builder, 0)
 	return builder.String()
 }
 
+// findMessage finds the request message of path for the client side,
+// and the response message for the server side.
+// The given schemas are preferred, the server reflection is the fallback.
+func (g *grpcExplainer) findMessage(path, source string) (protoreflect.MessageDescriptor, *grpcSchema) {
+	method, schema := g.schema.findMethod(path), g.schema
+	if method == nil && g.reflector != nil {
+		method, schema = g.reflector.findMethod(path)
+	}
+	if method == nil {
+		return nil, nil
+	}
+
+	if source == ClientSide {
+		return method.Input(), schema
+	}
+
+	return method.Output(), schema
+}
+
+func (g *grpcExplainer) explainWithSchema(schema *grpcSchema, desc protoreflect.MessageDescriptor,
+	b []byte) (string, bool) {
+	msg := dynamicpb.NewMessage(desc)
+	if err := (proto.UnmarshalOptions{Resolver: schema.types}).Unmarshal(b, msg); err != nil {
+		return "", false
+	}
+
+	content, err := protojson.MarshalOptions{
+		Multiline: true,
+		Indent:    "  ",
+		Resolver:  schema.types,
+	}.Marshal(msg)
+	if err != nil {
+		return "", false
+	}
+
+	return fmt.Sprintf("%s %s", desc.FullName(), content), true
+}
+
 func (g *grpcExplainer) explainFields(b []byte, builder *strings.Builder, depth int) bool {
 	for len(b) > 0 {
 		num, tp, n := protowire.ConsumeTag(b)
@@ -44,37 +236,40 @@ func (g *grpcExplainer) explainFields(b []byte, builder *strings.Builder, depth
 
 		switch tp {
 		case protowire.VarintType:
-			_, n = protowire.ConsumeVarint(b)
+			v, n := protowire.ConsumeVarint(b)
 			if n < 0 {
 				return false
 			}
 			b = b[n:]
-			write(builder, fmt.Sprintf("#%d: (varint)\n", num), depth)
+			write(builder, fmt.Sprintf("#%d: %d (varint)\n", num, v), depth)
 		case protowire.Fixed32Type:
-			_, n = protowire.ConsumeFixed32(b)
+			v, n := protowire.ConsumeFixed32(b)
 			if n < 0 {
 				return false
 			}
 			b = b[n:]
-			write(builder, fmt.Sprintf("#%d: (fixed32)\n", num), depth)
+			write(builder, fmt.Sprintf("#%d: %d (fixed32)\n", num, v), depth)
 		case protowire.Fixed64Type:
-			_, n = protowire.ConsumeFixed64(b)
+			v, n := protowire.ConsumeFixed64(b)
 			if n < 0 {
 				return false
 			}
 			b = b[n:]
-			write(builder, fmt.Sprintf("#%d: (fixed64)\n", num), depth)
+			write(builder, fmt.Sprintf("#%d: %d (fixed64)\n", num, v), depth)
 		case protowire.BytesType:
 			v, n := protowire.ConsumeBytes(b)
 			if n < 0 {
 				return false
 			}
 			var buf strings.Builder
-			if g.explainFields(b[1:n], &buf, depth+1) {
+			switch {
+			case len(v) > 0 && isPrintable(v):
+				write(builder, fmt.Sprintf("#%d: %q\n", num, v), depth)
+			case g.explainFields(v, &buf, depth+1):
 				write(builder, fmt.Sprintf("#%d:\n", num), depth)
 				builder.WriteString(buf.String())
-			} else {
-				write(builder, fmt.Sprintf("#%d: %s\n", num, v), depth)
+			default:
+				write(builder, fmt.Sprintf("#%d: %q\n", num, v), depth)
 			}
 			b = b[n:]
 		default:
@@ -89,6 +284,20 @@ func (g *grpcExplainer) explainFields(b []byte, builder *strings.Builder, depth
 	return true
 }
 
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func write(builder *strings.Builder, val string, depth int) {
 	for i := 0; i < depth; i++ {
 		builder.WriteString("  ")
@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func grpcTestMessage(size int, data []byte) []byte {
+	header := make([]byte, grpcHeaderLen)
+	binary.BigEndian.PutUint32(header[1:], uint32(size))
+	return append(header, data...)
+}
+
+func TestGrpcSkipTooLargeMessage(t *testing.T) {
+	size := grpcMaxMessageSize + 1
+	large := grpcTestMessage(size, make([]byte, size))
+	half := len(large) / 2
+	// field 1, varint 150.
+	small := grpcTestMessage(3, []byte{0x08, 0x96, 0x01})
+
+	g := newGrpcExplainer(nil, nil)
+	info := g.explain(ClientSide, 1, "/test.Service/Call", "", large[:half])
+	if !strings.Contains(info, "message #1 too large") {
+		t.Fatalf("expected the large message to be skipped, got %q", info)
+	}
+
+	info = g.explain(ClientSide, 1, "/test.Service/Call", "", append(large[half:], small...))
+	if !strings.HasPrefix(info, "message #2 len:3\n") || !strings.Contains(info, "150") {
+		t.Fatalf("expected the message after the large one, got %q", info)
+	}
+	if s := g.streams[grpcStreamKey{source: ClientSide, id: 1}]; s.skip != 0 || len(s.buf) != 0 {
+		t.Fatalf("expected nothing left, got skip:%d buf:%d", s.skip, len(s.buf))
+	}
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// decompressGrpcMessage decompresses a message with the codec of grpc-encoding.
+func decompressGrpcMessage(encoding string, b []byte) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return readGrpcMessage(reader)
+	case "deflate":
+		// deflate is zlib wrapped in http content coding, some implementations send it raw.
+		if reader, err := zlib.NewReader(bytes.NewReader(b)); err == nil {
+			if data, err := readGrpcMessage(reader); err == nil {
+				return data, nil
+			}
+		}
+		return readGrpcMessage(flate.NewReader(bytes.NewReader(b)))
+	case "snappy":
+		// the framing format first, then the block format.
+		if data, err := readGrpcMessage(snappy.NewReader(bytes.NewReader(b))); err == nil {
+			return data, nil
+		}
+		return snappy.Decode(nil, b)
+	case "zstd":
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(grpcMaxMessageSize))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(b, nil)
+	case "":
+		return nil, fmt.Errorf("compressed without grpc-encoding")
+	default:
+		return nil, fmt.Errorf("unsupported grpc-encoding: %s", encoding)
+	}
+}
+
+func readGrpcMessage(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, grpcMaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > grpcMaxMessageSize {
+		return nil, fmt.Errorf("decompressed message larger than %d bytes", grpcMaxMessageSize)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,359 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	grpcReflectionTimeout = 3 * time.Second
+	// the max rounds to fetch the dependencies that are not sent along with a file.
+	grpcReflectionRounds = 5
+	// the time to wait before looking up a service again after a failure.
+	grpcReflectionRetry = time.Minute
+	grpcUnimplemented   = "12"
+
+	// field numbers of grpc.reflection.v1.ServerReflectionRequest
+	reflectionRequestFileByFilename       = 3
+	reflectionRequestFileContainingSymbol = 4
+	// field numbers of grpc.reflection.v1.ServerReflectionResponse
+	reflectionResponseFileDescriptor = 4
+	reflectionResponseError          = 7
+)
+
+var (
+	errGrpcUnimplemented = errors.New("reflection service not implemented")
+
+	grpcReflectionServices = []string{
+		"grpc.reflection.v1.ServerReflection",
+		"grpc.reflection.v1alpha.ServerReflection",
+	}
+)
+
+type (
+	// grpcReflector looks up the schemas with the server reflection service of the remote,
+	// each service is queried once in the background, and again after retry if it failed.
+	grpcReflector struct {
+		remote  string
+		client  *http.Client
+		retry   time.Duration
+		lookups map[string]*grpcLookup
+		lock    sync.Mutex
+	}
+
+	// grpcLookup is the lookup of a service, the schema or the failure time is set before done is closed.
+	grpcLookup struct {
+		schema *grpcSchema
+		failed time.Time
+		done   chan struct{}
+	}
+)
+
+func newGrpcReflector(remote string) *grpcReflector {
+	return &grpcReflector{
+		remote: remote,
+		client: &http.Client{
+			Transport: &http2.Transport{
+				// gRPC without tls, the same as what we can decode.
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, network, addr)
+				},
+			},
+			Timeout: grpcReflectionTimeout,
+		},
+		retry:   grpcReflectionRetry,
+		lookups: make(map[string]*grpcLookup),
+	}
+}
+
+// findMethod finds the method by the :path of a gRPC request,
+// and returns the schema that the method belongs to.
+// It doesn't wait for the reflection, which would block the relaying,
+// so the messages are not decoded with the schema until the lookup of the service is done.
+func (r *grpcReflector) findMethod(path string) (protoreflect.MethodDescriptor, *grpcSchema) {
+	path = strings.TrimPrefix(path, "/")
+	index := strings.LastIndexByte(path, '/')
+	if index <= 0 {
+		return nil, nil
+	}
+	service := path[:index]
+
+	r.lock.Lock()
+	lookup, ok := r.lookups[service]
+	if !ok || lookup.expired(r.retry) {
+		lookup = &grpcLookup{done: make(chan struct{})}
+		r.lookups[service] = lookup
+		go r.lookup(service, lookup)
+	}
+	r.lock.Unlock()
+
+	select {
+	case <-lookup.done:
+		return lookup.schema.findMethod(path), lookup.schema
+	default:
+		return nil, nil
+	}
+}
+
+func (r *grpcReflector) lookup(service string, lookup *grpcLookup) {
+	defer close(lookup.done)
+
+	schema, err := r.resolve(service)
+	if err != nil {
+		display.PrintlnWithTime(color.HiRedString("[x] gRPC reflection of %s failed: %v, retry in %s",
+			service, err, r.retry))
+		lookup.failed = time.Now()
+		return
+	}
+
+	lookup.schema = schema
+}
+
+// expired tells whether the lookup failed longer than retry ago, then the service is looked up again.
+func (l *grpcLookup) expired(retry time.Duration) bool {
+	select {
+	case <-l.done:
+		return l.schema == nil && time.Since(l.failed) >= retry
+	default:
+		return false
+	}
+}
+
+func (r *grpcReflector) resolve(service string) (*grpcSchema, error) {
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	protos, err := r.query(reflectionRequestFileContainingSymbol, service)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range protos {
+		files[file.GetName()] = file
+	}
+
+	for i := 0; i < grpcReflectionRounds; i++ {
+		var missing []string
+		for _, file := range files {
+			for _, dep := range file.GetDependency() {
+				if _, ok := files[dep]; !ok {
+					missing = append(missing, dep)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+
+		for _, name := range missing {
+			protos, err := r.query(reflectionRequestFileByFilename, name)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range protos {
+				files[file.GetName()] = file
+			}
+		}
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	for _, file := range files {
+		set.File = append(set.File, file)
+	}
+	registry, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcSchema{
+		files: registry,
+		types: dynamicpb.NewTypes(registry),
+	}, nil
+}
+
+// query sends a ServerReflectionRequest with the given field set to value,
+// and tries the v1alpha service if v1 is not implemented by the remote.
+func (r *grpcReflector) query(field protowire.Number, value string) ([]*descriptorpb.FileDescriptorProto, error) {
+	var req []byte
+	req = protowire.AppendTag(req, field, protowire.BytesType)
+	req = protowire.AppendString(req, value)
+
+	var err error
+	for _, service := range grpcReflectionServices {
+		var protos []*descriptorpb.FileDescriptorProto
+		protos, err = r.call(service, req)
+		if !errors.Is(err, errGrpcUnimplemented) {
+			return protos, err
+		}
+	}
+
+	return nil, err
+}
+
+func (r *grpcReflector) call(service string, req []byte) ([]*descriptorpb.FileDescriptorProto, error) {
+	body := make([]byte, grpcHeaderLen, grpcHeaderLen+len(req))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(req)))
+	body = append(body, req...)
+
+	url := fmt.Sprintf("http://%s/%s/ServerReflectionInfo", r.remote, service)
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("content-type", "application/grpc")
+	httpReq.Header.Set("te", "trailers")
+
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// trailers-only responses carry the status in the headers.
+	status := resp.Trailer.Get("grpc-status")
+	message := resp.Trailer.Get("grpc-message")
+	if len(status) == 0 {
+		status = resp.Header.Get("grpc-status")
+		message = resp.Header.Get("grpc-message")
+	}
+	switch status {
+	case "", "0":
+	case grpcUnimplemented:
+		return nil, errGrpcUnimplemented
+	default:
+		return nil, fmt.Errorf("grpc-status: %s, grpc-message: %s", status, message)
+	}
+
+	var protos []*descriptorpb.FileDescriptorProto
+	for len(content) >= grpcHeaderLen {
+		size := int(binary.BigEndian.Uint32(content[1:grpcHeaderLen]))
+		if len(content) < grpcHeaderLen+size {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		files, err := parseReflectionResponse(content[grpcHeaderLen : grpcHeaderLen+size])
+		if err != nil {
+			return nil, err
+		}
+		protos = append(protos, files...)
+		content = content[grpcHeaderLen+size:]
+	}
+
+	return protos, nil
+}
+
+func parseReflectionResponse(b []byte) ([]*descriptorpb.FileDescriptorProto, error) {
+	var protos []*descriptorpb.FileDescriptorProto
+	for len(b) > 0 {
+		num, tp, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if tp != protowire.BytesType || (num != reflectionResponseFileDescriptor && num != reflectionResponseError) {
+			n = protowire.ConsumeFieldValue(num, tp, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num == reflectionResponseError {
+			return nil, parseReflectionError(v)
+		}
+
+		// FileDescriptorResponse, with repeated bytes file_descriptor_proto = 1
+		for len(v) > 0 {
+			fieldNum, fieldType, n := protowire.ConsumeTag(v)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			v = v[n:]
+
+			if fieldNum != 1 || fieldType != protowire.BytesType {
+				n = protowire.ConsumeFieldValue(fieldNum, fieldType, v)
+				if n < 0 {
+					return nil, protowire.ParseError(n)
+				}
+				v = v[n:]
+				continue
+			}
+
+			content, n := protowire.ConsumeBytes(v)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			v = v[n:]
+
+			file := new(descriptorpb.FileDescriptorProto)
+			if err := proto.Unmarshal(content, file); err != nil {
+				return nil, err
+			}
+			protos = append(protos, file)
+		}
+	}
+
+	return protos, nil
+}
+
+// parseReflectionError parses an ErrorResponse, with int32 error_code = 1 and string error_message = 2.
+func parseReflectionError(b []byte) error {
+	var code uint64
+	var message string
+	for len(b) > 0 {
+		num, tp, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && tp == protowire.VarintType:
+			code, n = protowire.ConsumeVarint(b)
+		case num == 2 && tp == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			message = string(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, tp, b)
+		}
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+	}
+
+	return fmt.Errorf("reflection error %d: %s", code, message)
+}
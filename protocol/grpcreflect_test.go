@@ -0,0 +1,235 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// reflectionServer is a stand-in of the server reflection service, only v1alpha is implemented,
+// and the files are only sent on request, not along with their dependencies.
+type reflectionServer struct {
+	files   map[string]*descriptorpb.FileDescriptorProto
+	symbols map[string]string
+	delay   time.Duration
+	lookups int32
+	// the symbol lookups to fail before the service is ready.
+	failures int32
+}
+
+func (s *reflectionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo" {
+		w.Header().Set("grpc-status", grpcUnimplemented)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if len(body) < grpcHeaderLen {
+		w.Header().Set("grpc-status", "3")
+		return
+	}
+	num, _, n := protowire.ConsumeTag(body[grpcHeaderLen:])
+	value, _ := protowire.ConsumeString(body[grpcHeaderLen+n:])
+	name := value
+	if num == reflectionRequestFileContainingSymbol {
+		atomic.AddInt32(&s.lookups, 1)
+		if atomic.AddInt32(&s.failures, -1) >= 0 {
+			w.Header().Set("grpc-status", "14")
+			return
+		}
+		name = s.symbols[value]
+	}
+	time.Sleep(s.delay)
+
+	w.Header().Set("content-type", "application/grpc")
+	w.Header().Set("trailer", "grpc-status")
+	file, ok := s.files[name]
+	if !ok {
+		var resp []byte
+		resp = protowire.AppendTag(resp, 1, protowire.VarintType)
+		resp = protowire.AppendVarint(resp, 5)
+		resp = protowire.AppendTag(resp, 2, protowire.BytesType)
+		resp = protowire.AppendString(resp, "not found: "+value)
+		_, _ = w.Write(reflectionFrame(reflectionResponseError, resp))
+		w.Header().Set("grpc-status", "0")
+		return
+	}
+
+	content, _ := proto.Marshal(file)
+	var resp []byte
+	resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+	resp = protowire.AppendBytes(resp, content)
+	_, _ = w.Write(reflectionFrame(reflectionResponseFileDescriptor, resp))
+	w.Header().Set("grpc-status", "0")
+}
+
+func reflectionFrame(field protowire.Number, value []byte) []byte {
+	var msg []byte
+	msg = protowire.AppendTag(msg, field, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, value)
+	frame := make([]byte, grpcHeaderLen, grpcHeaderLen+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func newReflectionServer(t *testing.T, delay time.Duration) (*reflectionServer, string) {
+	dep := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("dep.proto"),
+		Package: proto.String("dep"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Reply"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("message"),
+				Number:   proto.Int32(1),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				JsonName: proto.String("message"),
+			}},
+		}},
+	}
+	greeter := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("greeter.proto"),
+		Package:    proto.String("test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"dep.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("HelloRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("name"),
+				Number:   proto.Int32(1),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				JsonName: proto.String("name"),
+			}},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Hello"),
+				InputType:  proto.String(".test.HelloRequest"),
+				OutputType: proto.String(".dep.Reply"),
+			}},
+		}},
+	}
+
+	server := &reflectionServer{
+		files: map[string]*descriptorpb.FileDescriptorProto{
+			"dep.proto":     dep,
+			"greeter.proto": greeter,
+		},
+		symbols: map[string]string{"test.Greeter": "greeter.proto"},
+		delay:   delay,
+	}
+	ts := httptest.NewServer(h2c.NewHandler(server, &http2.Server{}))
+	t.Cleanup(ts.Close)
+
+	return server, strings.TrimPrefix(ts.URL, "http://")
+}
+
+// waitMethod waits for the lookup of the service of path, the first calls return nil until it's done.
+func waitMethod(t *testing.T, reflector *grpcReflector, path string) (string, string) {
+	deadline := time.Now().Add(2 * grpcReflectionTimeout)
+	for time.Now().Before(deadline) {
+		if method, _ := reflector.findMethod(path); method != nil {
+			return string(method.Input().FullName()), string(method.Output().FullName())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("method %s not found", path)
+	return "", ""
+}
+
+func TestGrpcReflectorFindMethod(t *testing.T) {
+	server, addr := newReflectionServer(t, 0)
+	reflector := newGrpcReflector(addr)
+
+	input, output := waitMethod(t, reflector, "/test.Greeter/Hello")
+	if input != "test.HelloRequest" || output != "dep.Reply" {
+		t.Fatalf("unexpected method %s -> %s", input, output)
+	}
+
+	if method, _ := reflector.findMethod("/test.Greeter/Missing"); method != nil {
+		t.Fatalf("unexpected method %s", method.FullName())
+	}
+	if method, _ := reflector.findMethod("/test.Unknown/Hello"); method != nil {
+		t.Fatalf("unexpected method %s", method.FullName())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if method, _ := reflector.findMethod("/test.Unknown/Hello"); method != nil {
+		t.Fatalf("unexpected method %s", method.FullName())
+	}
+	if lookups := atomic.LoadInt32(&server.lookups); lookups != 2 {
+		t.Fatalf("expected 2 symbol lookups, got %d", lookups)
+	}
+}
+
+func TestGrpcReflectorDoesNotBlock(t *testing.T) {
+	server, addr := newReflectionServer(t, 500*time.Millisecond)
+	reflector := newGrpcReflector(addr)
+
+	// the callers of all connections return at once, and share one lookup of the service.
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if method, _ := reflector.findMethod("/test.Greeter/Hello"); method != nil {
+				t.Errorf("unexpected method before the lookup is done")
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("findMethod blocked for %s", elapsed)
+	}
+
+	waitMethod(t, reflector, "/test.Greeter/Hello")
+	if lookups := atomic.LoadInt32(&server.lookups); lookups != 1 {
+		t.Fatalf("expected 1 symbol lookup, got %d", lookups)
+	}
+}
+
+func TestGrpcReflectorRetry(t *testing.T) {
+	server, addr := newReflectionServer(t, 0)
+	server.failures = 1
+	reflector := newGrpcReflector(addr)
+	reflector.retry = 300 * time.Millisecond
+
+	// the first lookup fails, and it's not retried before the backoff.
+	if method, _ := reflector.findMethod("/test.Greeter/Hello"); method != nil {
+		t.Fatalf("unexpected method %s", method.FullName())
+	}
+	reflector.lock.Lock()
+	lookup := reflector.lookups["test.Greeter"]
+	reflector.lock.Unlock()
+	<-lookup.done
+	if method, _ := reflector.findMethod("/test.Greeter/Hello"); method != nil {
+		t.Fatalf("unexpected method %s", method.FullName())
+	}
+	if lookups := atomic.LoadInt32(&server.lookups); lookups != 1 {
+		t.Fatalf("expected 1 symbol lookup before the backoff, got %d", lookups)
+	}
+
+	input, output := waitMethod(t, reflector, "/test.Greeter/Hello")
+	if input != "test.HelloRequest" || output != "dep.Reply" {
+		t.Fatalf("unexpected method %s -> %s", input, output)
+	}
+	if lookups := atomic.LoadInt32(&server.lookups); lookups != 2 {
+		t.Fatalf("expected 2 symbol lookups, got %d", lookups)
+	}
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcSchema resolves gRPC methods to the descriptors of their messages.
+type grpcSchema struct {
+	files *protoregistry.Files
+	types *dynamicpb.Types
+}
+
+func loadGrpcSchema(protoFiles, protoPaths []string, descriptorSet string) (*grpcSchema, error) {
+	files := new(protoregistry.Files)
+
+	if len(descriptorSet) > 0 {
+		content, err := os.ReadFile(descriptorSet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read descriptor set: %w", err)
+		}
+
+		var set descriptorpb.FileDescriptorSet
+		if err := proto.Unmarshal(content, &set); err != nil {
+			return nil, fmt.Errorf("failed to parse descriptor set %s: %w", descriptorSet, err)
+		}
+
+		if files, err = protodesc.NewFiles(&set); err != nil {
+			return nil, fmt.Errorf("invalid descriptor set %s: %w", descriptorSet, err)
+		}
+	}
+
+	if len(protoFiles) > 0 {
+		compiler := protocompile.Compiler{
+			Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+				ImportPaths: protoPaths,
+			}),
+		}
+		compiled, err := compiler.Compile(context.Background(), protoFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile proto files: %w", err)
+		}
+
+		for _, file := range compiled {
+			if err := registerProtoFile(files, file); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &grpcSchema{
+		files: files,
+		types: dynamicpb.NewTypes(files),
+	}, nil
+}
+
+// findMethod finds the method by the :path of a gRPC request, like /pkg.Service/Method.
+func (s *grpcSchema) findMethod(path string) protoreflect.MethodDescriptor {
+	if s == nil {
+		return nil
+	}
+
+	path = strings.TrimPrefix(path, "/")
+	index := strings.LastIndexByte(path, '/')
+	if index < 0 {
+		return nil
+	}
+
+	desc, err := s.files.FindDescriptorByName(protoreflect.FullName(path[:index]))
+	if err != nil {
+		return nil
+	}
+
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+
+	return service.Methods().ByName(protoreflect.Name(path[index+1:]))
+}
+
+func registerProtoFile(files *protoregistry.Files, file protoreflect.FileDescriptor) error {
+	if _, err := files.FindFileByPath(file.Path()); err == nil {
+		return nil
+	}
+
+	imports := file.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		if err := registerProtoFile(files, imports.Get(i).FileDescriptor); err != nil {
+			return err
+		}
+	}
+
+	if err := files.RegisterFile(file); err != nil {
+		return fmt.Errorf("failed to register %s: %w", file.Path(), err)
+	}
+
+	return nil
+}
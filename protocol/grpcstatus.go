@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var grpcCodes = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// grpcDetailTypes resolves the types of the status details,
+// the given schemas first, then the well-known ones in google.rpc.
+type grpcDetailTypes struct {
+	schema *grpcSchema
+}
+
+func (t grpcDetailTypes) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	if t.schema != nil {
+		if mt, err := t.schema.types.FindMessageByName(name); err == nil {
+			return mt, nil
+		}
+	}
+
+	return protoregistry.GlobalTypes.FindMessageByName(name)
+}
+
+func (t grpcDetailTypes) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	if t.schema != nil {
+		if mt, err := t.schema.types.FindMessageByURL(url); err == nil {
+			return mt, nil
+		}
+	}
+
+	return protoregistry.GlobalTypes.FindMessageByURL(url)
+}
+
+func (t grpcDetailTypes) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByName(field)
+}
+
+func (t grpcDetailTypes) FindExtensionByNumber(message protoreflect.FullName,
+	field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
+
+// explainGrpcCall describes a call in one line, with the status details if any.
+func explainGrpcCall(stream *http2Stream, requests, responses int, types grpcDetailTypes) string {
+	// a trailers-only response carries the status in the headers.
+	trailers := stream.trailers
+	if len(trailers) == 0 {
+		trailers = stream.response
+	}
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("%s authority:%s requests:%d responses:%d duration:%s",
+		color.HiYellowString("call %s", stream.path), headerValue(stream.request, ":authority"),
+		requests, responses, time.Since(stream.start)))
+
+	switch status := headerValue(trailers, "grpc-status"); {
+	case len(status) == 0:
+		builder.WriteString(" grpc-status:none")
+	case status == "0":
+		builder.WriteString(" grpc-status:" + explainGrpcCode(status))
+	default:
+		builder.WriteString(color.HiRedString(" grpc-status:%s", explainGrpcCode(status)))
+	}
+	if message := headerValue(trailers, "grpc-message"); len(message) > 0 {
+		// grpc-message is percent encoded.
+		if unescaped, err := url.PathUnescape(message); err == nil {
+			message = unescaped
+		}
+		builder.WriteString(fmt.Sprintf(" grpc-message:%q", message))
+	}
+	if len(stream.reset) > 0 {
+		builder.WriteString(color.HiRedString(" reset:%s", stream.reset))
+	}
+	builder.WriteString("\n")
+
+	if details := headerValue(trailers, "grpc-status-details-bin"); len(details) > 0 {
+		builder.WriteString(explainGrpcStatusDetails(details, types))
+	}
+
+	return builder.String()
+}
+
+func explainGrpcCode(status string) string {
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 0 || code >= len(grpcCodes) {
+		return status
+	}
+
+	return fmt.Sprintf("%s(%d)", grpcCodes[code], code)
+}
+
+// explainGrpcStatusDetails decodes grpc-status-details-bin, a base64 encoded google.rpc.Status.
+func explainGrpcStatusDetails(value string, types grpcDetailTypes) string {
+	// binary headers are sent without padding, but accepted with it.
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return fmt.Sprintf("  invalid grpc-status-details-bin: %v\n", err)
+	}
+
+	var status statuspb.Status
+	if err := proto.Unmarshal(b, &status); err != nil {
+		return fmt.Sprintf("  invalid grpc-status-details-bin: %v\n", err)
+	}
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("  status: %s %q\n", explainGrpcCode(strconv.Itoa(int(status.Code))),
+		status.Message))
+	for _, detail := range status.Details {
+		builder.WriteString(fmt.Sprintf("  detail: %s\n", explainGrpcDetail(detail, types)))
+	}
+
+	return builder.String()
+}
+
+func explainGrpcDetail(detail *anypb.Any, types grpcDetailTypes) string {
+	msg, err := anypb.UnmarshalNew(detail, proto.UnmarshalOptions{Resolver: types})
+	if err != nil {
+		return fmt.Sprintf("%s len:%d", detail.TypeUrl, len(detail.Value))
+	}
+
+	content, err := protojson.MarshalOptions{Resolver: types}.Marshal(msg)
+	if err != nil {
+		return fmt.Sprintf("%s len:%d", detail.TypeUrl, len(detail.Value))
+	}
+
+	return fmt.Sprintf("%s %s", msg.ProtoReflect().Descriptor().FullName(), content)
+}
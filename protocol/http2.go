@@ -6,7 +6,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/fatih/color"
 	"github.com/kevwan/tproxy/display"
@@ -18,190 +20,537 @@ const (
 	http2HeaderLen          = 9
 	http2Preface            = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 	http2SettingsPayloadLen = 6
+	// the initial SETTINGS_HEADER_TABLE_SIZE defined by RFC 7540.
+	http2HeaderTableSize = 4096
 )
 
 type (
+	// dataExplainer explains the DATA frames of the streams,
+	// the payloads of a stream are passed in order, and closeStream is called at the end.
 	dataExplainer interface {
-		explain(b []byte) string
+		explain(source string, stream uint32, path, encoding string, b []byte) string
+		closeStream(source string, stream uint32) string
+		// summary describes the stream after it's closed.
+		summary(stream *http2Stream) string
 	}
 
+	// http2Interop is shared by both directions of a connection.
 	http2Interop struct {
 		explainer dataExplainer
 		protocol  string
+		// frames is the frame view, otherwise the call view of the explainer.
+		frames bool
+		// keepalive is the keepalive view, if enabled, the other views are off.
+		keepalive *http2Keepalive
+		streams   map[uint32]*http2Stream
+		// the hpack decoder and the pending header block of the frames sent by each side,
+		// the dynamic tables live as long as the connection.
+		decoders map[string]*hpack.Decoder
+		blocks   map[string]*http2HeaderBlock
+		// the connection windows of each sender, and the initial stream windows set by each side.
+		windows        map[string]*http2Window
+		initialWindows map[string]int64
+		lock           sync.Mutex
+	}
+
+	// http2HeaderBlock is a header block that is continued by CONTINUATION frames.
+	http2HeaderBlock struct {
+		frame    http2.FrameHeader
+		promised uint32
+		fragment []byte
 	}
 )
 
+func newHttp2Interop(protocol, client string, explainer dataExplainer) *http2Interop {
+	var keepalive *http2Keepalive
+	if http2KeepaliveView {
+		keepalive = newHttp2Keepalive(client)
+	}
+
+	return &http2Interop{
+		explainer: explainer,
+		protocol:  protocol,
+		frames:    explainer == nil || http2Verbose,
+		keepalive: keepalive,
+		streams:   make(map[uint32]*http2Stream),
+		decoders: map[string]*hpack.Decoder{
+			ClientSide: hpack.NewDecoder(http2HeaderTableSize, nil),
+			ServerSide: hpack.NewDecoder(http2HeaderTableSize, nil),
+		},
+		blocks: make(map[string]*http2HeaderBlock),
+		windows: map[string]*http2Window{
+			ClientSide: {size: http2InitialWindowSize},
+			ServerSide: {size: http2InitialWindowSize},
+		},
+		initialWindows: map[string]int64{
+			ClientSide: http2InitialWindowSize,
+			ServerSide: http2InitialWindowSize,
+		},
+	}
+}
+
 func (i *http2Interop) Dump(r io.Reader, source string, id int, quiet bool) {
-	i.readPreface(r, source, id)
+	r = i.readPreface(r, source, id, quiet)
+
+	if i.keepalive != nil {
+		defer func() {
+			i.keepalive.close(source)
+			i.printKeepalive(source, id, quiet)
+		}()
+	}
 
-	data := make([]byte, bufferSize)
+	header := make([]byte, http2HeaderLen)
 	for {
-		n, err := r.Read(data)
-		if n > 0 && !quiet {
-			var buf strings.Builder
-			buf.WriteString(color.HiGreenString("from %s [%d]\n", source, id))
-
-			var index int
-			for index < n {
-				frameInfo, moreInfo, offset := i.explain(data[index:n])
-				protocol := i.protocol
-				if len(protocol) == 0 {
-					protocol = http2Protocol
-				}
-				buf.WriteString(fmt.Sprintf("%s%s%s\n",
-					color.HiBlueString("%s:(", protocol),
-					color.HiYellowString(frameInfo),
-					color.HiBlueString(")")))
-				end := index + offset
-				if end > n {
-					end = n
-				}
-				buf.WriteString(fmt.Sprint(hex.Dump(data[index:end])))
-				if len(moreInfo) > 0 {
-					buf.WriteString(fmt.Sprintf("\n%s\n\n", strings.TrimSpace(moreInfo)))
-				}
-				index += offset
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err != io.EOF {
+				display.PrintfWithTime("[%s-%d] unable to read http2 frame: %v\n", source, id, err)
 			}
-
-			display.PrintfWithTime("%s\n\n", strings.TrimSpace(buf.String()))
+			drain(r)
+			return
 		}
-		if err != nil && err != io.EOF {
-			fmt.Printf("unable to read data %v", err)
-			break
-		}
-		if n == 0 {
-			break
+
+		frame, err := http2.ReadFrameHeader(bytes.NewReader(header))
+		if err != nil {
+			drain(r)
+			return
 		}
-	}
-}
 
-func (i *http2Interop) explain(b []byte) (string, string, int) {
-	if len(b) < http2HeaderLen {
-		return "", "", len(b)
-	}
+		// the frame length is at most 2^24-1, read the whole frame, even for large DATA frames,
+		// to keep in sync with the frame boundaries.
+		data := make([]byte, http2HeaderLen+int(frame.Length))
+		copy(data, header)
+		if _, err := io.ReadFull(r, data[http2HeaderLen:]); err != nil {
+			display.PrintfWithTime("[%s-%d] unable to read http2 frame: %v\n", source, id, err)
+			drain(r)
+			return
+		}
 
-	frame, err := http2.ReadFrameHeader(bytes.NewReader(b[:http2HeaderLen]))
-	if err != nil {
-		return "", "", len(b)
-	}
+		// always explain the frames, the stream and hpack states depend on every frame.
+		frameInfo, moreInfo, call := i.explain(source, frame, data[http2HeaderLen:])
+		if i.keepalive != nil {
+			i.printKeepalive(source, id, quiet)
+			continue
+		}
+		if quiet {
+			continue
+		}
+		if !i.frames {
+			if len(call) > 0 {
+				display.PrintfWithTime("[%s-%d] %s\n", source, id, strings.TrimSpace(call))
+			}
+			continue
+		}
 
-	frameLen := http2HeaderLen + int(frame.Length)
-	maxOffset := frameLen
-	if maxOffset > len(b) {
-		maxOffset = len(b)
+		var buf strings.Builder
+		buf.WriteString(color.HiGreenString("from %s [%d]\n", source, id))
+		buf.WriteString(fmt.Sprintf("%s%s%s\n",
+			color.HiBlueString("%s:(", i.protocol),
+			color.HiYellowString(frameInfo),
+			color.HiBlueString(")")))
+		buf.WriteString(fmt.Sprint(hex.Dump(data)))
+		if len(moreInfo) > 0 {
+			buf.WriteString(fmt.Sprintf("\n%s\n\n", strings.TrimSpace(moreInfo)))
+		}
+		display.PrintfWithTime("%s\n\n", strings.TrimSpace(buf.String()))
 	}
+}
 
+func (i *http2Interop) explain(source string, frame http2.FrameHeader, payload []byte) (string, string, string) {
 	switch frame.Type {
 	case http2.FrameSettings:
 		switch frame.Flags {
 		case http2.FlagSettingsAck:
-			return "http2:settings:ack", "", frameLen
+			return "http2:settings:ack", "", ""
 		default:
-			return i.explainSettings(b[http2HeaderLen:maxOffset]), "", frameLen
+			desc, info := i.explainSettings(source, payload)
+			return desc, info, ""
 		}
 	case http2.FramePing:
-		id := hex.EncodeToString(b[http2HeaderLen:maxOffset])
+		id := hex.EncodeToString(payload)
+		if i.keepalive != nil && frame.Flags&http2.FlagPingAck == 0 {
+			i.keepalive.ping(source)
+		}
 		switch frame.Flags {
 		case http2.FlagPingAck:
-			return fmt.Sprintf("http2:ping:ack %s", id), "", frameLen
+			return fmt.Sprintf("http2:ping:ack %s", id), "", ""
 		default:
-			return fmt.Sprintf("http2:ping %s", id), "", frameLen
+			return fmt.Sprintf("http2:ping %s", id), "", ""
 		}
 	case http2.FrameWindowUpdate:
-		increment := binary.BigEndian.Uint32(b[http2HeaderLen : http2HeaderLen+4])
-		return fmt.Sprintf("http2:window_update window_size_increment:%d", increment), "", frameLen
-	case http2.FrameHeaders:
-		info, headers := i.explainHeaders(frame, b[http2HeaderLen:maxOffset])
-		var builder strings.Builder
-		for _, header := range headers {
-			builder.WriteString(fmt.Sprintf("%s: %s\n", header.Name, header.Value))
-		}
-		return info, builder.String(), frameLen
+		if len(payload) < 4 {
+			return "http2:window_update", "", ""
+		}
+		increment := binary.BigEndian.Uint32(payload[:4]) & (1<<31 - 1)
+		desc := "http2:window_update"
+		if frame.StreamID > 0 {
+			desc += fmt.Sprintf(" stream:%d", frame.StreamID)
+		}
+		desc += fmt.Sprintf(" window_size_increment:%d", increment)
+		info, call := i.updateWindows(source, frame.StreamID, int64(increment))
+		return desc, info, call
+	case http2.FrameHeaders, http2.FramePushPromise:
+		desc, promised, fragment := i.explainHeaders(frame, payload)
+		block := &http2HeaderBlock{
+			frame:    frame,
+			promised: promised,
+			fragment: fragment,
+		}
+		if frame.Flags&http2.FlagHeadersEndHeaders == 0 {
+			i.lock.Lock()
+			i.blocks[source] = block
+			i.lock.Unlock()
+			return desc, "", ""
+		}
+		info, call := i.explainHeaderBlock(source, block)
+		return desc, info, call
+	case http2.FrameContinuation:
+		desc := fmt.Sprintf("http2:continuation stream:%d len:%d", frame.StreamID, frame.Length)
+		i.lock.Lock()
+		block, ok := i.blocks[source]
+		if ok {
+			block.fragment = append(block.fragment, payload...)
+		}
+		i.lock.Unlock()
+		if !ok || block.frame.StreamID != frame.StreamID {
+			return desc, "continuation without headers\n", ""
+		}
+		if frame.Flags&http2.FlagContinuationEndHeaders == 0 {
+			return desc, "", ""
+		}
+
+		desc += " end_headers"
+		i.lock.Lock()
+		delete(i.blocks, source)
+		i.lock.Unlock()
+		info, call := i.explainHeaderBlock(source, block)
+		return desc, info, call
 	case http2.FrameData:
-		if frame.Flags == http2.FlagDataEndStream {
-			var info string
-			if i.explainer != nil {
-				info = i.explainer.explain(b[http2HeaderLen:maxOffset])
+		desc := fmt.Sprintf("http2:%s stream:%d len:%d",
+			strings.ToLower(frame.Type.String()), frame.StreamID, frame.Length)
+		endStream := frame.Flags&http2.FlagDataEndStream != 0
+		if endStream {
+			desc += " end_stream"
+		}
+
+		var path, encoding string
+		i.lock.Lock()
+		if stream, ok := i.streams[frame.StreamID]; ok {
+			stream.bytes[source] += int(frame.Length)
+			path, encoding = stream.path, stream.encodings[source]
+		}
+		i.lock.Unlock()
+
+		// the padding is counted in flow control too.
+		info, call := i.consumeWindows(source, frame.StreamID, int64(frame.Length))
+		if i.explainer != nil {
+			messages := i.explainer.explain(source, frame.StreamID, path, encoding, dataPayload(frame, payload))
+			info += messages
+			if len(messages) > 0 {
+				call += fmt.Sprintf("%s stream:%d\n%s", path, frame.StreamID, indent(messages))
 			}
-			return fmt.Sprintf("http2:%s stream:%d len:%d end_stream",
-				strings.ToLower(frame.Type.String()), frame.StreamID, frame.Length), info, frameLen
-		} else {
-			// TODO: handle data frame without end_stream flag
-			return fmt.Sprintf("http2:%s stream:%d len:%d",
-				strings.ToLower(frame.Type.String()), frame.StreamID, frame.Length), "", frameLen
 		}
+		if endStream {
+			endInfo, endCall := i.endStream(source, frame.StreamID)
+			info += endInfo
+			call += endCall
+		}
+		return desc, info, call
+	case http2.FrameRSTStream:
+		var code http2.ErrCode
+		if len(payload) >= 4 {
+			code = http2.ErrCode(binary.BigEndian.Uint32(payload[:4]))
+		}
+		desc := fmt.Sprintf("http2:rst_stream stream:%d error_code:%s", frame.StreamID, code)
+		info, call := i.resetStream(frame.StreamID, fmt.Sprintf("%s by %s", code, source))
+		return desc, info, call
+	case http2.FrameGoAway:
+		if len(payload) < 8 {
+			return "http2:goaway", "", ""
+		}
+		lastStreamID := binary.BigEndian.Uint32(payload[:4]) & (1<<31 - 1)
+		code := http2.ErrCode(binary.BigEndian.Uint32(payload[4:8]))
+		desc := fmt.Sprintf("http2:goaway last_stream_id:%d error_code:%s", lastStreamID, code)
+		if len(payload) > 8 {
+			desc += fmt.Sprintf(" debug_data:%q", payload[8:])
+		}
+		if i.keepalive != nil {
+			i.keepalive.goAway(source, desc, payload[8:])
+		}
+		info, call := i.goAway(source, lastStreamID, code)
+		return desc, info, desc + "\n" + call
+	case http2.FramePriority:
+		if len(payload) < 5 {
+			return fmt.Sprintf("http2:priority stream:%d", frame.StreamID), "", ""
+		}
+		dependency := binary.BigEndian.Uint32(payload[:4])
+		desc := fmt.Sprintf("http2:priority stream:%d depends_on:%d", frame.StreamID, dependency&(1<<31-1))
+		if dependency>>31 == 1 {
+			desc += " exclusive"
+		}
+		return fmt.Sprintf("%s weight:%d", desc, int(payload[4])+1), "", ""
 	}
 
 	if frame.StreamID > 0 {
 		desc := fmt.Sprintf("http2:%s stream:%d len:%d",
 			strings.ToLower(frame.Type.String()), frame.StreamID, frame.Length)
-		return desc, "", frameLen
+		return desc, "", ""
 	}
 
-	return "http2:" + strings.ToLower(frame.Type.String()), "", frameLen
+	return "http2:" + strings.ToLower(frame.Type.String()), "", ""
 }
 
-func (i *http2Interop) explainHeaders(frame http2.FrameHeader, b []byte) (string, []hpack.HeaderField) {
+// endStream ends the half of the stream sent by source,
+// and returns the summary of the stream if both halves are ended.
+func (i *http2Interop) endStream(source string, id uint32) (string, string) {
+	var info string
+	if i.explainer != nil {
+		info = i.explainer.closeStream(source, id)
+	}
+
+	i.lock.Lock()
+	stream, ok := i.streams[id]
+	if !ok {
+		i.lock.Unlock()
+		return info, info
+	}
+	if !stream.end(source) {
+		i.lock.Unlock()
+		return info + fmt.Sprintf("stream:%d %s\n", id, stream.state), info
+	}
+	delete(i.streams, id)
+	i.lock.Unlock()
+
+	return i.summarize(stream, info)
+}
+
+// resetStream closes the stream immediately, for RST_STREAM or GOAWAY.
+func (i *http2Interop) resetStream(id uint32, reason string) (string, string) {
+	var info string
+	if i.explainer != nil {
+		info = i.explainer.closeStream(ClientSide, id) + i.explainer.closeStream(ServerSide, id)
+	}
+
+	i.lock.Lock()
+	stream, ok := i.streams[id]
+	if !ok {
+		i.lock.Unlock()
+		return info, info
+	}
+	stream.close(reason)
+	delete(i.streams, id)
+	i.lock.Unlock()
+
+	return i.summarize(stream, info)
+}
+
+// summarize returns the summaries of a closed stream, for the frame view and the call view.
+func (i *http2Interop) summarize(stream *http2Stream, info string) (string, string) {
+	if i.keepalive != nil && stream.id%2 == 1 {
+		i.keepalive.closeStream()
+	}
+
+	summary := stream.summary()
+	if i.explainer == nil {
+		return info + summary, info + summary
+	}
+
+	call := i.explainer.summary(stream)
+	return info + summary + call, info + call
+}
+
+// goAway closes the streams that are initiated by the peer of source,
+// and are after the last stream that source processed.
+func (i *http2Interop) goAway(source string, lastStreamID uint32, code http2.ErrCode) (string, string) {
+	// the client initiates the odd streams, the server pushes the even ones.
+	var parity uint32
+	if source == ServerSide {
+		parity = 1
+	}
+
+	i.lock.Lock()
+	var ids []uint32
+	for id := range i.streams {
+		if id > lastStreamID && id%2 == parity {
+			ids = append(ids, id)
+		}
+	}
+	i.lock.Unlock()
+	sort.Slice(ids, func(a, b int) bool {
+		return ids[a] < ids[b]
+	})
+
+	var infos, calls strings.Builder
+	for _, id := range ids {
+		info, call := i.resetStream(id, fmt.Sprintf("goaway %s by %s", code, source))
+		infos.WriteString(info)
+		calls.WriteString(call)
+	}
+
+	return infos.String(), calls.String()
+}
+
+// stream returns the stream of id, creates it if not exists, i.lock must be held.
+func (i *http2Interop) stream(id uint32) *http2Stream {
+	stream, ok := i.streams[id]
+	if !ok {
+		stream = newHttp2Stream(id, i.initialWindows)
+		i.streams[id] = stream
+	}
+
+	return stream
+}
+
+func peerSide(source string) string {
+	if source == ClientSide {
+		return ServerSide
+	}
+
+	return ClientSide
+}
+
+func (i *http2Interop) printKeepalive(source string, id int, quiet bool) {
+	for _, event := range i.keepalive.drain(source) {
+		if !quiet {
+			display.PrintfWithTime("[%s-%d] %s\n", source, id, event)
+		}
+	}
+}
+
+func indent(info string) string {
+	var builder strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(info, "\n"), "\n") {
+		builder.WriteString("  " + line + "\n")
+	}
+
+	return builder.String()
+}
+
+// dataPayload strips the padding of a DATA frame.
+func dataPayload(frame http2.FrameHeader, b []byte) []byte {
+	if frame.Flags&http2.FlagDataPadded == 0 || len(b) == 0 {
+		return b
+	}
+
+	padding := int(b[0])
+	b = b[1:]
+	if padding > len(b) {
+		return nil
+	}
+
+	return b[:len(b)-padding]
+}
+
+// explainHeaders describes a HEADERS or PUSH_PROMISE frame,
+// and returns the promised stream id and the header block fragment.
+func (i *http2Interop) explainHeaders(frame http2.FrameHeader, b []byte) (string, uint32, []byte) {
 	var padded int
 	var weight int
-	if frame.Flags&http2.FlagHeadersPadded != 0 {
+	var promised uint32
+	if frame.Flags&http2.FlagHeadersPadded != 0 && len(b) > 0 {
 		padded = int(b[0])
-		b = b[1 : len(b)-padded]
+		b = b[1:]
+		if padded > len(b) {
+			padded = len(b)
+		}
+		b = b[:len(b)-padded]
+	}
+	// PUSH_PROMISE has no priority fields.
+	if frame.Type == http2.FrameHeaders && frame.Flags&http2.FlagHeadersPriority != 0 && len(b) >= 5 {
+		weight = int(b[4]) + 1
+		b = b[5:]
 	}
-	if frame.Flags&http2.FlagHeadersPriority != 0 {
+	if frame.Type == http2.FramePushPromise && len(b) >= 4 {
+		promised = binary.BigEndian.Uint32(b[:4]) & (1<<31 - 1)
 		b = b[4:]
-		weight = int(b[0])
-		b = b[1:]
 	}
 
 	var buf strings.Builder
-	buf.WriteString(fmt.Sprintf("http2:headers stream:%d", frame.StreamID))
+	buf.WriteString(fmt.Sprintf("http2:%s stream:%d",
+		strings.ToLower(frame.Type.String()), frame.StreamID))
+	if promised > 0 {
+		buf.WriteString(fmt.Sprintf(" promised_stream:%d", promised))
+	}
 
-	switch {
-	case frame.Flags&http2.FlagHeadersEndStream != 0:
+	if frame.Type == http2.FrameHeaders && frame.Flags&http2.FlagHeadersEndStream != 0 {
 		buf.WriteString(" end_stream")
-	case frame.Flags&http2.FlagHeadersEndHeaders != 0:
+	}
+	if frame.Flags&http2.FlagHeadersEndHeaders != 0 {
 		buf.WriteString(" end_headers")
-	case frame.Flags&http2.FlagHeadersPadded != 0:
+	}
+	if frame.Flags&http2.FlagHeadersPadded != 0 {
 		buf.WriteString(" padded")
-	case frame.Flags&http2.FlagHeadersPriority != 0:
-		buf.WriteString(" priority")
 	}
-
 	if weight > 0 {
-		buf.WriteString(fmt.Sprintf(" weight:%d", weight))
+		buf.WriteString(fmt.Sprintf(" priority weight:%d", weight))
 	}
 
-	if frame.Flags&http2.FlagHeadersEndStream != 0 || frame.Flags&http2.FlagHeadersEndHeaders != 0 {
-		headers, err := hpack.NewDecoder(0, nil).DecodeFull(b)
-		if err != nil {
-			return buf.String(), nil
+	return buf.String(), promised, b
+}
+
+// explainHeaderBlock decodes a complete header block with the hpack decoder of source.
+// Every block must be decoded in order, even if not printed, to keep the dynamic table in sync.
+func (i *http2Interop) explainHeaderBlock(source string, block *http2HeaderBlock) (string, string) {
+	i.lock.Lock()
+	headers, err := i.decoders[source].DecodeFull(block.fragment)
+	i.lock.Unlock()
+	if err != nil {
+		info := fmt.Sprintf("unable to decode headers: %v\n", err)
+		return info, info
+	}
+
+	var builder strings.Builder
+	for _, header := range headers {
+		builder.WriteString(fmt.Sprintf("%s: %s\n", header.Name, header.Value))
+	}
+
+	i.lock.Lock()
+	if block.frame.Type == http2.FramePushPromise {
+		// the promised request is sent by the server, on behalf of the client.
+		stream := i.stream(block.promised)
+		stream.state = http2StreamReserved
+		stream.addHeaders(ClientSide, headers)
+	} else {
+		_, ok := i.streams[block.frame.StreamID]
+		if !ok && source == ClientSide && i.keepalive != nil {
+			i.keepalive.openStream()
 		}
+		i.stream(block.frame.StreamID).addHeaders(source, headers)
+	}
+	i.lock.Unlock()
 
-		return buf.String(), headers
+	if block.frame.Type != http2.FrameHeaders || block.frame.Flags&http2.FlagHeadersEndStream == 0 {
+		return builder.String(), ""
 	}
 
-	return buf.String(), nil
+	info, call := i.endStream(source, block.frame.StreamID)
+	builder.WriteString(info)
+	return builder.String(), call
 }
 
-func (i *http2Interop) explainSettings(b []byte) string {
+func (i *http2Interop) explainSettings(source string, b []byte) (string, string) {
 	var builder strings.Builder
+	var info string
 
 	builder.WriteString("http2:settings")
-	for i := 0; i < len(b)/http2SettingsPayloadLen; i++ {
-		start := i * http2SettingsPayloadLen
+	for index := 0; index < len(b)/http2SettingsPayloadLen; index++ {
+		start := index * http2SettingsPayloadLen
 		flag := binary.BigEndian.Uint16(b[start : start+2])
 		value := binary.BigEndian.Uint32(b[start+2 : start+http2SettingsPayloadLen])
 
 		switch http2.SettingID(flag) {
 		case http2.SettingHeaderTableSize:
 			builder.WriteString(fmt.Sprintf(" header_table_size:%d", value))
+			// the table size is set by the decoding side, it limits the encoder of the peer.
+			i.lock.Lock()
+			i.decoders[peerSide(source)].SetAllowedMaxDynamicTableSize(value)
+			i.lock.Unlock()
 		case http2.SettingEnablePush:
 			builder.WriteString(fmt.Sprintf(" enable_push:%d", value))
 		case http2.SettingMaxConcurrentStreams:
 			builder.WriteString(fmt.Sprintf(" max_concurrent_streams:%d", value))
 		case http2.SettingInitialWindowSize:
 			builder.WriteString(fmt.Sprintf(" initial_window_size:%d", value))
+			info += i.setInitialWindow(source, value)
 		case http2.SettingMaxFrameSize:
 			builder.WriteString(fmt.Sprintf(" max_frame_size:%d", value))
 		case http2.SettingMaxHeaderListSize:
@@ -209,27 +558,34 @@ func (i *http2Interop) explainSettings(b []byte) string {
 		}
 	}
 
-	return builder.String()
+	return builder.String(), info
 }
 
-func (i *http2Interop) readPreface(r io.Reader, source string, id int) {
+// readPreface reads the client connection preface, the returned reader starts from the first frame.
+// If the preface is absent, the bytes read are put back and decoded as frames.
+func (i *http2Interop) readPreface(r io.Reader, source string, id int, quiet bool) io.Reader {
 	if source != ClientSide {
-		return
+		return r
 	}
 
 	preface := make([]byte, len(http2Preface))
-	n, err := r.Read(preface)
-	if err != nil || n < len(http2Preface) {
-		return
+	n, err := io.ReadFull(r, preface)
+	if err != nil || string(preface) != http2Preface {
+		return io.MultiReader(bytes.NewReader(preface[:n]), r)
+	}
+
+	if quiet || !i.frames {
+		return r
 	}
 
-	fmt.Println()
 	var builder strings.Builder
 	builder.WriteString(color.HiGreenString("from %s [%d]\n", source, id))
 	builder.WriteString(fmt.Sprintf("%s%s%s\n",
-		color.HiBlueString("%s:(", grpcProtocol),
+		color.HiBlueString("%s:(", i.protocol),
 		color.YellowString("http2:preface"),
 		color.HiBlueString(")")))
 	builder.WriteString(fmt.Sprint(hex.Dump(preface)))
 	display.PrintlnWithTime(builder.String())
+
+	return r
 }
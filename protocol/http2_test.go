@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// TestHttp2ResetRace resets server-streaming calls by the client while the server is still sending them,
+// the reset closes the buffers of both directions from the client side, it's meant to run with -race.
+func TestHttp2ResetRace(t *testing.T) {
+	const streams = 50
+	i := newHttp2Interop(grpcProtocol, "127.0.0.1:1234", newGrpcExplainer(nil, nil))
+	writers := make(map[string]*io.PipeWriter)
+	var wg sync.WaitGroup
+	for _, source := range []string{ClientSide, ServerSide} {
+		r, w := io.Pipe()
+		writers[source] = w
+		wg.Add(1)
+		go func(source string) {
+			defer wg.Done()
+			i.Dump(r, source, 1, true)
+		}(source)
+	}
+
+	var buf bytes.Buffer
+	framer := http2.NewFramer(&buf, nil)
+	send := func(source string, write func()) {
+		write()
+		_, _ = writers[source].Write(buf.Bytes())
+		buf.Reset()
+	}
+
+	message := make([]byte, grpcHeaderLen+16)
+	binary.BigEndian.PutUint32(message[1:], 16)
+	_, _ = writers[ClientSide].Write([]byte(http2.ClientPreface))
+	send(ClientSide, func() { _ = framer.WriteSettings() })
+	send(ServerSide, func() { _ = framer.WriteSettings() })
+	for id := uint32(1); id < 2*streams; id += 2 {
+		send(ClientSide, func() {
+			_ = framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      id,
+				BlockFragment: http2TestHeaders(":method", "POST", ":path", "/test.Greeter/Watch"),
+				EndHeaders:    true,
+			})
+			_ = framer.WriteData(id, true, message)
+		})
+		send(ServerSide, func() {
+			_ = framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      id,
+				BlockFragment: http2TestHeaders(":status", "200", "content-type", "application/grpc"),
+				EndHeaders:    true,
+			})
+		})
+		// the server keeps a partial message in the buffer, while the client resets the stream.
+		for j := 0; j < 5; j++ {
+			send(ServerSide, func() { _ = framer.WriteData(id, false, message[:10]) })
+			send(ServerSide, func() { _ = framer.WriteData(id, false, message[10:]) })
+		}
+		send(ServerSide, func() { _ = framer.WriteData(id, false, message[:10]) })
+		send(ClientSide, func() { _ = framer.WriteRSTStream(id, http2.ErrCodeCancel) })
+		send(ServerSide, func() { _ = framer.WriteData(id, false, message[10:]) })
+	}
+
+	// the streams still open are closed by the goaway.
+	for id := uint32(2*streams + 1); id < 4*streams; id += 2 {
+		send(ClientSide, func() {
+			_ = framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      id,
+				BlockFragment: http2TestHeaders(":method", "POST", ":path", "/test.Greeter/Watch"),
+				EndHeaders:    true,
+			})
+		})
+		send(ServerSide, func() { _ = framer.WriteData(id, false, message[:10]) })
+	}
+	send(ClientSide, func() { _ = framer.WriteGoAway(2*streams-1, http2.ErrCodeNo, nil) })
+	send(ServerSide, func() { _ = framer.WriteData(4*streams-1, false, message[10:]) })
+
+	for _, w := range writers {
+		_ = w.Close()
+	}
+	wg.Wait()
+}
+
+// TestHttp2WindowsCallView checks the windows of the watched stream are in the call view, not only the frames.
+func TestHttp2WindowsCallView(t *testing.T) {
+	http2WindowStream = 1
+	defer func() {
+		http2WindowStream = 0
+	}()
+
+	i := newHttp2Interop(grpcProtocol, "127.0.0.1:1234", newGrpcExplainer(nil, nil))
+	i.streams[1] = &http2Stream{
+		id: 1,
+		windows: map[string]*http2Window{
+			ClientSide: {size: http2InitialWindowSize},
+			ServerSide: {size: http2InitialWindowSize},
+		},
+	}
+
+	expect := "stream:1 client:65535 server:65505"
+	if _, call := i.consumeWindows(ServerSide, 1, 30); !strings.Contains(call, expect) {
+		t.Fatalf("expected %q in the call view, got %q", expect, call)
+	}
+	expect = "stream:1 client:65535 server:65535"
+	if _, call := i.updateWindows(ClientSide, 1, 30); !strings.Contains(call, expect) {
+		t.Fatalf("expected %q in the call view, got %q", expect, call)
+	}
+	if _, call := i.consumeWindows(ServerSide, 3, 30); len(call) > 0 {
+		t.Fatalf("unexpected windows of another stream: %q", call)
+	}
+}
+
+func http2TestHeaders(kv ...string) []byte {
+	var buf bytes.Buffer
+	encoder := hpack.NewEncoder(&buf)
+	for j := 0; j < len(kv); j += 2 {
+		_ = encoder.WriteField(hpack.HeaderField{Name: kv[j], Value: kv[j+1]})
+	}
+
+	return buf.Bytes()
+}
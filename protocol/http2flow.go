@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// the initial flow-control window size defined by RFC 7540.
+const http2InitialWindowSize = 65535
+
+// http2Window is the flow-control window of a sender,
+// on the connection or on a stream.
+type http2Window struct {
+	size    int64
+	blocked time.Time
+}
+
+// consume accounts a DATA frame, and returns true if the sender becomes blocked.
+func (w *http2Window) consume(length int64) bool {
+	w.size -= length
+	if w.size > 0 || !w.blocked.IsZero() {
+		return false
+	}
+
+	w.blocked = time.Now()
+	return true
+}
+
+// update applies a WINDOW_UPDATE or a change of SETTINGS_INITIAL_WINDOW_SIZE,
+// and returns how long the sender was blocked, if it's unblocked.
+func (w *http2Window) update(increment int64) time.Duration {
+	w.size += increment
+	if w.size <= 0 || w.blocked.IsZero() {
+		return 0
+	}
+
+	stalled := time.Since(w.blocked)
+	w.blocked = time.Time{}
+	return stalled
+}
+
+// consumeWindows accounts a DATA frame sent by source on both the connection and the stream.
+func (i *http2Interop) consumeWindows(source string, id uint32, length int64) (string, string) {
+	if length == 0 {
+		return "", ""
+	}
+
+	var info string
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.windows[source].consume(length) {
+		info += color.HiRedString("%s blocked on the connection window: %d\n", source, i.windows[source].size)
+	}
+	if stream, ok := i.streams[id]; ok && stream.windows[source].consume(length) {
+		info += color.HiRedString("%s blocked on the window of stream %d: %d\n",
+			source, id, stream.windows[source].size)
+	}
+
+	info += i.explainWindows(id)
+	return info, info
+}
+
+// updateWindows applies a WINDOW_UPDATE sent by source, which allows the peer to send more.
+func (i *http2Interop) updateWindows(source string, id uint32, increment int64) (string, string) {
+	sender := peerSide(source)
+	var info string
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if id == 0 {
+		if stalled := i.windows[sender].update(increment); stalled > 0 {
+			info += fmt.Sprintf("%s unblocked on the connection window after %s\n", sender, stalled)
+		}
+	} else if stream, ok := i.streams[id]; ok {
+		if stalled := stream.windows[sender].update(increment); stalled > 0 {
+			info += fmt.Sprintf("%s unblocked on the window of stream %d after %s\n", sender, id, stalled)
+		}
+	}
+
+	info += i.explainWindows(id)
+	return info, info
+}
+
+// setInitialWindow applies SETTINGS_INITIAL_WINDOW_SIZE sent by source,
+// which changes the stream windows of the peer, but not the connection window.
+func (i *http2Interop) setInitialWindow(source string, size uint32) string {
+	sender := peerSide(source)
+	var info string
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	delta := int64(size) - i.initialWindows[source]
+	i.initialWindows[source] = int64(size)
+	for id, stream := range i.streams {
+		if stalled := stream.windows[sender].update(delta); stalled > 0 {
+			info += fmt.Sprintf("%s unblocked on the window of stream %d after %s\n", sender, id, stalled)
+		}
+	}
+
+	return info + i.explainWindows(http2WindowStream)
+}
+
+// explainWindows shows the windows if id is the stream selected to watch, i.lock must be held.
+func (i *http2Interop) explainWindows(id uint32) string {
+	if http2WindowStream == 0 || (id != 0 && id != http2WindowStream) {
+		return ""
+	}
+
+	info := fmt.Sprintf("windows connection client:%d server:%d", i.windows[ClientSide].size,
+		i.windows[ServerSide].size)
+	if stream, ok := i.streams[http2WindowStream]; ok {
+		info += fmt.Sprintf(" stream:%d client:%d server:%d", http2WindowStream,
+			stream.windows[ClientSide].size, stream.windows[ServerSide].size)
+	}
+
+	return info + "\n"
+}
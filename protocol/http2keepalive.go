@@ -0,0 +1,241 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// the reconnect delays kept for each client to show the backoff.
+const http2ReconnectHistory = 5
+
+var http2Clients = struct {
+	clients map[string]*http2ClientHistory
+	lock    sync.Mutex
+}{
+	clients: make(map[string]*http2ClientHistory),
+}
+
+type (
+	// http2ClientHistory is the connections history of a client host, across connections.
+	http2ClientHistory struct {
+		conns     int
+		lastOpen  time.Time
+		lastClose time.Time
+		delays    []time.Duration
+	}
+
+	// http2Keepalive records the keepalive behavior of a connection,
+	// the events are queued by the side that sees them, and printed by its Dump.
+	http2Keepalive struct {
+		client    string
+		start     time.Time
+		pings     map[string]int
+		lastPings map[string]time.Time
+		intervals map[string][]time.Duration
+		goAways   []string
+		streams   int
+		calls     int
+		idleSince time.Time
+		maxIdle   time.Duration
+		events    map[string][]string
+		closed    bool
+		lock      sync.Mutex
+	}
+)
+
+func newHttp2Keepalive(client string) *http2Keepalive {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	now := time.Now()
+	k := &http2Keepalive{
+		client:    client,
+		start:     now,
+		pings:     make(map[string]int),
+		lastPings: make(map[string]time.Time),
+		intervals: make(map[string][]time.Duration),
+		idleSince: now,
+		events:    make(map[string][]string),
+	}
+	k.events[ClientSide] = append(k.events[ClientSide], k.connect(now))
+
+	return k
+}
+
+// connect records a new connection of the client, and describes the reconnect.
+func (k *http2Keepalive) connect(now time.Time) string {
+	http2Clients.lock.Lock()
+	defer http2Clients.lock.Unlock()
+
+	history, ok := http2Clients.clients[k.client]
+	if !ok {
+		history = new(http2ClientHistory)
+		http2Clients.clients[k.client] = history
+	}
+	defer func() {
+		history.conns++
+		history.lastOpen = now
+	}()
+
+	switch {
+	case !ok:
+		return fmt.Sprintf("first connection from %s", k.client)
+	case history.conns > 0:
+		return fmt.Sprintf("new connection from %s after %s, while %d connections open",
+			k.client, now.Sub(history.lastOpen), history.conns)
+	}
+
+	delay := now.Sub(history.lastClose)
+	history.delays = append(history.delays, delay)
+	if len(history.delays) > http2ReconnectHistory {
+		history.delays = history.delays[1:]
+	}
+
+	info := fmt.Sprintf("reconnect from %s after %s", k.client, delay)
+	if len(history.delays) > 1 {
+		var delays []string
+		for _, d := range history.delays {
+			delays = append(delays, d.Round(time.Millisecond).String())
+		}
+		info += fmt.Sprintf(" delays:[%s]", strings.Join(delays, " "))
+		prev := history.delays[len(history.delays)-2]
+		if prev > 0 {
+			info += fmt.Sprintf(" backoff:x%.2f", float64(delay)/float64(prev))
+		}
+	}
+
+	return info
+}
+
+func (k *http2Keepalive) ping(source string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	now := time.Now()
+	info := fmt.Sprintf("ping from %s", source)
+	if last, ok := k.lastPings[source]; ok {
+		interval := now.Sub(last)
+		k.intervals[source] = append(k.intervals[source], interval)
+		info += fmt.Sprintf(" interval:%s", interval)
+	} else {
+		info += fmt.Sprintf(" first after %s", now.Sub(k.start))
+	}
+	if k.streams == 0 {
+		info += " without active calls"
+	}
+	k.pings[source]++
+	k.lastPings[source] = now
+	k.events[source] = append(k.events[source], info)
+}
+
+func (k *http2Keepalive) goAway(source, desc string, debug []byte) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	info := fmt.Sprintf("%s from %s after %s", desc, source, time.Since(k.start))
+	k.goAways = append(k.goAways, info)
+	info = color.HiRedString(info)
+	if string(debug) == "too_many_pings" {
+		info += fmt.Sprintf("\n  the server rejects the client pings: %s, the keepalive time of the client"+
+			" should be longer than the min time of the server enforcement policy,"+
+			" or the server should permit pings without calls",
+			explainPings(k.pings[ClientSide], k.intervals[ClientSide]))
+	}
+	k.events[source] = append(k.events[source], info)
+}
+
+func (k *http2Keepalive) openStream() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.streams == 0 {
+		if idle := time.Since(k.idleSince); idle > k.maxIdle {
+			k.maxIdle = idle
+		}
+	}
+	k.streams++
+	k.calls++
+}
+
+func (k *http2Keepalive) closeStream() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.streams > 0 {
+		k.streams--
+	}
+	if k.streams == 0 {
+		k.idleSince = time.Now()
+	}
+}
+
+// close records the end of the connection, it's called by both sides, and only the first one counts.
+func (k *http2Keepalive) close(source string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.closed {
+		return
+	}
+	k.closed = true
+
+	now := time.Now()
+	if k.streams == 0 {
+		if idle := now.Sub(k.idleSince); idle > k.maxIdle {
+			k.maxIdle = idle
+		}
+	}
+
+	info := fmt.Sprintf("connection from %s closed lifetime:%s calls:%d max_idle:%s client_pings:%s server_pings:%s",
+		k.client, now.Sub(k.start), k.calls, k.maxIdle,
+		explainPings(k.pings[ClientSide], k.intervals[ClientSide]),
+		explainPings(k.pings[ServerSide], k.intervals[ServerSide]))
+	if len(k.goAways) > 0 {
+		info += fmt.Sprintf(" goaways:%d", len(k.goAways))
+	}
+	k.events[source] = append(k.events[source], info)
+
+	http2Clients.lock.Lock()
+	if history, ok := http2Clients.clients[k.client]; ok {
+		history.conns--
+		history.lastClose = now
+	}
+	http2Clients.lock.Unlock()
+}
+
+// drain returns the events queued for source.
+func (k *http2Keepalive) drain(source string) []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	events := k.events[source]
+	delete(k.events, source)
+	return events
+}
+
+func explainPings(pings int, intervals []time.Duration) string {
+	if len(intervals) == 0 {
+		return fmt.Sprint(pings)
+	}
+
+	least, most := intervals[0], intervals[0]
+	var total time.Duration
+	for _, interval := range intervals {
+		if interval < least {
+			least = interval
+		}
+		if interval > most {
+			most = interval
+		}
+		total += interval
+	}
+
+	return fmt.Sprintf("%d(min:%s avg:%s max:%s)", pings, least.Round(time.Millisecond),
+		(total / time.Duration(len(intervals))).Round(time.Millisecond), most.Round(time.Millisecond))
+}
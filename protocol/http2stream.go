@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	http2StreamIdle http2StreamState = iota
+	http2StreamReserved
+	http2StreamOpen
+	http2StreamHalfClosedClient
+	http2StreamHalfClosedServer
+	http2StreamClosed
+)
+
+var http2StreamStates = map[http2StreamState]string{
+	http2StreamIdle:             "idle",
+	http2StreamReserved:         "reserved",
+	http2StreamOpen:             "open",
+	http2StreamHalfClosedClient: "half_closed(client)",
+	http2StreamHalfClosedServer: "half_closed(server)",
+	http2StreamClosed:           "closed",
+}
+
+type (
+	http2StreamState int
+
+	// http2Stream is the state of a stream, which is shared by both directions.
+	// The half-closed states are named by the side that ended its half of the stream.
+	http2Stream struct {
+		id    uint32
+		state http2StreamState
+		start time.Time
+		// the :path from the request headers.
+		path string
+		// the grpc-encoding of each direction.
+		encodings map[string]string
+		request   []hpack.HeaderField
+		response  []hpack.HeaderField
+		trailers  []hpack.HeaderField
+		// the DATA bytes and the flow-control window of each sender.
+		bytes   map[string]int
+		windows map[string]*http2Window
+		// the error code of RST_STREAM or GOAWAY that closed the stream.
+		reset string
+	}
+)
+
+// newHttp2Stream creates a stream, the initial windows are the ones set by the receiving sides.
+func newHttp2Stream(id uint32, initialWindows map[string]int64) *http2Stream {
+	return &http2Stream{
+		id:        id,
+		start:     time.Now(),
+		encodings: make(map[string]string),
+		bytes:     make(map[string]int),
+		windows: map[string]*http2Window{
+			ClientSide: {size: initialWindows[ServerSide]},
+			ServerSide: {size: initialWindows[ClientSide]},
+		},
+	}
+}
+
+func (s http2StreamState) String() string {
+	return http2StreamStates[s]
+}
+
+// addHeaders pairs a header block of source with the stream,
+// the server side may send informational responses, a response and then the trailers.
+func (s *http2Stream) addHeaders(source string, headers []hpack.HeaderField) {
+	switch s.state {
+	case http2StreamIdle:
+		s.state = http2StreamOpen
+	case http2StreamReserved:
+		// a pushed stream is half closed by the client once the server responds.
+		s.state = http2StreamHalfClosedClient
+	}
+
+	for _, header := range headers {
+		switch {
+		case source == ClientSide && header.Name == ":path":
+			s.path = header.Value
+		case header.Name == "grpc-encoding":
+			s.encodings[source] = header.Value
+		}
+	}
+
+	switch {
+	case source == ClientSide:
+		if s.request == nil {
+			s.request = headers
+		}
+	case s.response == nil || strings.HasPrefix(headerValue(s.response, ":status"), "1"):
+		s.response = headers
+	default:
+		s.trailers = headers
+	}
+}
+
+// end ends the half of the stream sent by source, and returns true if the stream is closed.
+func (s *http2Stream) end(source string) bool {
+	switch s.state {
+	case http2StreamIdle, http2StreamOpen, http2StreamReserved:
+		if source == ClientSide {
+			s.state = http2StreamHalfClosedClient
+		} else {
+			s.state = http2StreamHalfClosedServer
+		}
+	case http2StreamHalfClosedClient:
+		if source == ServerSide {
+			s.state = http2StreamClosed
+		}
+	case http2StreamHalfClosedServer:
+		if source == ClientSide {
+			s.state = http2StreamClosed
+		}
+	}
+
+	return s.state == http2StreamClosed
+}
+
+func (s *http2Stream) close(reason string) {
+	s.state = http2StreamClosed
+	s.reset = reason
+}
+
+func (s *http2Stream) summary() string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("stream:%d closed duration:%s", s.id, time.Since(s.start)))
+	if method := headerValue(s.request, ":method"); len(method) > 0 {
+		builder.WriteString(fmt.Sprintf(" %s %s", method, headerValue(s.request, ":path")))
+	}
+	if status := headerValue(s.response, ":status"); len(status) > 0 {
+		builder.WriteString(fmt.Sprintf(" status:%s", status))
+	}
+	if len(s.trailers) > 0 {
+		builder.WriteString(fmt.Sprintf(" trailers:%d", len(s.trailers)))
+	}
+	builder.WriteString(fmt.Sprintf(" request_bytes:%d response_bytes:%d",
+		s.bytes[ClientSide], s.bytes[ServerSide]))
+	if len(s.reset) > 0 {
+		builder.WriteString(" reset:" + s.reset)
+	}
+	builder.WriteString("\n")
+
+	return builder.String()
+}
+
+func headerValue(headers []hpack.HeaderField, name string) string {
+	for _, header := range headers {
+		if header.Name == name {
+			return header.Value
+		}
+	}
+
+	return ""
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/kevwan/tproxy/display"
 )
@@ -12,43 +13,111 @@ const (
 	ServerSide = "SERVER"
 	ClientSide = "CLIENT"
 
-	bufferSize    = 1 << 20
-	grpcProtocol  = "grpc"
-	http2Protocol = "http2"
-	redisProtocol = "redis"
-	mongoProtocol = "mongo"
-	mqttProtocol  = "mqtt"
-	mysqlProtocol = "mysql"
-	textProtocol  = "text"
+	bufferSize        = 1 << 20
+	amqpProtocol      = "amqp"
+	dnsProtocol       = "dns"
+	grpcProtocol      = "grpc"
+	http2Protocol     = "http2"
+	kafkaProtocol     = "kafka"
+	redisProtocol     = "redis"
+	mongoProtocol     = "mongo"
+	memcachedProtocol = "memcached"
+	mqttProtocol      = "mqtt"
+	mysqlProtocol     = "mysql"
+	textProtocol      = "text"
+	tlsProtocol       = "tls"
 )
 
-var interop defaultInterop
+var (
+	interop        defaultInterop
+	grpcSchemas    *grpcSchema
+	grpcReflection *grpcReflector
+	// the HTTP/2 stream to show its flow-control windows.
+	http2WindowStream uint32
+	// shows the HTTP/2 frames of gRPC, not only the calls.
+	http2Verbose bool
+	// shows the keepalive and the connection churn of HTTP/2, instead of frames or calls.
+	http2KeepaliveView bool
+	// the mysql queries slower than it are highlighted, 0 to disable.
+	mysqlSlowQuery time.Duration
+)
+
+type (
+	Interop interface {
+		Dump(r io.Reader, source string, id int, quiet bool)
+	}
+
+	// Options are the settings of the protocol decoders.
+	Options struct {
+		// ProtoFiles and ProtoPaths are the .proto files and their import paths,
+		// used to decode gRPC messages with field names.
+		ProtoFiles []string
+		ProtoPaths []string
+		// DescriptorSet is a FileDescriptorSet file, like the output of protoc --descriptor_set_out.
+		DescriptorSet string
+		// Reflection enables looking up the gRPC schemas with the server reflection of Remote.
+		Reflection bool
+		Remote     string
+		// WindowStream is the HTTP/2 stream id to show its flow-control windows over time.
+		WindowStream uint32
+		// Verbose shows the HTTP/2 frames of gRPC, instead of one line per call.
+		Verbose bool
+		// Keepalive shows the pings, goaways, idle time and reconnects of HTTP/2 connections.
+		Keepalive bool
+		// SlowQuery is the latency over which the MySQL queries are highlighted, 0 to disable.
+		SlowQuery time.Duration
+	}
+)
+
+// Setup applies opts, it should be called before creating any Interop.
+func Setup(opts Options) error {
+	if len(opts.ProtoFiles) > 0 || len(opts.DescriptorSet) > 0 {
+		schema, err := loadGrpcSchema(opts.ProtoFiles, opts.ProtoPaths, opts.DescriptorSet)
+		if err != nil {
+			return err
+		}
+		grpcSchemas = schema
+	}
+
+	if opts.Reflection {
+		grpcReflection = newGrpcReflector(opts.Remote)
+	}
+
+	http2WindowStream = opts.WindowStream
+	http2Verbose = opts.Verbose
+	http2KeepaliveView = opts.Keepalive
+	mysqlSlowQuery = opts.SlowQuery
 
-type Interop interface {
-	Dump(r io.Reader, source string, id int, quiet bool)
+	return nil
 }
 
-func CreateInterop(protocol string) Interop {
+// CreateInterop creates the Interop of a connection from client.
+func CreateInterop(protocol, client string) Interop {
 	switch protocol {
 	case textProtocol:
 		return new(textInterop)
+	case amqpProtocol:
+		return new(amqpInterop)
+	case dnsProtocol:
+		return newDnsInterop()
 	case grpcProtocol:
-		return &http2Interop{
-			explainer: new(grpcExplainer),
-			protocol:  grpcProtocol,
-		}
+		return newHttp2Interop(grpcProtocol, client, newGrpcExplainer(grpcSchemas, grpcReflection))
 	case http2Protocol:
-		return &http2Interop{
-			protocol: http2Protocol,
-		}
+		return newHttp2Interop(http2Protocol, client, nil)
+	case kafkaProtocol:
+		return newKafkaInterop()
 	case redisProtocol:
-		return new(redisInterop)
+		return newRedisInterop()
+	case memcachedProtocol:
+		return newMemcachedInterop()
 	case mongoProtocol:
 		return new(mongoInterop)
 	case mqttProtocol:
 		return new(mqttInterop)
 	case mysqlProtocol:
-		return new(mysqlInterop)
+		return newMysqlInterop()
+	case tlsProtocol:
+		return new(tlsInterop)
 	default:
 		return interop
 	}
@@ -73,3 +142,8 @@ func (d defaultInterop) Dump(r io.Reader, source string, id int, quiet bool) {
 		}
 	}
 }
+
+// drain discards the rest of r, so that the relaying is not blocked after a decoder gives up.
+func drain(r io.Reader) {
+	_, _ = io.Copy(io.Discard, r)
+}
@@ -0,0 +1,931 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+)
+
+const (
+	kafkaSizeLen      = 4
+	kafkaMaxFrameSize = 100 << 20
+
+	kafkaProduce      = 0
+	kafkaFetch        = 1
+	kafkaMetadata     = 3
+	kafkaOffsetCommit = 8
+	kafkaJoinGroup    = 11
+	kafkaHeartbeat    = 12
+	kafkaSyncGroup    = 14
+	kafkaApiVersions  = 18
+)
+
+var (
+	errKafkaShortBuffer = errors.New("short buffer")
+
+	kafkaApiNames = map[int16]string{
+		0:  "Produce",
+		1:  "Fetch",
+		2:  "ListOffsets",
+		3:  "Metadata",
+		4:  "LeaderAndIsr",
+		5:  "StopReplica",
+		6:  "UpdateMetadata",
+		7:  "ControlledShutdown",
+		8:  "OffsetCommit",
+		9:  "OffsetFetch",
+		10: "FindCoordinator",
+		11: "JoinGroup",
+		12: "Heartbeat",
+		13: "LeaveGroup",
+		14: "SyncGroup",
+		15: "DescribeGroups",
+		16: "ListGroups",
+		17: "SaslHandshake",
+		18: "ApiVersions",
+		19: "CreateTopics",
+		20: "DeleteTopics",
+		21: "DeleteRecords",
+		22: "InitProducerId",
+		23: "OffsetForLeaderEpoch",
+		24: "AddPartitionsToTxn",
+		25: "AddOffsetsToTxn",
+		26: "EndTxn",
+		27: "WriteTxnMarkers",
+		28: "TxnOffsetCommit",
+		29: "DescribeAcls",
+		30: "CreateAcls",
+		31: "DeleteAcls",
+		32: "DescribeConfigs",
+		33: "AlterConfigs",
+		34: "AlterReplicaLogDirs",
+		35: "DescribeLogDirs",
+		36: "SaslAuthenticate",
+		37: "CreatePartitions",
+		38: "CreateDelegationToken",
+		39: "RenewDelegationToken",
+		40: "ExpireDelegationToken",
+		41: "DescribeDelegationToken",
+		42: "DeleteGroups",
+		43: "ElectLeaders",
+		44: "IncrementalAlterConfigs",
+		45: "AlterPartitionReassignments",
+		46: "ListPartitionReassignments",
+		47: "OffsetDelete",
+		48: "DescribeClientQuotas",
+		49: "AlterClientQuotas",
+		50: "DescribeUserScramCredentials",
+		51: "AlterUserScramCredentials",
+		55: "DescribeQuorum",
+		57: "UpdateFeatures",
+		60: "DescribeCluster",
+		61: "DescribeProducers",
+		64: "UnregisterBroker",
+		65: "DescribeTransactions",
+		66: "ListTransactions",
+		67: "AllocateProducerIds",
+		68: "ConsumerGroupHeartbeat",
+		69: "ConsumerGroupDescribe",
+	}
+
+	// the first version of each api that uses the flexible (compact) encoding,
+	// only needed for the apis that we decode.
+	kafkaFlexibleVersions = map[int16]int16{
+		kafkaProduce:      9,
+		kafkaFetch:        12,
+		kafkaMetadata:     9,
+		kafkaOffsetCommit: 8,
+		kafkaJoinGroup:    6,
+		kafkaHeartbeat:    4,
+		kafkaSyncGroup:    4,
+		kafkaApiVersions:  3,
+	}
+
+	kafkaErrorNames = map[int16]string{
+		-1:  "UNKNOWN_SERVER_ERROR",
+		0:   "NONE",
+		1:   "OFFSET_OUT_OF_RANGE",
+		2:   "CORRUPT_MESSAGE",
+		3:   "UNKNOWN_TOPIC_OR_PARTITION",
+		5:   "LEADER_NOT_AVAILABLE",
+		6:   "NOT_LEADER_OR_FOLLOWER",
+		7:   "REQUEST_TIMED_OUT",
+		10:  "MESSAGE_TOO_LARGE",
+		14:  "COORDINATOR_LOAD_IN_PROGRESS",
+		15:  "COORDINATOR_NOT_AVAILABLE",
+		16:  "NOT_COORDINATOR",
+		22:  "ILLEGAL_GENERATION",
+		25:  "UNKNOWN_MEMBER_ID",
+		26:  "INVALID_SESSION_TIMEOUT",
+		27:  "REBALANCE_IN_PROGRESS",
+		29:  "TOPIC_AUTHORIZATION_FAILED",
+		30:  "GROUP_AUTHORIZATION_FAILED",
+		35:  "UNSUPPORTED_VERSION",
+		58:  "SASL_AUTHENTICATION_FAILED",
+		79:  "MEMBER_ID_REQUIRED",
+		82:  "FENCED_INSTANCE_ID",
+		100: "UNKNOWN_TOPIC_ID",
+	}
+
+	kafkaRequestDecoders = map[int16]kafkaDecoder{
+		kafkaProduce:      decodeKafkaProduceRequest,
+		kafkaFetch:        decodeKafkaFetchRequest,
+		kafkaMetadata:     decodeKafkaMetadataRequest,
+		kafkaOffsetCommit: decodeKafkaOffsetCommitRequest,
+		kafkaJoinGroup:    decodeKafkaJoinGroupRequest,
+		kafkaHeartbeat:    decodeKafkaHeartbeatRequest,
+		kafkaSyncGroup:    decodeKafkaSyncGroupRequest,
+	}
+
+	kafkaResponseDecoders = map[int16]kafkaDecoder{
+		kafkaProduce:      decodeKafkaProduceResponse,
+		kafkaFetch:        decodeKafkaFetchResponse,
+		kafkaMetadata:     decodeKafkaMetadataResponse,
+		kafkaOffsetCommit: decodeKafkaOffsetCommitResponse,
+		kafkaJoinGroup:    decodeKafkaJoinGroupResponse,
+		kafkaHeartbeat:    decodeKafkaHeartbeatResponse,
+		kafkaSyncGroup:    decodeKafkaSyncGroupResponse,
+	}
+)
+
+type (
+	kafkaDecoder func(r *kafkaReader, version int16) string
+
+	kafkaRequest struct {
+		apiKey     int16
+		apiVersion int16
+		start      time.Time
+	}
+
+	// kafkaInterop is shared by both directions of a connection,
+	// so that responses can be paired with requests by correlation id.
+	kafkaInterop struct {
+		requests map[int32]kafkaRequest
+		lock     sync.Mutex
+	}
+)
+
+func newKafkaInterop() *kafkaInterop {
+	return &kafkaInterop{
+		requests: make(map[int32]kafkaRequest),
+	}
+}
+
+func (k *kafkaInterop) Dump(r io.Reader, source string, id int, quiet bool) {
+	size := make([]byte, kafkaSizeLen)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			if err != io.EOF {
+				display.PrintfWithTime("[%s-%d] unable to read kafka frame: %v\n", source, id, err)
+			}
+			drain(r)
+			return
+		}
+
+		length := binary.BigEndian.Uint32(size)
+		if length > kafkaMaxFrameSize {
+			display.PrintfWithTime(color.HiRedString("[%s-%d] invalid kafka frame size %d, stop decoding\n",
+				source, id, length))
+			drain(r)
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			drain(r)
+			return
+		}
+
+		if source == ClientSide {
+			k.dumpRequest(payload, id, quiet)
+		} else {
+			k.dumpResponse(payload, id, quiet)
+		}
+	}
+}
+
+func (k *kafkaInterop) dumpRequest(payload []byte, id int, quiet bool) {
+	r := &kafkaReader{b: payload}
+	apiKey := r.int16()
+	apiVersion := r.int16()
+	correlationID := r.int32()
+	clientID := r.nullableString(false)
+	if r.err != nil {
+		display.PrintfWithTime(color.HiRedString("[%s-%d] invalid kafka request header\n", ClientSide, id))
+		return
+	}
+	flexible := kafkaIsFlexible(apiKey, apiVersion)
+	r.taggedFields(flexible)
+
+	r.flexible = flexible
+	// registered before decoding the body, so that a fast response is still paired.
+	if kafkaExpectsResponse(*r, apiKey, apiVersion) {
+		k.lock.Lock()
+		k.requests[correlationID] = kafkaRequest{
+			apiKey:     apiKey,
+			apiVersion: apiVersion,
+			start:      time.Now(),
+		}
+		k.lock.Unlock()
+	}
+
+	var detail string
+	if decoder, ok := kafkaRequestDecoders[apiKey]; ok && r.err == nil {
+		detail = decoder(r, apiVersion)
+	}
+
+	if quiet {
+		return
+	}
+
+	display.PrintfWithTime("[%s-%d] %s correlation:%d client:%s len:%d%s\n", ClientSide, id,
+		color.HiYellowString("%s v%d", kafkaApiName(apiKey), apiVersion),
+		correlationID, clientID, len(payload), kafkaFormatDetail(detail))
+}
+
+func (k *kafkaInterop) dumpResponse(payload []byte, id int, quiet bool) {
+	r := &kafkaReader{b: payload}
+	correlationID := r.int32()
+	if r.err != nil {
+		display.PrintfWithTime(color.HiRedString("[%s-%d] invalid kafka response header\n", ServerSide, id))
+		return
+	}
+
+	k.lock.Lock()
+	req, ok := k.requests[correlationID]
+	delete(k.requests, correlationID)
+	k.lock.Unlock()
+
+	if quiet {
+		return
+	}
+
+	if !ok {
+		display.PrintfWithTime("[%s-%d] %s correlation:%d len:%d\n", ServerSide, id,
+			color.HiYellowString("unknown response"), correlationID, len(payload))
+		return
+	}
+
+	// ApiVersions responses always use the v0 header, so that old clients can parse them.
+	if req.apiKey != kafkaApiVersions {
+		r.taggedFields(kafkaIsFlexible(req.apiKey, req.apiVersion))
+	}
+
+	var detail string
+	if decoder, ok := kafkaResponseDecoders[req.apiKey]; ok && r.err == nil {
+		r.flexible = kafkaIsFlexible(req.apiKey, req.apiVersion)
+		detail = decoder(r, req.apiVersion)
+	}
+
+	display.PrintfWithTime("[%s-%d] %s correlation:%d len:%d latency:%s%s\n", ServerSide, id,
+		color.HiYellowString("%s v%d response", kafkaApiName(req.apiKey), req.apiVersion),
+		correlationID, len(payload), time.Since(req.start), kafkaFormatDetail(detail))
+}
+
+func decodeKafkaProduceRequest(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	if version >= 3 {
+		if txn := r.nullableString(r.flexible); len(txn) > 0 {
+			builder.WriteString(fmt.Sprintf("transactional_id:%s ", txn))
+		}
+	}
+	builder.WriteString(fmt.Sprintf("acks:%d timeout:%dms", r.int16(), r.int32()))
+
+	r.array(func() {
+		topic := kafkaTopic(r, version >= 13)
+		r.array(func() {
+			partition := r.int32()
+			records := r.bytes(r.flexible)
+			builder.WriteString(fmt.Sprintf("\n%s[%d] records:%d bytes:%d",
+				topic, partition, kafkaRecordCount(records), len(records)))
+			r.taggedFields(r.flexible)
+		})
+		r.taggedFields(r.flexible)
+	})
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaProduceResponse(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	r.array(func() {
+		topic := kafkaTopic(r, version >= 13)
+		r.array(func() {
+			partition := r.int32()
+			errCode := r.int16()
+			baseOffset := r.int64()
+			if version >= 2 {
+				r.int64() // log_append_time_ms
+			}
+			if version >= 5 {
+				r.int64() // log_start_offset
+			}
+			var errMsg string
+			if version >= 8 {
+				r.array(func() {
+					r.int32() // batch_index
+					r.nullableString(r.flexible)
+					r.taggedFields(r.flexible)
+				})
+				errMsg = r.nullableString(r.flexible)
+			}
+			builder.WriteString(fmt.Sprintf("\n%s[%d] %s base_offset:%d",
+				topic, partition, kafkaErrorName(errCode), baseOffset))
+			if len(errMsg) > 0 {
+				builder.WriteString(" message:" + errMsg)
+			}
+			r.taggedFields(r.flexible)
+		})
+		r.taggedFields(r.flexible)
+	})
+	if version >= 1 {
+		builder.WriteString(fmt.Sprintf("\nthrottle:%dms", r.int32()))
+	}
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaFetchRequest(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	if version < 15 {
+		r.int32() // replica_id
+	}
+	builder.WriteString(fmt.Sprintf("max_wait:%dms min_bytes:%d", r.int32(), r.int32()))
+	if version >= 3 {
+		builder.WriteString(fmt.Sprintf(" max_bytes:%d", r.int32()))
+	}
+	if version >= 4 {
+		builder.WriteString(fmt.Sprintf(" isolation_level:%d", r.int8()))
+	}
+	if version >= 7 {
+		builder.WriteString(fmt.Sprintf(" session:%d epoch:%d", r.int32(), r.int32()))
+	}
+
+	r.array(func() {
+		topic := kafkaTopic(r, version >= 13)
+		r.array(func() {
+			partition := r.int32()
+			if version >= 9 {
+				r.int32() // current_leader_epoch
+			}
+			offset := r.int64()
+			if version >= 12 {
+				r.int32() // last_fetched_epoch
+			}
+			if version >= 5 {
+				r.int64() // log_start_offset
+			}
+			maxBytes := r.int32()
+			builder.WriteString(fmt.Sprintf("\n%s[%d] offset:%d max_bytes:%d",
+				topic, partition, offset, maxBytes))
+			r.taggedFields(r.flexible)
+		})
+		r.taggedFields(r.flexible)
+	})
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaFetchResponse(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	if version >= 1 {
+		builder.WriteString(fmt.Sprintf("throttle:%dms", r.int32()))
+	}
+	if version >= 7 {
+		builder.WriteString(fmt.Sprintf(" %s session:%d", kafkaErrorName(r.int16()), r.int32()))
+	}
+
+	r.array(func() {
+		topic := kafkaTopic(r, version >= 13)
+		r.array(func() {
+			partition := r.int32()
+			errCode := r.int16()
+			highWatermark := r.int64()
+			if version >= 4 {
+				r.int64() // last_stable_offset
+			}
+			if version >= 5 {
+				r.int64() // log_start_offset
+			}
+			if version >= 4 {
+				r.array(func() {
+					r.int64() // producer_id
+					r.int64() // first_offset
+					r.taggedFields(r.flexible)
+				})
+			}
+			if version >= 11 {
+				r.int32() // preferred_read_replica
+			}
+			records := r.bytes(r.flexible)
+			builder.WriteString(fmt.Sprintf("\n%s[%d] %s high_watermark:%d records:%d bytes:%d",
+				topic, partition, kafkaErrorName(errCode), highWatermark, kafkaRecordCount(records), len(records)))
+			r.taggedFields(r.flexible)
+		})
+		r.taggedFields(r.flexible)
+	})
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaMetadataRequest(r *kafkaReader, version int16) string {
+	var topics []string
+	count := r.array(func() {
+		if version >= 10 {
+			r.uuid()
+			topics = append(topics, r.nullableString(r.flexible))
+		} else {
+			topics = append(topics, r.string(r.flexible))
+		}
+		r.taggedFields(r.flexible)
+	})
+
+	if count < 0 {
+		return r.result("topics:all")
+	}
+
+	return r.result("topics:" + strings.Join(topics, ","))
+}
+
+func decodeKafkaMetadataResponse(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	if version >= 3 {
+		builder.WriteString(fmt.Sprintf("throttle:%dms ", r.int32()))
+	}
+
+	var brokers []string
+	r.array(func() {
+		node := r.int32()
+		host := r.string(r.flexible)
+		port := r.int32()
+		if version >= 1 {
+			r.nullableString(r.flexible) // rack
+		}
+		brokers = append(brokers, fmt.Sprintf("%d@%s:%d", node, host, port))
+		r.taggedFields(r.flexible)
+	})
+	builder.WriteString("brokers:" + strings.Join(brokers, ","))
+
+	if version >= 2 {
+		if cluster := r.nullableString(r.flexible); len(cluster) > 0 {
+			builder.WriteString(" cluster:" + cluster)
+		}
+	}
+	if version >= 1 {
+		builder.WriteString(fmt.Sprintf(" controller:%d", r.int32()))
+	}
+
+	r.array(func() {
+		errCode := r.int16()
+		topic := r.nullableString(r.flexible)
+		if version >= 10 {
+			r.uuid()
+		}
+		if version >= 1 {
+			r.bool() // is_internal
+		}
+		var leaders []string
+		r.array(func() {
+			r.int16() // error_code
+			partition := r.int32()
+			leader := r.int32()
+			if version >= 7 {
+				r.int32() // leader_epoch
+			}
+			r.int32Array() // replica_nodes
+			r.int32Array() // isr_nodes
+			if version >= 5 {
+				r.int32Array() // offline_replicas
+			}
+			leaders = append(leaders, fmt.Sprintf("%d->%d", partition, leader))
+			r.taggedFields(r.flexible)
+		})
+		if version >= 8 {
+			r.int32() // topic_authorized_operations
+		}
+		builder.WriteString(fmt.Sprintf("\n%s %s partitions:%d leaders:%s",
+			topic, kafkaErrorName(errCode), len(leaders), strings.Join(leaders, ",")))
+		r.taggedFields(r.flexible)
+	})
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaOffsetCommitRequest(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	builder.WriteString("group:" + r.string(r.flexible))
+	if version >= 1 {
+		builder.WriteString(fmt.Sprintf(" generation:%d member:%s", r.int32(), r.string(r.flexible)))
+	}
+	if version >= 7 {
+		if instance := r.nullableString(r.flexible); len(instance) > 0 {
+			builder.WriteString(" instance:" + instance)
+		}
+	}
+	if version >= 2 && version <= 4 {
+		builder.WriteString(fmt.Sprintf(" retention:%dms", r.int64()))
+	}
+
+	r.array(func() {
+		topic := r.string(r.flexible)
+		r.array(func() {
+			partition := r.int32()
+			offset := r.int64()
+			if version >= 6 {
+				r.int32() // committed_leader_epoch
+			}
+			if version == 1 {
+				r.int64() // commit_timestamp
+			}
+			r.nullableString(r.flexible) // committed_metadata
+			builder.WriteString(fmt.Sprintf("\n%s[%d] offset:%d", topic, partition, offset))
+			r.taggedFields(r.flexible)
+		})
+		r.taggedFields(r.flexible)
+	})
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaOffsetCommitResponse(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	if version >= 3 {
+		builder.WriteString(fmt.Sprintf("throttle:%dms", r.int32()))
+	}
+
+	r.array(func() {
+		topic := r.string(r.flexible)
+		r.array(func() {
+			partition := r.int32()
+			builder.WriteString(fmt.Sprintf("\n%s[%d] %s", topic, partition, kafkaErrorName(r.int16())))
+			r.taggedFields(r.flexible)
+		})
+		r.taggedFields(r.flexible)
+	})
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaJoinGroupRequest(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("group:%s session_timeout:%dms", r.string(r.flexible), r.int32()))
+	if version >= 1 {
+		builder.WriteString(fmt.Sprintf(" rebalance_timeout:%dms", r.int32()))
+	}
+	builder.WriteString(" member:" + r.string(r.flexible))
+	if version >= 5 {
+		if instance := r.nullableString(r.flexible); len(instance) > 0 {
+			builder.WriteString(" instance:" + instance)
+		}
+	}
+	builder.WriteString(" protocol_type:" + r.string(r.flexible))
+
+	var protocols []string
+	r.array(func() {
+		protocols = append(protocols, r.string(r.flexible))
+		r.bytes(r.flexible) // metadata
+		r.taggedFields(r.flexible)
+	})
+	builder.WriteString(" protocols:" + strings.Join(protocols, ","))
+
+	if version >= 8 {
+		if reason := r.nullableString(r.flexible); len(reason) > 0 {
+			builder.WriteString(" reason:" + reason)
+		}
+	}
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaJoinGroupResponse(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	if version >= 2 {
+		builder.WriteString(fmt.Sprintf("throttle:%dms ", r.int32()))
+	}
+	builder.WriteString(fmt.Sprintf("%s generation:%d", kafkaErrorName(r.int16()), r.int32()))
+	if version >= 7 {
+		r.nullableString(r.flexible) // protocol_type
+	}
+	builder.WriteString(fmt.Sprintf(" protocol:%s leader:%s", r.nullableString(r.flexible), r.string(r.flexible)))
+	if version >= 9 {
+		r.bool() // skip_assignment
+	}
+	builder.WriteString(" member:" + r.string(r.flexible))
+
+	count := r.array(func() {
+		r.string(r.flexible) // member_id
+		if version >= 5 {
+			r.nullableString(r.flexible) // group_instance_id
+		}
+		r.bytes(r.flexible) // metadata
+		r.taggedFields(r.flexible)
+	})
+	builder.WriteString(fmt.Sprintf(" members:%d", count))
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaSyncGroupRequest(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("group:%s generation:%d member:%s",
+		r.string(r.flexible), r.int32(), r.string(r.flexible)))
+	if version >= 3 {
+		if instance := r.nullableString(r.flexible); len(instance) > 0 {
+			builder.WriteString(" instance:" + instance)
+		}
+	}
+	if version >= 5 {
+		r.nullableString(r.flexible) // protocol_type
+		if name := r.nullableString(r.flexible); len(name) > 0 {
+			builder.WriteString(" protocol:" + name)
+		}
+	}
+
+	count := r.array(func() {
+		r.string(r.flexible) // member_id
+		r.bytes(r.flexible)  // assignment
+		r.taggedFields(r.flexible)
+	})
+	builder.WriteString(fmt.Sprintf(" assignments:%d", count))
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaSyncGroupResponse(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	if version >= 1 {
+		builder.WriteString(fmt.Sprintf("throttle:%dms ", r.int32()))
+	}
+	builder.WriteString(kafkaErrorName(r.int16()))
+	if version >= 5 {
+		r.nullableString(r.flexible) // protocol_type
+		r.nullableString(r.flexible) // protocol_name
+	}
+	builder.WriteString(fmt.Sprintf(" assignment:%d bytes", len(r.bytes(r.flexible))))
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaHeartbeatRequest(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("group:%s generation:%d member:%s",
+		r.string(r.flexible), r.int32(), r.string(r.flexible)))
+	if version >= 3 {
+		if instance := r.nullableString(r.flexible); len(instance) > 0 {
+			builder.WriteString(" instance:" + instance)
+		}
+	}
+
+	return r.result(builder.String())
+}
+
+func decodeKafkaHeartbeatResponse(r *kafkaReader, version int16) string {
+	var builder strings.Builder
+	if version >= 1 {
+		builder.WriteString(fmt.Sprintf("throttle:%dms ", r.int32()))
+	}
+	builder.WriteString(kafkaErrorName(r.int16()))
+
+	return r.result(builder.String())
+}
+
+func kafkaApiName(key int16) string {
+	if name, ok := kafkaApiNames[key]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Api(%d)", key)
+}
+
+func kafkaErrorName(code int16) string {
+	if name, ok := kafkaErrorNames[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("ERROR(%d)", code)
+}
+
+// kafkaExpectsResponse reports whether the request gets a response,
+// Produce requests with acks=0 never get one.
+func kafkaExpectsResponse(r kafkaReader, apiKey, apiVersion int16) bool {
+	if apiKey != kafkaProduce {
+		return true
+	}
+
+	if apiVersion >= 3 {
+		r.nullableString(r.flexible) // transactional_id
+	}
+
+	return r.int16() != 0 || r.err != nil
+}
+
+func kafkaFormatDetail(detail string) string {
+	if len(detail) == 0 {
+		return ""
+	}
+
+	lines := strings.Split(detail, "\n")
+	if len(lines[0]) > 0 {
+		lines[0] = " " + lines[0]
+	}
+
+	return strings.Join(lines, "\n    ")
+}
+
+func kafkaIsFlexible(apiKey, apiVersion int16) bool {
+	version, ok := kafkaFlexibleVersions[apiKey]
+	return ok && apiVersion >= version
+}
+
+// kafkaRecordCount counts the records in a message set or a sequence of record batches,
+// a partial batch at the end of a fetch response is ignored.
+func kafkaRecordCount(b []byte) int {
+	const (
+		batchHeaderLen   = 12
+		magicOffset      = 16
+		recordsLenOffset = 57
+	)
+
+	var count int
+	for len(b) >= batchHeaderLen {
+		size := int(int32(binary.BigEndian.Uint32(b[8:batchHeaderLen])))
+		if size <= 0 || len(b) < batchHeaderLen+size {
+			break
+		}
+
+		batch := b[:batchHeaderLen+size]
+		if len(batch) > magicOffset && batch[magicOffset] >= 2 {
+			if len(batch) >= recordsLenOffset+4 {
+				count += int(int32(binary.BigEndian.Uint32(batch[recordsLenOffset:])))
+			}
+		} else {
+			count++
+		}
+		b = b[batchHeaderLen+size:]
+	}
+
+	return count
+}
+
+func kafkaTopic(r *kafkaReader, byID bool) string {
+	if byID {
+		return r.uuid()
+	}
+
+	return r.string(r.flexible)
+}
+
+// kafkaReader reads the kafka primitive types, the first error sticks,
+// so that the decoders can be written without checking every read.
+type kafkaReader struct {
+	b        []byte
+	flexible bool
+	err      error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errKafkaShortBuffer
+		return nil
+	}
+
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) bool() bool {
+	return r.int8() != 0
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+func (r *kafkaReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errKafkaShortBuffer
+		return 0
+	}
+
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) uuid() string {
+	return hex.EncodeToString(r.next(16))
+}
+
+// length reads the length of a string, bytes or array, -1 means null.
+func (r *kafkaReader) length(compact bool, wide bool) int {
+	switch {
+	case compact:
+		return int(r.uvarint()) - 1
+	case wide:
+		return int(r.int32())
+	default:
+		return int(r.int16())
+	}
+}
+
+func (r *kafkaReader) string(compact bool) string {
+	return r.nullableString(compact)
+}
+
+func (r *kafkaReader) nullableString(compact bool) string {
+	n := r.length(compact, false)
+	if n < 0 {
+		return ""
+	}
+
+	return string(r.next(n))
+}
+
+func (r *kafkaReader) bytes(compact bool) []byte {
+	n := r.length(compact, true)
+	if n < 0 {
+		return nil
+	}
+
+	return r.next(n)
+}
+
+// array calls fn for each element, and returns the element count, -1 means null.
+func (r *kafkaReader) array(fn func()) int {
+	n := r.length(r.flexible, true)
+	for i := 0; i < n && r.err == nil; i++ {
+		fn()
+	}
+
+	return n
+}
+
+func (r *kafkaReader) int32Array() {
+	r.array(func() {
+		r.int32()
+	})
+}
+
+func (r *kafkaReader) taggedFields(flexible bool) {
+	if !flexible {
+		return
+	}
+
+	count := r.uvarint()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		r.uvarint() // tag
+		r.next(int(r.uvarint()))
+	}
+}
+
+func (r *kafkaReader) result(s string) string {
+	if r.err != nil {
+		return s + " (truncated)"
+	}
+
+	return s
+}
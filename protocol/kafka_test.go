@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"testing/iotest"
+)
+
+type kafkaTestBuffer struct {
+	bytes.Buffer
+}
+
+func (b *kafkaTestBuffer) int8(v int8) *kafkaTestBuffer {
+	b.WriteByte(byte(v))
+	return b
+}
+
+func (b *kafkaTestBuffer) int16(v int16) *kafkaTestBuffer {
+	_ = binary.Write(b, binary.BigEndian, v)
+	return b
+}
+
+func (b *kafkaTestBuffer) int32(v int32) *kafkaTestBuffer {
+	_ = binary.Write(b, binary.BigEndian, v)
+	return b
+}
+
+func (b *kafkaTestBuffer) int64(v int64) *kafkaTestBuffer {
+	_ = binary.Write(b, binary.BigEndian, v)
+	return b
+}
+
+func (b *kafkaTestBuffer) string(s string) *kafkaTestBuffer {
+	b.int16(int16(len(s)))
+	b.WriteString(s)
+	return b
+}
+
+func (b *kafkaTestBuffer) bytes(v []byte) *kafkaTestBuffer {
+	b.int32(int32(len(v)))
+	b.Write(v)
+	return b
+}
+
+// frame prefixes the content with its length.
+func (b *kafkaTestBuffer) frame() []byte {
+	frame := new(kafkaTestBuffer).int32(int32(b.Len()))
+	frame.Write(b.Bytes())
+	return frame.Bytes()
+}
+
+func kafkaTestRequest(apiKey, version int16, correlationID int32) *kafkaTestBuffer {
+	return new(kafkaTestBuffer).int16(apiKey).int16(version).int32(correlationID).string("test")
+}
+
+// kafkaTestRecordBatch returns a record batch of magic 2 with count records.
+func kafkaTestRecordBatch(count int32) []byte {
+	batch := make([]byte, 61)
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-12))
+	batch[16] = 2
+	binary.BigEndian.PutUint32(batch[57:], uint32(count))
+	return batch
+}
+
+func TestKafkaFramingAcrossReads(t *testing.T) {
+	var stream []byte
+	stream = append(stream, kafkaTestRequest(kafkaMetadata, 1, 1).int32(-1).frame()...)
+	stream = append(stream, kafkaTestRequest(kafkaHeartbeat, 0, 2).string("group").int32(1).
+		string("member").frame()...)
+
+	k := newKafkaInterop()
+	k.Dump(iotest.OneByteReader(bytes.NewReader(stream)), ClientSide, 1, true)
+	if len(k.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %v", k.requests)
+	}
+	if req := k.requests[2]; req.apiKey != kafkaHeartbeat {
+		t.Fatalf("expected Heartbeat, got %v", req)
+	}
+}
+
+func TestKafkaPairing(t *testing.T) {
+	k := newKafkaInterop()
+	k.dumpRequest(kafkaTestRequest(kafkaMetadata, 1, 1).int32(-1).Bytes(), 1, true)
+	k.dumpRequest(kafkaTestRequest(kafkaHeartbeat, 0, 2).string("group").int32(1).
+		string("member").Bytes(), 1, true)
+	// acks=0, no response is expected.
+	k.dumpRequest(kafkaTestRequest(kafkaProduce, 3, 3).int16(-1).int16(0).int32(1000).int32(0).Bytes(), 1, true)
+
+	tests := []struct {
+		name          string
+		correlationID int32
+		remaining     []int32
+	}{
+		{name: "out of order", correlationID: 2, remaining: []int32{1}},
+		{name: "unknown", correlationID: 9, remaining: []int32{1}},
+		{name: "in order", correlationID: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k.dumpResponse(new(kafkaTestBuffer).int32(test.correlationID).int16(0).Bytes(), 1, true)
+			if len(k.requests) != len(test.remaining) {
+				t.Fatalf("expected %v pending, got %v", test.remaining, k.requests)
+			}
+			for _, id := range test.remaining {
+				if _, ok := k.requests[id]; !ok {
+					t.Fatalf("expected %d pending, got %v", id, k.requests)
+				}
+			}
+		})
+	}
+}
+
+func TestKafkaSummaries(t *testing.T) {
+	batch := kafkaTestRecordBatch(3)
+	tests := []struct {
+		name    string
+		decoder kafkaDecoder
+		version int16
+		body    *kafkaTestBuffer
+		expect  string
+	}{
+		{
+			name:    "produce request",
+			decoder: decodeKafkaProduceRequest,
+			version: 3,
+			body: new(kafkaTestBuffer).int16(-1).int16(1).int32(1000).
+				int32(1).string("t").int32(1).int32(0).bytes(batch),
+			expect: "acks:1 timeout:1000ms\nt[0] records:3 bytes:61",
+		},
+		{
+			name:    "produce response",
+			decoder: decodeKafkaProduceResponse,
+			version: 2,
+			body: new(kafkaTestBuffer).int32(1).string("t").int32(1).
+				int32(0).int16(0).int64(42).int64(-1).int32(5),
+			expect: "\nt[0] NONE base_offset:42\nthrottle:5ms",
+		},
+		{
+			name:    "fetch request",
+			decoder: decodeKafkaFetchRequest,
+			version: 4,
+			body: new(kafkaTestBuffer).int32(-1).int32(500).int32(1).int32(1024).int8(0).
+				int32(1).string("t").int32(1).int32(0).int64(7).int32(512),
+			expect: "max_wait:500ms min_bytes:1 max_bytes:1024 isolation_level:0\nt[0] offset:7 max_bytes:512",
+		},
+		{
+			name:    "fetch response",
+			decoder: decodeKafkaFetchResponse,
+			version: 4,
+			body: new(kafkaTestBuffer).int32(0).int32(1).string("t").int32(1).
+				int32(0).int16(1).int64(10).int64(10).int32(0).bytes(batch),
+			expect: "throttle:0ms\nt[0] OFFSET_OUT_OF_RANGE high_watermark:10 records:3 bytes:61",
+		},
+		{
+			name:    "truncated fetch response",
+			decoder: decodeKafkaFetchResponse,
+			version: 4,
+			body:    new(kafkaTestBuffer).int32(0).int32(1).string("t").int32(1).int32(0),
+			expect:  "throttle:0ms\nt[0] NONE high_watermark:0 records:0 bytes:0 (truncated)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &kafkaReader{b: test.body.Bytes()}
+			if detail := test.decoder(r, test.version); detail != test.expect {
+				t.Fatalf("expected %q, got %q", test.expect, detail)
+			}
+		})
+	}
+}
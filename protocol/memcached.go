@@ -0,0 +1,459 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+)
+
+const (
+	memcachedRequestMagic  = 0x80
+	memcachedResponseMagic = 0x81
+	memcachedHeaderLen     = 24
+	memcachedMaxBodySize   = 64 << 20
+	memcachedPreviewLen    = 64
+
+	memcachedOpGetQ  = 0x09
+	memcachedOpNoop  = 0x0a
+	memcachedOpGetKQ = 0x0d
+
+	memcachedStatusKeyNotFound = 0x01
+)
+
+var (
+	memcachedOpcodes = map[byte]string{
+		0x00: "Get",
+		0x01: "Set",
+		0x02: "Add",
+		0x03: "Replace",
+		0x04: "Delete",
+		0x05: "Increment",
+		0x06: "Decrement",
+		0x07: "Quit",
+		0x08: "Flush",
+		0x09: "GetQ",
+		0x0a: "Noop",
+		0x0b: "Version",
+		0x0c: "GetK",
+		0x0d: "GetKQ",
+		0x0e: "Append",
+		0x0f: "Prepend",
+		0x10: "Stat",
+		0x11: "SetQ",
+		0x12: "AddQ",
+		0x13: "ReplaceQ",
+		0x14: "DeleteQ",
+		0x15: "IncrementQ",
+		0x16: "DecrementQ",
+		0x17: "QuitQ",
+		0x18: "FlushQ",
+		0x19: "AppendQ",
+		0x1a: "PrependQ",
+		0x1c: "Touch",
+		0x1d: "GAT",
+		0x1e: "GATQ",
+		0x20: "SASLListMechs",
+		0x21: "SASLAuth",
+		0x22: "SASLStep",
+	}
+
+	memcachedStatuses = map[uint16]string{
+		0x00: "NO_ERROR",
+		0x01: "KEY_NOT_FOUND",
+		0x02: "KEY_EXISTS",
+		0x03: "VALUE_TOO_LARGE",
+		0x04: "INVALID_ARGUMENTS",
+		0x05: "ITEM_NOT_STORED",
+		0x06: "NON_NUMERIC_VALUE",
+		0x07: "WRONG_VBUCKET",
+		0x08: "AUTH_ERROR",
+		0x09: "AUTH_CONTINUE",
+		0x81: "UNKNOWN_COMMAND",
+		0x82: "OUT_OF_MEMORY",
+		0x83: "NOT_SUPPORTED",
+		0x84: "INTERNAL_ERROR",
+		0x85: "BUSY",
+		0x86: "TEMPORARY_FAILURE",
+	}
+
+	// the binary opcodes that look up a key, used to count hits and misses.
+	memcachedBinaryGets = map[byte]bool{
+		0x00: true,
+		0x09: true,
+		0x0c: true,
+		0x0d: true,
+		0x1d: true,
+		0x1e: true,
+	}
+)
+
+type (
+	memcachedCommand struct {
+		name   string
+		line   string
+		keys   int
+		opcode byte
+		start  time.Time
+	}
+
+	// memcachedInterop is shared by both directions of a connection,
+	// text commands are paired with responses in order, binary ones by opaque.
+	memcachedInterop struct {
+		pending []memcachedCommand
+		opaques map[uint32]memcachedCommand
+		hits    int
+		misses  int
+		lock    sync.Mutex
+	}
+)
+
+func newMemcachedInterop() *memcachedInterop {
+	return &memcachedInterop{
+		opaques: make(map[uint32]memcachedCommand),
+	}
+}
+
+func (m *memcachedInterop) Dump(r io.Reader, source string, id int, quiet bool) {
+	reader := bufio.NewReader(r)
+	magic, err := reader.Peek(1)
+	if err != nil {
+		drain(reader)
+		return
+	}
+
+	switch {
+	case magic[0] == memcachedRequestMagic || magic[0] == memcachedResponseMagic:
+		m.dumpBinary(reader, source, id, quiet)
+	case source == ClientSide:
+		m.dumpTextCommands(reader, id, quiet)
+	default:
+		m.dumpTextResponses(reader, id, quiet)
+	}
+
+	drain(reader)
+}
+
+func (m *memcachedInterop) dumpTextCommands(r *bufio.Reader, id int, quiet bool) {
+	for {
+		line, err := readMemcachedLine(r)
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		cmd := memcachedCommand{
+			name:  strings.ToLower(fields[0]),
+			line:  line,
+			start: time.Now(),
+		}
+
+		var data []byte
+		var noreply bool
+		switch cmd.name {
+		case "set", "add", "replace", "append", "prepend", "cas":
+			// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+			if len(fields) < 5 {
+				break
+			}
+			if data, err = readMemcachedData(r, fields[4]); err != nil {
+				return
+			}
+			noreply = fields[len(fields)-1] == "noreply"
+		case "ms":
+			// ms <key> <datalen> <flags>*
+			if len(fields) < 3 {
+				break
+			}
+			if data, err = readMemcachedData(r, fields[2]); err != nil {
+				return
+			}
+		case "get", "gets":
+			cmd.keys = len(fields) - 1
+		case "gat", "gats":
+			cmd.keys = len(fields) - 2
+		case "mg":
+			cmd.keys = 1
+		case "delete", "incr", "decr", "touch", "flush_all", "verbosity":
+			noreply = fields[len(fields)-1] == "noreply"
+		case "quit":
+			noreply = true
+		}
+
+		if !noreply {
+			m.lock.Lock()
+			m.pending = append(m.pending, cmd)
+			m.lock.Unlock()
+		}
+
+		if quiet {
+			continue
+		}
+
+		if data != nil {
+			display.PrintfWithTime("[%s-%d] %s\n  %q (%d bytes)\n", ClientSide, id,
+				color.HiYellowString(line), memcachedPreview(data), len(data))
+		} else {
+			display.PrintfWithTime("[%s-%d] %s\n", ClientSide, id, color.HiYellowString(line))
+		}
+	}
+}
+
+func (m *memcachedInterop) dumpTextResponses(r *bufio.Reader, id int, quiet bool) {
+	for {
+		var builder strings.Builder
+		var hits int
+		var status string
+		for {
+			line, err := readMemcachedLine(r)
+			if err != nil {
+				return
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+
+			switch fields[0] {
+			case "VALUE":
+				// VALUE <key> <flags> <bytes> [<cas unique>]
+				if len(fields) < 4 {
+					status = line
+					break
+				}
+				data, err := readMemcachedData(r, fields[3])
+				if err != nil {
+					return
+				}
+				hits++
+				builder.WriteString(fmt.Sprintf("\n  %s %q (%d bytes)", line, memcachedPreview(data), len(data)))
+				continue
+			case "VA":
+				// VA <size> <flags>*, the value of a meta get, no END follows.
+				if len(fields) < 2 {
+					status = line
+					break
+				}
+				data, err := readMemcachedData(r, fields[1])
+				if err != nil {
+					return
+				}
+				hits++
+				builder.WriteString(fmt.Sprintf("\n  %s %q (%d bytes)", line, memcachedPreview(data), len(data)))
+				status = "VA"
+			case "STAT":
+				builder.WriteString("\n  " + line)
+				continue
+			default:
+				status = line
+			}
+
+			break
+		}
+
+		m.lock.Lock()
+		var cmd memcachedCommand
+		var paired bool
+		if len(m.pending) > 0 {
+			cmd = m.pending[0]
+			m.pending = m.pending[1:]
+			paired = true
+		}
+		if cmd.name == "mg" && status == "HD" {
+			hits++
+		}
+		misses := cmd.keys - hits
+		if misses < 0 {
+			misses = 0
+		}
+		m.hits += hits
+		m.misses += misses
+		totalHits, totalMisses := m.hits, m.misses
+		m.lock.Unlock()
+
+		if quiet {
+			continue
+		}
+
+		if !paired {
+			display.PrintfWithTime("[%s-%d] %s%s\n", ServerSide, id, color.HiYellowString(status), builder.String())
+			continue
+		}
+
+		var stat string
+		if cmd.keys > 0 {
+			stat = fmt.Sprintf(" hits:%d misses:%d (connection hits:%d misses:%d)",
+				hits, misses, totalHits, totalMisses)
+		}
+		display.PrintfWithTime("[%s-%d] %s -> %s%s latency:%s%s\n", ServerSide, id,
+			color.HiYellowString(cmd.line), memcachedStatusColor(status), stat,
+			time.Since(cmd.start), builder.String())
+	}
+}
+
+func (m *memcachedInterop) dumpBinary(r *bufio.Reader, source string, id int, quiet bool) {
+	header := make([]byte, memcachedHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+
+		magic := header[0]
+		opcode := header[1]
+		keyLen := int(binary.BigEndian.Uint16(header[2:4]))
+		extrasLen := int(header[4])
+		status := binary.BigEndian.Uint16(header[6:8])
+		bodyLen := int(binary.BigEndian.Uint32(header[8:12]))
+		opaque := binary.BigEndian.Uint32(header[12:16])
+		cas := binary.BigEndian.Uint64(header[16:24])
+		if (magic != memcachedRequestMagic && magic != memcachedResponseMagic) ||
+			bodyLen > memcachedMaxBodySize || extrasLen+keyLen > bodyLen {
+			display.PrintfWithTime(color.HiRedString("[%s-%d] invalid memcached binary header, stop decoding\n",
+				source, id))
+			return
+		}
+
+		body := make([]byte, bodyLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		key := string(body[extrasLen : extrasLen+keyLen])
+		value := body[extrasLen+keyLen:]
+
+		name, ok := memcachedOpcodes[opcode]
+		if !ok {
+			name = fmt.Sprintf("Opcode(0x%02x)", opcode)
+		}
+
+		if magic == memcachedRequestMagic {
+			m.lock.Lock()
+			m.opaques[opaque] = memcachedCommand{
+				name:   name,
+				line:   strings.TrimSpace(name + " " + key),
+				opcode: opcode,
+				start:  time.Now(),
+			}
+			m.lock.Unlock()
+
+			if quiet {
+				continue
+			}
+
+			var data string
+			if len(value) > 0 {
+				data = fmt.Sprintf("\n  %q (%d bytes)", memcachedPreview(value), len(value))
+			}
+			display.PrintfWithTime("[%s-%d] %s opaque:%d extras:%d%s\n", ClientSide, id,
+				color.HiYellowString(strings.TrimSpace(name+" "+key)), opaque, extrasLen, data)
+			continue
+		}
+
+		m.lock.Lock()
+		cmd, paired := m.opaques[opaque]
+		delete(m.opaques, opaque)
+		if memcachedBinaryGets[opcode] {
+			if status == memcachedStatusKeyNotFound {
+				m.misses++
+			} else if status == 0 {
+				m.hits++
+			}
+		}
+		// quiet gets are only answered on hits, the ones before a noop are misses.
+		var quietMisses []memcachedCommand
+		if opcode == memcachedOpNoop {
+			for k, v := range m.opaques {
+				if v.opcode == memcachedOpGetQ || v.opcode == memcachedOpGetKQ {
+					quietMisses = append(quietMisses, v)
+					m.misses++
+					delete(m.opaques, k)
+				}
+			}
+		}
+		hits, misses := m.hits, m.misses
+		m.lock.Unlock()
+
+		if quiet {
+			continue
+		}
+
+		for _, miss := range quietMisses {
+			display.PrintfWithTime("[%s-%d] %s -> %s latency:%s\n", ServerSide, id,
+				color.HiYellowString(miss.line), memcachedStatusColor("KEY_NOT_FOUND"), time.Since(miss.start))
+		}
+
+		statusName, ok := memcachedStatuses[status]
+		if !ok {
+			statusName = fmt.Sprintf("STATUS(0x%04x)", status)
+		}
+
+		var latency string
+		if paired {
+			latency = fmt.Sprintf(" latency:%s", time.Since(cmd.start))
+		} else {
+			cmd.line = strings.TrimSpace(name + " " + key)
+		}
+		var stat string
+		if memcachedBinaryGets[opcode] {
+			stat = fmt.Sprintf(" (connection hits:%d misses:%d)", hits, misses)
+		}
+		var data string
+		if len(value) > 0 {
+			data = fmt.Sprintf("\n  %q (%d bytes)", memcachedPreview(value), len(value))
+		}
+		display.PrintfWithTime("[%s-%d] %s -> %s opaque:%d cas:%d%s%s%s\n", ServerSide, id,
+			color.HiYellowString(cmd.line), memcachedStatusColor(statusName), opaque, cas, stat, latency, data)
+	}
+}
+
+func memcachedPreview(b []byte) string {
+	if len(b) > memcachedPreviewLen {
+		return toPrintableASCII(b[:memcachedPreviewLen]) + "..."
+	}
+
+	return toPrintableASCII(b)
+}
+
+func memcachedStatusColor(status string) string {
+	switch {
+	case strings.Contains(status, "ERROR"), strings.HasPrefix(status, "STATUS("):
+		return color.HiRedString(status)
+	default:
+		return color.HiGreenString(status)
+	}
+}
+
+func readMemcachedData(r *bufio.Reader, size string) ([]byte, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 || n > memcachedMaxBodySize {
+		return nil, fmt.Errorf("invalid data size: %s", size)
+	}
+
+	// data block followed by \r\n
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data[:n], nil
+}
+
+func readMemcachedLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func memcachedTestPacket(magic, opcode byte, status uint16, opaque uint32, extras, key, value string) []byte {
+	header := make([]byte, memcachedHeaderLen)
+	header[0] = magic
+	header[1] = opcode
+	binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(header[6:], status)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:], opaque)
+	return append(header, extras+key+value...)
+}
+
+func TestMemcachedText(t *testing.T) {
+	tests := []struct {
+		name      string
+		commands  string
+		responses string
+		// reads one byte at a time, to split the lines and the data blocks.
+		split  bool
+		hits   int
+		misses int
+	}{
+		{
+			name:      "partial hit",
+			commands:  "get a b c\r\n",
+			responses: "VALUE a 0 1\r\nx\r\nVALUE c 0 2\r\nyz\r\nEND\r\n",
+			hits:      2,
+			misses:    1,
+		},
+		{
+			name:      "all missed",
+			commands:  "gets a b\r\n",
+			responses: "END\r\n",
+			misses:    2,
+		},
+		{
+			name:      "data split across reads",
+			commands:  "set k 0 0 12\r\nvalue\r\nvalue\r\nget k\r\n",
+			responses: "STORED\r\nVALUE k 0 12\r\nvalue\r\nvalue\r\nEND\r\n",
+			split:     true,
+			hits:      1,
+		},
+		{
+			name:      "noreply",
+			commands:  "set k 0 0 1 noreply\r\nx\r\ndelete k noreply\r\nget k\r\n",
+			responses: "END\r\n",
+			misses:    1,
+		},
+		{
+			name:      "meta get",
+			commands:  "mg a v\r\nmg b v\r\n",
+			responses: "VA 1\r\nx\r\nEN\r\n",
+			hits:      1,
+			misses:    1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := func(s string) io.Reader {
+				if test.split {
+					return iotest.OneByteReader(strings.NewReader(s))
+				}
+				return strings.NewReader(s)
+			}
+
+			m := newMemcachedInterop()
+			m.Dump(reader(test.commands), ClientSide, 1, true)
+			m.Dump(reader(test.responses), ServerSide, 1, true)
+			if m.hits != test.hits || m.misses != test.misses {
+				t.Fatalf("expected hits:%d misses:%d, got hits:%d misses:%d",
+					test.hits, test.misses, m.hits, m.misses)
+			}
+			if len(m.pending) != 0 {
+				t.Fatalf("expected nothing pending, got %v", m.pending)
+			}
+		})
+	}
+}
+
+func TestMemcachedBinary(t *testing.T) {
+	const flags = "\x00\x00\x00\x00"
+	tests := []struct {
+		name      string
+		requests  [][]byte
+		responses [][]byte
+		hits      int
+		misses    int
+	}{
+		{
+			name: "quiet get miss",
+			requests: [][]byte{
+				memcachedTestPacket(memcachedRequestMagic, memcachedOpGetQ, 0, 1, "", "a", ""),
+				memcachedTestPacket(memcachedRequestMagic, memcachedOpGetQ, 0, 2, "", "b", ""),
+				memcachedTestPacket(memcachedRequestMagic, memcachedOpNoop, 0, 3, "", "", ""),
+			},
+			responses: [][]byte{
+				memcachedTestPacket(memcachedResponseMagic, memcachedOpGetQ, 0, 2, flags, "", "x"),
+				memcachedTestPacket(memcachedResponseMagic, memcachedOpNoop, 0, 3, "", "", ""),
+			},
+			hits:   1,
+			misses: 1,
+		},
+		{
+			name: "paired by opaque",
+			requests: [][]byte{
+				memcachedTestPacket(memcachedRequestMagic, 0x00, 0, 7, "", "a", ""),
+				memcachedTestPacket(memcachedRequestMagic, 0x00, 0, 8, "", "b", ""),
+			},
+			responses: [][]byte{
+				memcachedTestPacket(memcachedResponseMagic, 0x00, memcachedStatusKeyNotFound, 8, "", "", ""),
+				memcachedTestPacket(memcachedResponseMagic, 0x00, 0, 7, flags, "", "x"),
+			},
+			hits:   1,
+			misses: 1,
+		},
+		{
+			name: "unknown opaque",
+			responses: [][]byte{
+				memcachedTestPacket(memcachedResponseMagic, 0x01, 0, 9, "", "", ""),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemcachedInterop()
+			m.Dump(bytes.NewReader(bytes.Join(test.requests, nil)), ClientSide, 1, true)
+			m.Dump(bytes.NewReader(bytes.Join(test.responses, nil)), ServerSide, 1, true)
+			if m.hits != test.hits || m.misses != test.misses {
+				t.Fatalf("expected hits:%d misses:%d, got hits:%d misses:%d",
+					test.hits, test.misses, m.hits, m.misses)
+			}
+			if len(m.opaques) != 0 {
+				t.Fatalf("expected nothing pending, got %v", m.opaques)
+			}
+		})
+	}
+}
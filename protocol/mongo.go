@@ -41,6 +41,7 @@ func (mongo *mongoInterop) Dump(r io.Reader, source string, id int, quiet bool)
 	for {
 		pk = newPacket(source, r)
 		if pk == nil {
+			drain(r)
 			return
 		}
 		if pk.IsClientFlow {
@@ -13,11 +13,12 @@ type mqttInterop struct {
 func (red *mqttInterop) Dump(r io.Reader, source string, id int, quiet bool) {
 	for {
 		readPacket, err := packets.ReadPacket(r)
-		if err != nil && err == io.EOF {
-			continue
+		if err == io.EOF {
+			return
 		}
 		if err != nil {
 			display.PrintfWithTime("[%s-%d] read packet has err: %+v, stop!!!\n", source, id, err)
+			drain(r)
 			return
 		}
 		if !quiet {
@@ -1,22 +1,81 @@
 package protocol
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
-	"github.com/fatih/color"
-	"github.com/kevwan/tproxy/display"
 	"io"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
 )
 
-type mysqlInterop struct{}
+const (
+	mysqlComQuit            = 0x01
+	mysqlComInitDB          = 0x02
+	mysqlComQuery           = 0x03
+	mysqlComFieldList       = 0x04
+	mysqlComRefresh         = 0x07
+	mysqlComStatistics      = 0x09
+	mysqlComProcessKill     = 0x0c
+	mysqlComSetOption       = 0x1b
+	mysqlServerMoreResults  = 0x0008
+	mysqlClientQueryAttrs   = 1 << 27
+	mysqlMaxShowQueryLen    = 4096
+	mysqlLocalInfileRequest = 0xfb
+)
 
-const maxDecodeResponseBodySize = 32 * 1 << 10 // Limit 32KB (only result set may reach this limitation.)
+// mysqlInterop is shared by both directions of a connection, the sequence ids are shared too.
+type mysqlInterop struct {
+	phase mysqlPhase
+	// the HandshakeResponse is sent.
+	responded bool
+	// the capabilities of the client, which are a subset of the server ones.
+	capabilities       uint32
+	serverCapabilities uint32
+	plugin             string
+	// the command waiting for its response, and the result set being read.
+	command *mysqlCommand
+	result  *mysqlResult
+	// the open prepared statements, and the one being prepared.
+	stmts     map[uint32]*mysqlStmt
+	preparing *mysqlStmt
+	// the client is sending a file for LOAD DATA LOCAL INFILE.
+	infile  bool
+	conn    mysqlConnStats
+	nextSeq byte
+	closed  bool
+	lock    sync.Mutex
+}
+
+type mysqlCommand struct {
+	code  byte
+	query string
+	stmt  *mysqlStmt
+	start time.Time
+	// accumulated over the results, for the query digest.
+	rows     int
+	affected uint64
+	failed   bool
+}
+
+func newMysqlInterop() *mysqlInterop {
+	mysqlPoolStatsOnce.Do(func() {
+		register(mysqlPoolStatistics)
+	})
+	mysqlDigestStatsOnce.Do(func() {
+		register(mysqlDigestStatistics)
+	})
+
+	return &mysqlInterop{
+		conn: mysqlConnStats{start: time.Now()},
+	}
+}
 
 var comTypeMap = map[byte]string{
 	0x00: "SLEEP",
@@ -48,135 +107,107 @@ var comTypeMap = map[byte]string{
 	0x1a: "RESET_STMT",
 	0x1b: "SET_OPTION",
 	0x1c: "FETCH",
+	0x1d: "DAEMON",
+	0x1e: "BINLOG_DUMP_GTID",
+	0x1f: "RESET_CONNECTION",
 }
 
 var statusFlagMap = map[uint16]string{
-	0x01: "SERVER_STATUS_AUTOCOMMIT",
-	0x02: "SERVER_STATUS_COMMAND",
-	0x04: "SERVER_STATUS_CONNECTED",
-	0x08: "SERVER_STATUS_MORE_RESULTS",
-	0x10: "SERVER_STATUS_SESSION_STATE ",
+	0x0001: "SERVER_STATUS_IN_TRANS",
+	0x0002: "SERVER_STATUS_AUTOCOMMIT",
+	0x0008: "SERVER_MORE_RESULTS_EXISTS",
+	0x0010: "SERVER_QUERY_NO_GOOD_INDEX_USED",
+	0x0020: "SERVER_QUERY_NO_INDEX_USED",
+	0x0040: "SERVER_STATUS_CURSOR_EXISTS",
+	0x0080: "SERVER_STATUS_LAST_ROW_SENT",
+	0x0100: "SERVER_STATUS_DB_DROPPED",
+	0x0200: "SERVER_STATUS_NO_BACKSLASH_ESCAPES",
+	0x0400: "SERVER_STATUS_METADATA_CHANGED",
+	0x0800: "SERVER_QUERY_WAS_SLOW",
+	0x1000: "SERVER_PS_OUT_PARAMS",
+	0x2000: "SERVER_STATUS_IN_TRANS_READONLY",
+	0x4000: "SERVER_SESSION_STATE_CHANGED",
 }
 
-type ServerResponse struct {
-	PacketLength int
-	SequenceID   byte
-	Type         byte
-	Data         []byte
+type mysqlOK struct {
+	affectedRows uint64
+	lastInsertID uint64
+	status       uint16
+	warnings     uint16
+	info         []byte
 }
 
-type ResponsePkgType string
-
-const (
-	MySQLResponseTypeOK        ResponsePkgType = "OK"
-	MySQLResponseTypeError     ResponsePkgType = "Error"
-	MySQLResponseTypeEOF       ResponsePkgType = "EOF"
-	MySQLResponseTypeResultSet ResponsePkgType = "Result Set"
-	MySQLResponseTypeUnknown   ResponsePkgType = "Unknown"
-)
-
-func getPkgType(flag byte) ResponsePkgType {
-	if flag == 0x00 || flag == 0xfe {
-		return MySQLResponseTypeOK
-	} else if flag == 0xff {
-		return MySQLResponseTypeError
-	} else if flag > 0x01 && flag < 0xfa {
-		return MySQLResponseTypeResultSet
-	} else {
-		return MySQLResponseTypeUnknown
-	}
+// parseMysqlOK parses an OK packet, or an EOF packet that replaces it with CLIENT_DEPRECATE_EOF.
+func parseMysqlOK(payload []byte) (mysqlOK, error) {
+	var ok mysqlOK
+	buf := &mysqlBuffer{b: payload[1:]}
+	ok.affectedRows, _ = buf.lenencInt()
+	ok.lastInsertID, _ = buf.lenencInt()
+	ok.status = buf.uint16()
+	ok.warnings = buf.uint16()
+	ok.info = buf.rest()
+
+	return ok, buf.err
 }
 
-func readLCInt(buf []byte) ([]byte, uint64, error) {
-	if len(buf) == 0 {
-		return nil, 0, errors.New("empty buffer")
+func (ok mysqlOK) String() string {
+	result := fmt.Sprintf("affected_rows:%d last_insert_id:%d warnings:%d status:%s",
+		ok.affectedRows, ok.lastInsertID, ok.warnings, explainMysqlStatus(ok.status))
+	if len(ok.info) > 0 {
+		result += fmt.Sprintf(" info:%q", ok.info)
 	}
 
-	lcbyte := buf[0]
-
-	switch {
-	case lcbyte == 0xFB: // 0xFB
-		return buf[1:], 0, nil
-	case lcbyte < 0xFB:
-		return buf[1:], uint64(lcbyte), nil
-	case lcbyte == 0xFC: // 0xFC
-		return buf[3:], uint64(binary.LittleEndian.Uint16(buf[1:3])), nil
-	case lcbyte == 0xFD: // 0xFD
-		return buf[4:], uint64(binary.LittleEndian.Uint32(append(buf[1:4], 0))), nil
-	case lcbyte == 0xFE: // 0xFE
-		return buf[9:], binary.LittleEndian.Uint64(buf[1:9]), nil
-	default:
-		return nil, 0, errors.New("failed reading length encoded integer")
-	}
+	return result
 }
 
-func processOkResponse(sequenceId byte, payload []byte) {
-	var (
-		affectedRows, lastInsertID uint64
-		statusFlag                 string
-		ok                         bool
-		err                        error
-		remaining                  []byte
-	)
-	remaining, affectedRows, err = readLCInt(payload[1:])
-	if err != nil {
-		display.PrintlnWithTime(color.HiRedString("Failed reading length encoded integer: " + err.Error()))
-		return
-	}
-	remaining, lastInsertID, err = readLCInt(remaining)
+func explainMysqlOK(payload []byte) string {
+	ok, err := parseMysqlOK(payload)
 	if err != nil {
-		display.PrintlnWithTime(color.HiRedString("Failed reading length encoded integer: " + err.Error()))
-		return
+		return color.HiRedString("invalid OK packet: %v", err)
 	}
 
-	if err != nil {
-		display.PrintlnWithTime(color.HiRedString("Failed reading length encoded integer: " + err.Error()))
-		return
-	}
+	return ok.String()
+}
 
-	statusFlag, ok = statusFlagMap[binary.LittleEndian.Uint16(remaining[:2])]
-	if !ok {
-		statusFlag = "unknown"
+func explainMysqlStatus(status uint16) string {
+	var names []string
+	for bit := uint16(1); bit != 0; bit <<= 1 {
+		if status&bit == 0 {
+			continue
+		}
+		if name, ok := statusFlagMap[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("0x%04x", bit))
+		}
+	}
+	if len(names) == 0 {
+		return "0"
 	}
 
-	remaining = remaining[2:]
-
-	warningsCount := binary.LittleEndian.Uint16(remaining[:2])
-
-	remaining = remaining[2:]
-
-	display.PrintlnWithTime(
-		fmt.Sprintf("[Server -> Client] %d-%s: affectRows: %d, lastInsertID: %d, warningsCount: %d, status: %s, data: %s",
-			sequenceId, MySQLResponseTypeOK, affectedRows, lastInsertID, warningsCount, statusFlag, remaining))
-}
-
-var sqlStateDescriptions = map[string]string{
-	"42000": "Syntax error or access rule violation.",
-	"23000": "Integrity constraint violation.",
-	"08000": "Connection exception.",
-	"28000": "Invalid authorization specification.",
-	"42001": "Syntax error in SQL statement.",
+	return strings.Join(names, "|")
 }
 
-func processErrorResponse(sequenceId byte, payload []byte) {
-	errCode := binary.LittleEndian.Uint16(payload[1:3])
-	sqlStateMarker := payload[3]
-	sqlState := string(payload[5:9])
-	sqlStateDescription, ok := sqlStateDescriptions[sqlState[1:]]
-	if !ok {
-		sqlStateDescription = "Unknown SQLSTATE"
+// explainMysqlError explains an ERR packet like the mysql client,
+// the SQLSTATE is absent before the handshake completes.
+func explainMysqlError(payload []byte) string {
+	buf := &mysqlBuffer{b: payload[1:]}
+	errCode := buf.uint16()
+	var sqlState string
+	if len(buf.b) > 0 && buf.b[0] == '#' {
+		buf.next(1)
+		sqlState = string(buf.next(5))
+	}
+	errorMessage := string(buf.rest())
+	if buf.err != nil {
+		return fmt.Sprintf("invalid ERR packet: %v", buf.err)
 	}
-	errorMessage := string(payload[9:])
-
-	display.PrintfWithTime(
-		color.HiYellowString(fmt.Sprintf("[Server -> Client] %d-%s: ErrCode: %d, ErrMsg: %s, SqlState: %s, sqlStateMaker: %v",
-			sequenceId, MySQLResponseTypeError, errCode, errorMessage, sqlStateDescription, sqlStateMarker)),
-	)
-}
 
-func processResultSetResponse(sequenceId byte, payload []byte) {
-	display.PrintfWithTime(fmt.Sprintf("[Server -> Client] %d-%s: \n %s", sequenceId, MySQLResponseTypeResultSet, hexDump(payload)))
+	if len(sqlState) == 0 {
+		return fmt.Sprintf("ERROR %d: %s", errCode, errorMessage)
+	}
 
+	return fmt.Sprintf("ERROR %d (%s): %s", errCode, sqlState, errorMessage)
 }
 
 func insertSpace(hexStr string) string {
@@ -226,94 +257,264 @@ func hexDump(data []byte) string {
 	return result.String()
 }
 
-func processUnknownResponse(sequenceId byte, payload []byte) {
-	display.PrintlnWithTime(fmt.Sprintf("[Server -> Client] %d-%s:\n%s", sequenceId, MySQLResponseTypeUnknown, hexDump(payload)))
+func (mysql *mysqlInterop) dumpServer(id int, quiet bool, packet *mysqlPacket) {
+	switch mysql.getPhase() {
+	case mysqlPhaseGreeting:
+		mysql.dumpGreeting(id, quiet, packet)
+	case mysqlPhaseAuth:
+		mysql.dumpAuthResult(id, quiet, packet)
+	default:
+		mysql.dumpResponse(id, quiet, packet)
+	}
 }
 
-func (mysql *mysqlInterop) dumpServer(r io.Reader, id int, quiet bool, data []byte) {
-	if len(data) < 4 {
-		display.PrintlnWithTime("Invalid packet: insufficient data for header")
+func (mysql *mysqlInterop) dumpClient(id int, quiet bool, packet *mysqlPacket) {
+	if mysql.getPhase() != mysqlPhaseCommand {
+		mysql.dumpClientAuth(id, quiet, packet)
 		return
 	}
 
-	sequenceId := data[3]
-	payload := data[4:]
+	mysql.lock.Lock()
+	infile := mysql.infile
+	if infile && len(packet.payload) == 0 {
+		// an empty packet ends the file.
+		mysql.infile = false
+	}
+	mysql.lock.Unlock()
+	if infile {
+		if !quiet {
+			display.PrintfWithTime("[%s-%d] %s len:%d\n", ClientSide, id, color.HiYellowString("local_infile_data"),
+				packet.size)
+		}
+		return
+	}
+	if len(packet.payload) == 0 {
+		return
+	}
 
-	if len(payload) > maxDecodeResponseBodySize {
-		display.PrintlnWithTime(color.HiRedString(fmt.Sprintf("Packet too large to, just decode %d MB", maxDecodeResponseBodySize/1024/1024)))
-		payload = payload[:maxDecodeResponseBodySize]
+	cmd := &mysqlCommand{
+		code:  packet.payload[0],
+		start: time.Now(),
+	}
+	if cmd.code == mysqlComChangeUser {
+		mysql.lock.Lock()
+		mysql.conn.addCommand(cmd, false)
+		mysql.lock.Unlock()
+		mysql.dumpChangeUser(id, quiet, packet)
+		return
 	}
 
-	switch getPkgType(payload[0]) {
-	case MySQLResponseTypeOK:
-		processOkResponse(sequenceId, payload)
-	case MySQLResponseTypeError:
-		processErrorResponse(sequenceId, payload)
-	case MySQLResponseTypeResultSet:
-		processResultSetResponse(sequenceId, payload)
-	case MySQLResponseTypeEOF:
+	args := mysql.explainCommand(cmd, packet)
+	mysql.lock.Lock()
+	switch cmd.code {
+	case mysqlComQuit, mysqlComStmtClose, mysqlComStmtSendLongData:
+		// no responses
+		mysql.conn.addCommand(cmd, true)
 	default:
-		processUnknownResponse(sequenceId, payload)
+		mysql.conn.addCommand(cmd, false)
+		mysql.command = cmd
+		mysql.result = nil
+		mysql.preparing = nil
+	}
+	mysql.lock.Unlock()
+
+	if quiet {
+		return
 	}
 
+	display.PrintfWithTime("[%s-%d] %s%s\n", ClientSide, id, color.HiYellowString(mysqlCommandName(cmd.code)), args)
 }
 
-func (mysql *mysqlInterop) dumpClient(r io.Reader, id int, quiet bool, data []byte) {
-	// parse packet length
-	var (
-		packetLength uint32
-		sequenceId   uint32
-	)
-	reader := bytes.NewReader(data[:4])
-	err := binary.Read(reader, binary.BigEndian, &packetLength)
-	if err != nil {
-		display.PrintfWithTime("Error reading packet length: %v\n", err)
-		return
+// explainCommand explains the arguments of a command, and keeps the query in cmd.
+func (mysql *mysqlInterop) explainCommand(cmd *mysqlCommand, packet *mysqlPacket) string {
+	buf := &mysqlBuffer{b: packet.payload[1:]}
+	var args string
+	switch cmd.code {
+	case mysqlComQuery:
+		mysql.lock.Lock()
+		capabilities := mysql.capabilities
+		mysql.lock.Unlock()
+		var attrs string
+		if capabilities&mysqlClientQueryAttrs != 0 {
+			attrs = explainMysqlQueryAttrs(buf)
+		}
+		// the size of the query, after the command and the query attributes.
+		size := packet.size - (len(packet.payload) - len(buf.b))
+		cmd.query = string(buf.rest())
+		args = " " + truncateMysqlQuery(cmd.query, size) + attrs
+	case mysqlComInitDB:
+		args = " " + string(buf.rest())
+	case mysqlComFieldList:
+		table := buf.nulString()
+		args = fmt.Sprintf(" table:%s wildcard:%s", table, buf.rest())
+	case mysqlComProcessKill:
+		args = fmt.Sprintf(" connection_id:%d", buf.uint32())
+	case mysqlComRefresh:
+		args = fmt.Sprintf(" flags:0x%02x", buf.uint8())
+	case mysqlComSetOption:
+		args = fmt.Sprintf(" option:%d", buf.uint16())
+	case mysqlComStmtPrepare, mysqlComStmtExecute, mysqlComStmtSendLongData, mysqlComStmtClose,
+		mysqlComStmtReset, mysqlComStmtFetch:
+		args = mysql.explainStmtCommand(cmd, buf)
+	default:
+		if len(buf.b) > 0 {
+			args = fmt.Sprintf(" len:%d", packet.size)
+		}
+	}
+	if buf.err != nil {
+		return fmt.Sprintf(" invalid packet: %v", buf.err)
 	}
 
-	// parse command type
-	commandType := data[4]
-	commandName := comTypeMap[commandType]
+	return args
+}
 
-	// parse sequence id
-	if len(data) < 6 {
-		sequenceId = 0
-	} else {
-		sequenceId = uint32(data[5])
+// explainMysqlQueryAttrs reads the query attributes before the query of COM_QUERY,
+// with the same layout as the parameters of COM_STMT_EXECUTE, and the names of the attributes.
+func explainMysqlQueryAttrs(buf *mysqlBuffer) string {
+	count, _ := buf.lenencInt()
+	buf.lenencInt() // parameter set count, always 1
+	if count == 0 || buf.err != nil {
+		return ""
+	}
+	if count > uint64(len(buf.b)) {
+		buf.err = errMysqlShortPacket
+		return ""
 	}
 
-	// parse query
-	var query []byte
-	for i := 6; i < len(data); i++ {
-		if data[i] == 0 {
-			break
-		}
-		query = append(query, data[i])
+	nulls := buf.next(int(count+7) / 8)
+	buf.uint8() // new params bind flag, always 1
+	types := make([]uint16, 0, count)
+	names := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		types = append(types, buf.uint16())
+		names = append(names, buf.lenencString())
 	}
 
-	if utf8.Valid(query) {
-		display.PrintlnWithTime(fmt.Sprintf("[Client -> Server] %d-%s: %s", sequenceId, commandName, string(query)))
-	} else {
-		display.PrintlnWithTime(color.HiRedString("Invalid Query %v", query))
+	attrs := make([]string, 0, count)
+	for i, typ := range types {
+		value := mysqlNull
+		if buf.err == nil && nulls[i/8]&(1<<(i%8)) == 0 {
+			text, raw := readMysqlBinaryValue(buf, byte(typ), typ&mysqlParamUnsignedFlag != 0)
+			value = mysqlLiteral(byte(typ), text, raw)
+		}
+		attrs = append(attrs, fmt.Sprintf("%s=%s", names[i], value))
+	}
+	if buf.err != nil {
+		return ""
 	}
+
+	return " attributes:" + strings.Join(attrs, ",")
 }
 
 func (mysql *mysqlInterop) Dump(r io.Reader, source string, id int, quiet bool) {
-	buffer := make([]byte, bufferSize)
+	reader := newMysqlReader(r)
 	for {
-		n, err := r.Read(buffer)
-		if err != nil && err != io.EOF {
-			display.PrintlnWithTime("Unable to read data: %v", err)
-			break
+		packet, err := reader.readPacket()
+		if mysql.getPhase() == mysqlPhaseEncrypted {
+			drain(r)
+			mysql.close(source, id, quiet)
+			return
 		}
-
-		if n > 0 && !quiet {
-			data := buffer[:n]
-			if source == "CLIENT" {
-				mysql.dumpClient(r, id, quiet, data)
-			} else {
-				mysql.dumpServer(r, id, quiet, data)
+		if err != nil {
+			if err != io.EOF {
+				display.PrintfWithTime(color.HiRedString("[%s-%d] unable to read mysql packet: %v\n", source, id, err))
 			}
+			drain(r)
+			mysql.close(source, id, quiet)
+			return
+		}
+
+		mysql.checkSequence(source, id, packet)
+		if source == ClientSide {
+			mysql.dumpClient(id, quiet, packet)
+		} else if len(packet.payload) > 0 {
+			mysql.dumpServer(id, quiet, packet)
 		}
 	}
 }
+
+// checkSequence checks that the sequence ids increase across both directions,
+// they are reset to 0 at the start of each command, and the greeting of the server.
+func (mysql *mysqlInterop) checkSequence(source string, id int, packet *mysqlPacket) {
+	mysql.lock.Lock()
+	defer mysql.lock.Unlock()
+
+	if packet.seq != 0 && packet.seq != mysql.nextSeq {
+		display.PrintfWithTime(color.HiRedString("[%s-%d] out of order mysql packet, sequence id %d, expected %d\n",
+			source, id, packet.seq, mysql.nextSeq))
+	}
+	mysql.nextSeq = packet.lastSeq + 1
+}
+
+// close summarizes the connection and reports the prepared statements that are not closed,
+// on the first direction that ends, which is the side that closes the connection.
+func (mysql *mysqlInterop) close(source string, id int, quiet bool) {
+	mysql.lock.Lock()
+	defer mysql.lock.Unlock()
+
+	if mysql.closed {
+		return
+	}
+	mysql.closed = true
+
+	closedBy := source
+	if mysql.conn.quit {
+		closedBy = ClientSide
+	}
+	info, details := mysql.conn.summary(closedBy)
+	mysqlPoolStatistics.record(&mysql.conn, closedBy)
+	if quiet {
+		return
+	}
+
+	if len(details) > 0 {
+		details = indent(details)
+	}
+	display.PrintfWithTime("[%s-%d] %s %s\n%s", source, id, color.HiYellowString("connection_closed"), info,
+		details)
+	if len(mysql.stmts) == 0 {
+		return
+	}
+
+	ids := make([]uint32, 0, len(mysql.stmts))
+	for stmtID := range mysql.stmts {
+		ids = append(ids, stmtID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	var builder strings.Builder
+	for _, stmtID := range ids {
+		query := mysql.stmts[stmtID].query
+		builder.WriteString(fmt.Sprintf("stmt:%d %s\n", stmtID, truncateMysqlQuery(query, len(query))))
+	}
+	display.PrintfWithTime("[%s-%d] %s\n%s", source, id,
+		color.HiRedString("%d prepared statements not closed", len(mysql.stmts)), indent(builder.String()))
+}
+
+func (mysql *mysqlInterop) getPhase() mysqlPhase {
+	mysql.lock.Lock()
+	defer mysql.lock.Unlock()
+
+	return mysql.phase
+}
+
+func mysqlCommandName(code byte) string {
+	if name, ok := comTypeMap[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("COM_0x%02x", code)
+}
+
+// truncateMysqlQuery truncates the query if too long, size is the bytes of the whole query.
+func truncateMysqlQuery(query string, size int) string {
+	if len(query) <= mysqlMaxShowQueryLen && len(query) == size {
+		return query
+	}
+	if len(query) > mysqlMaxShowQueryLen {
+		query = query[:mysqlMaxShowQueryLen]
+	}
+
+	return fmt.Sprintf("%s...(%d bytes)", query, size)
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestMysqlEncryptedClose(t *testing.T) {
+	payload := make([]byte, mysqlSSLRequestLen)
+	binary.LittleEndian.PutUint32(payload, mysqlClientProtocol41|mysqlClientSSL)
+	packet := []byte{byte(len(payload)), 0, 0, 1}
+	packet = append(packet, payload...)
+	// the tls handshake after the SSLRequest.
+	packet = append(packet, 0x16, 0x03, 0x01, 0x00, 0x05, 1, 2, 3, 4, 5)
+
+	mysql := newMysqlInterop()
+	mysql.Dump(bytes.NewReader(packet), ClientSide, 1, true)
+	if !mysql.closed {
+		t.Fatal("expected the encrypted connection to be closed")
+	}
+	if !mysql.conn.encrypted {
+		t.Fatal("expected the connection to be marked encrypted")
+	}
+	_, details := mysql.conn.summary(ClientSide)
+	if !strings.Contains(details, "statistics stop at the handshake") {
+		t.Fatalf("expected the summary to tell the statistics stop at the handshake, got %q", details)
+	}
+}
+
+func TestMysqlQueryAttributes(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		query   string
+		args    string
+	}{
+		{
+			name:    "no attributes",
+			payload: []byte("\x03\x00\x01select 1"),
+			query:   "select 1",
+			args:    " select 1",
+		},
+		{
+			name: "string and integer",
+			payload: []byte("\x03\x02\x01\x00\x01" +
+				"\xfd\x00\x05trace" + "\x08\x00\x02id" +
+				"\x03abc" + "\x2a\x00\x00\x00\x00\x00\x00\x00" +
+				"select 1"),
+			query: "select 1",
+			args:  " select 1 attributes:trace='abc',id=42",
+		},
+		{
+			name:    "null",
+			payload: []byte("\x03\x01\x01\x01\x01\xfd\x00\x05trace" + "select 1"),
+			query:   "select 1",
+			args:    " select 1 attributes:trace=NULL",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mysql := newMysqlInterop()
+			mysql.capabilities = mysqlClientQueryAttrs
+			cmd := &mysqlCommand{code: mysqlComQuery}
+			args := mysql.explainCommand(cmd, &mysqlPacket{payload: test.payload, size: len(test.payload)})
+			if cmd.query != test.query {
+				t.Fatalf("expected query %q, got %q", test.query, cmd.query)
+			}
+			if args != test.args {
+				t.Fatalf("expected %q, got %q", test.args, args)
+			}
+		})
+	}
+}
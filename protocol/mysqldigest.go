@@ -0,0 +1,284 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/olekukonko/tablewriter/tw"
+)
+
+const (
+	// the latest latencies kept for each fingerprint to compute the p99.
+	mysqlLatencySamples = 1000
+	// the max distinct fingerprints, the queries of the ones after are not counted to bound the memory.
+	mysqlMaxFingerprints = 10000
+	mysqlDigestTopN      = 20
+	// the max bytes of a fingerprint to show in the digest.
+	mysqlMaxShowFingerprintLen = 100
+)
+
+var (
+	mysqlDigestStatistics = newMysqlDigestStats()
+	mysqlDigestStatsOnce  sync.Once
+	// the value lists of IN and VALUES, after the literals are replaced.
+	mysqlInList     = regexp.MustCompile(`\bin ?\( ?\?( ?, ?\?)* ?\)`)
+	mysqlValuesList = regexp.MustCompile(`\bvalues ?\( ?\?( ?, ?\?)* ?\)( ?, ?\( ?\?( ?, ?\?)* ?\))*`)
+)
+
+type (
+	mysqlDigest struct {
+		count     int
+		total     time.Duration
+		latencies []time.Duration
+		// the next position to overwrite in latencies once it's full.
+		next     int
+		rows     int
+		affected uint64
+		errors   int
+		slow     int
+	}
+
+	// mysqlDigestStats accumulates the queries of all mysql connections by their fingerprints.
+	mysqlDigestStats struct {
+		digests map[string]*mysqlDigest
+		changed bool
+		lock    sync.Mutex
+	}
+)
+
+func newMysqlDigestStats() *mysqlDigestStats {
+	return &mysqlDigestStats{
+		digests: make(map[string]*mysqlDigest),
+	}
+}
+
+// record accounts a query, or a prepared statement execution, once all its results are read.
+func (s *mysqlDigestStats) record(cmd *mysqlCommand, latency time.Duration, slow bool) {
+	query := mysqlCommandQuery(cmd)
+	if len(query) == 0 {
+		return
+	}
+
+	fingerprint := mysqlFingerprint(query)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	digest, ok := s.digests[fingerprint]
+	if !ok {
+		if len(s.digests) >= mysqlMaxFingerprints {
+			return
+		}
+		digest = new(mysqlDigest)
+		s.digests[fingerprint] = digest
+	}
+
+	s.changed = true
+	digest.count++
+	digest.total += latency
+	if len(digest.latencies) < mysqlLatencySamples {
+		digest.latencies = append(digest.latencies, latency)
+	} else {
+		digest.latencies[digest.next] = latency
+		digest.next = (digest.next + 1) % mysqlLatencySamples
+	}
+	digest.rows += cmd.rows
+	digest.affected += cmd.affected
+	if cmd.failed {
+		digest.errors++
+	}
+	if slow {
+		digest.slow++
+	}
+}
+
+func (s *mysqlDigestStats) report() (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.digests) == 0 {
+		return "", false
+	}
+	changed := s.changed
+	s.changed = false
+
+	// ranked by the total latency, like pt-query-digest.
+	fingerprints := make([]string, 0, len(s.digests))
+	for fingerprint := range s.digests {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		ti, tj := s.digests[fingerprints[i]].total, s.digests[fingerprints[j]].total
+		return ti > tj || ti == tj && fingerprints[i] < fingerprints[j]
+	})
+	var more int
+	if len(fingerprints) > mysqlDigestTopN {
+		more = len(fingerprints) - mysqlDigestTopN
+		fingerprints = fingerprints[:mysqlDigestTopN]
+	}
+
+	var builder strings.Builder
+	header := []string{"fingerprint", "count", "total", "avg", "p99", "rows", "affected", "errors"}
+	if mysqlSlowQuery > 0 {
+		header = append(header, "slow")
+	}
+	rows := make([][]string, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		digest := s.digests[fingerprint]
+		latencies := append([]time.Duration(nil), digest.latencies...)
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		if len(fingerprint) > mysqlMaxShowFingerprintLen {
+			fingerprint = fingerprint[:mysqlMaxShowFingerprintLen] + "..."
+		}
+		row := []string{
+			fingerprint,
+			fmt.Sprint(digest.count),
+			digest.total.String(),
+			(digest.total / time.Duration(digest.count)).String(),
+			percentile(latencies, 99).String(),
+			fmt.Sprint(digest.rows),
+			fmt.Sprint(digest.affected),
+			fmt.Sprint(digest.errors),
+		}
+		if mysqlSlowQuery > 0 {
+			row = append(row, fmt.Sprint(digest.slow))
+		}
+		rows = append(rows, row)
+	}
+	table := tablewriter.NewTable(&builder,
+		tablewriter.WithHeaderAutoFormat(tw.Off),
+		tablewriter.WithRowAutoWrap(tw.WrapNone),
+	)
+	table.Header(header)
+	_ = table.Bulk(rows)
+	_ = table.Render()
+	if more > 0 {
+		builder.WriteString(fmt.Sprintf("... %d more fingerprints\n", more))
+	}
+
+	return color.HiWhiteString("MySQL query digest:\n") + color.HiWhiteString(builder.String()), changed
+}
+
+// mysqlCommandQuery returns the query of a COM_QUERY, or the statement of a COM_STMT_EXECUTE.
+func mysqlCommandQuery(cmd *mysqlCommand) string {
+	switch {
+	case cmd.code == mysqlComQuery:
+		return cmd.query
+	case cmd.code == mysqlComStmtExecute && cmd.stmt != nil:
+		return cmd.stmt.query
+	default:
+		return ""
+	}
+}
+
+// mysqlFingerprint normalizes the query, the literals are replaced by ?, the comments are removed,
+// the words are lowercased, and the lists of IN and VALUES are collapsed into (?+).
+func mysqlFingerprint(query string) string {
+	var builder strings.Builder
+	space := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			space = true
+			continue
+		case c == '-' && strings.HasPrefix(query[i:], "-- "), c == '#':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			i += end
+			space = true
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 4
+			}
+			i += end + 3
+			space = true
+			continue
+		}
+
+		if space && builder.Len() > 0 {
+			builder.WriteByte(' ')
+		}
+		space = false
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(query) {
+				if query[end] == '\\' {
+					end++
+				} else if query[end] == c {
+					// a doubled quote is an escaped one.
+					if end+1 >= len(query) || query[end+1] != c {
+						break
+					}
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				end = len(query) - 1
+			}
+			if c == '`' {
+				// a quoted identifier, not a literal.
+				builder.WriteString(query[i : end+1])
+			} else {
+				builder.WriteByte('?')
+			}
+			i = end
+		case isMysqlDigit(c) || c == '.' && i+1 < len(query) && isMysqlDigit(query[i+1]):
+			// numbers, like 1, 1.5, .5, 1e-3 and 0x1f.
+			end := i + 1
+			for end < len(query) && (isMysqlWord(query[end]) || query[end] == '.' ||
+				(query[end] == '-' || query[end] == '+') && (query[end-1] == 'e' || query[end-1] == 'E')) {
+				end++
+			}
+			builder.WriteByte('?')
+			i = end - 1
+		case c == '-' && i+1 < len(query) && isMysqlDigit(query[i+1]) && !isMysqlOperand(builder.String()):
+			// the sign of a number.
+		case isMysqlWord(c):
+			end := i + 1
+			for end < len(query) && isMysqlWord(query[end]) {
+				end++
+			}
+			builder.WriteString(strings.ToLower(query[i:end]))
+			i = end - 1
+		default:
+			builder.WriteByte(c)
+		}
+	}
+
+	fingerprint := strings.TrimRight(builder.String(), "; ")
+	fingerprint = mysqlInList.ReplaceAllString(fingerprint, "in (?+)")
+	return mysqlValuesList.ReplaceAllString(fingerprint, "values (?+)")
+}
+
+func isMysqlDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isMysqlOperand tells whether the fingerprint ends with an operand, then a following - is a minus, not a sign.
+func isMysqlOperand(fingerprint string) bool {
+	fingerprint = strings.TrimRight(fingerprint, " ")
+	if len(fingerprint) == 0 {
+		return false
+	}
+
+	c := fingerprint[len(fingerprint)-1]
+	return isMysqlWord(c) || c == ')' || c == '?' || c == '`'
+}
+
+func isMysqlWord(c byte) bool {
+	return isMysqlDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || c >= 0x80
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import "testing"
+
+func TestMysqlFingerprint(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		expect string
+	}{
+		{
+			name:   "line comments",
+			query:  "SELECT * FROM t WHERE id = 1 -- trailing\n# another\nAND b = 2",
+			expect: "select * from t where id = ? and b = ?",
+		},
+		{
+			name:   "block comments",
+			query:  "select /* hint */ a from t /* unterminated",
+			expect: "select a from t",
+		},
+		{
+			name:   "doubled quotes",
+			query:  `select * from t where name='bob''s' and x="say ""hi"""`,
+			expect: "select * from t where name=? and x=?",
+		},
+		{
+			name:   "backslash escaped quotes",
+			query:  `select * from t where name = 'a\'b' and c = 'd\\'`,
+			expect: "select * from t where name = ? and c = ?",
+		},
+		{
+			name:   "quoted identifiers",
+			query:  "SELECT `Id` FROM `T1`",
+			expect: "select `Id` from `T1`",
+		},
+		{
+			name:   "numbers",
+			query:  "select 1.5, .5, 1e-3, 0x1F from t1",
+			expect: "select ?, ?, ?, ? from t1",
+		},
+		{
+			name:   "negative numbers",
+			query:  "select * from t where a = -1 and b > -1.5e-3 and c in (-1, -2)",
+			expect: "select * from t where a = ? and b > ? and c in (?+)",
+		},
+		{
+			name:   "minus",
+			query:  "select a - 1, a-1, (a) -1, f(b)-2 from t",
+			expect: "select a - ?, a-?, (a) -?, f(b)-? from t",
+		},
+		{
+			name:   "in list",
+			query:  "select * from t where id IN (1, 2,3) and name in ('x','y')",
+			expect: "select * from t where id in (?+) and name in (?+)",
+		},
+		{
+			name:   "in subquery",
+			query:  "select 1 in (select 2)",
+			expect: "select ? in (select ?)",
+		},
+		{
+			name:   "values lists",
+			query:  "INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y'),(3,'z');",
+			expect: "insert into t (a, b) values (?+)",
+		},
+		{
+			name:   "prepared values",
+			query:  "insert into t values(?, ?)",
+			expect: "insert into t values (?+)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if fingerprint := mysqlFingerprint(test.query); fingerprint != test.expect {
+				t.Fatalf("expected %q, got %q", test.expect, fingerprint)
+			}
+		})
+	}
+}
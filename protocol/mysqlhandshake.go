@@ -0,0 +1,400 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+)
+
+const (
+	mysqlClientConnectWithDB        = 0x8
+	mysqlClientProtocol41           = 0x200
+	mysqlClientSSL                  = 0x800
+	mysqlClientSecureConnection     = 0x8000
+	mysqlClientPluginAuth           = 1 << 19
+	mysqlClientConnectAttrs         = 1 << 20
+	mysqlClientPluginAuthLenencData = 1 << 21
+	mysqlClientDeprecateEOF         = 1 << 24
+
+	mysqlOKPacket          = 0x00
+	mysqlAuthMoreData      = 0x01
+	mysqlAuthSwitchRequest = 0xfe
+	mysqlErrPacket         = 0xff
+	mysqlComChangeUser     = 0x11
+
+	mysqlHandshakeV10             = 10
+	mysqlHandshakeScrambleLen     = 8
+	mysqlHandshakeScramble2MinLen = 13
+	mysqlHandshakeReserved        = 10
+	mysqlHandshakeFiller          = 23
+	mysqlSSLRequestLen            = 32
+
+	mysqlCachingSha2Password           = "caching_sha2_password"
+	mysqlCachingSha2FastAuthSuccess    = 3
+	mysqlCachingSha2FullAuthentication = 4
+	mysqlRequestPublicKey              = 0x02
+	mysqlSha256RequestPublicKey        = 0x01
+	mysqlPublicKeyPrefix               = "-----BEGIN"
+)
+
+const (
+	mysqlPhaseGreeting mysqlPhase = iota
+	mysqlPhaseAuth
+	mysqlPhaseCommand
+	// the connection is upgraded to TLS after SSLRequest, nothing can be decoded.
+	mysqlPhaseEncrypted
+)
+
+var (
+	mysqlCapabilityNames = map[uint32]string{
+		0x1:     "LONG_PASSWORD",
+		0x2:     "FOUND_ROWS",
+		0x4:     "LONG_FLAG",
+		0x8:     "CONNECT_WITH_DB",
+		0x10:    "NO_SCHEMA",
+		0x20:    "COMPRESS",
+		0x40:    "ODBC",
+		0x80:    "LOCAL_FILES",
+		0x100:   "IGNORE_SPACE",
+		0x200:   "PROTOCOL_41",
+		0x400:   "INTERACTIVE",
+		0x800:   "SSL",
+		0x1000:  "IGNORE_SIGPIPE",
+		0x2000:  "TRANSACTIONS",
+		0x4000:  "RESERVED",
+		0x8000:  "SECURE_CONNECTION",
+		1 << 16: "MULTI_STATEMENTS",
+		1 << 17: "MULTI_RESULTS",
+		1 << 18: "PS_MULTI_RESULTS",
+		1 << 19: "PLUGIN_AUTH",
+		1 << 20: "CONNECT_ATTRS",
+		1 << 21: "PLUGIN_AUTH_LENENC_CLIENT_DATA",
+		1 << 22: "CAN_HANDLE_EXPIRED_PASSWORDS",
+		1 << 23: "SESSION_TRACK",
+		1 << 24: "DEPRECATE_EOF",
+		1 << 25: "OPTIONAL_RESULTSET_METADATA",
+		1 << 26: "ZSTD_COMPRESSION_ALGORITHM",
+		1 << 27: "QUERY_ATTRIBUTES",
+		1 << 28: "MULTI_FACTOR_AUTHENTICATION",
+		1 << 29: "CAPABILITY_EXTENSION",
+		1 << 30: "SSL_VERIFY_SERVER_CERT",
+		1 << 31: "REMEMBER_OPTIONS",
+	}
+
+	mysqlCharsetNames = map[uint8]string{
+		8:   "latin1_swedish_ci",
+		28:  "gbk_chinese_ci",
+		33:  "utf8mb3_general_ci",
+		45:  "utf8mb4_general_ci",
+		46:  "utf8mb4_bin",
+		63:  "binary",
+		83:  "utf8mb3_bin",
+		192: "utf8mb3_unicode_ci",
+		224: "utf8mb4_unicode_ci",
+		255: "utf8mb4_0900_ai_ci",
+	}
+)
+
+// mysqlPhase is the phase of a connection, the packets are decoded differently in each phase.
+type mysqlPhase int
+
+// dumpGreeting dumps the initial handshake packet of the server.
+func (mysql *mysqlInterop) dumpGreeting(id int, quiet bool, packet *mysqlPacket) {
+	buf := &mysqlBuffer{b: packet.payload}
+	version := buf.uint8()
+	if version == mysqlErrPacket {
+		// the server refuses the connection, like too many connections or a blocked host.
+		if !quiet {
+			display.PrintfWithTime("[%s-%d] %s %s\n", ServerSide, id, color.HiYellowString("greeting"),
+				color.HiRedString(explainMysqlError(packet.payload)))
+		}
+		return
+	}
+
+	serverVersion := buf.nulString()
+	connectionID := buf.uint32()
+	buf.next(mysqlHandshakeScrambleLen)
+	buf.uint8()
+	capabilities := uint32(buf.uint16())
+	var charset uint8
+	var status uint16
+	var plugin string
+	if len(buf.b) > 0 {
+		charset = buf.uint8()
+		status = buf.uint16()
+		capabilities |= uint32(buf.uint16()) << 16
+		scrambleLen := int(buf.uint8())
+		buf.next(mysqlHandshakeReserved)
+		if capabilities&mysqlClientSecureConnection != 0 {
+			buf.next(max(mysqlHandshakeScramble2MinLen, scrambleLen-mysqlHandshakeScrambleLen))
+		}
+		if capabilities&mysqlClientPluginAuth != 0 {
+			plugin = buf.nulString()
+		}
+	}
+
+	mysql.lock.Lock()
+	mysql.phase = mysqlPhaseAuth
+	mysql.serverCapabilities = capabilities
+	mysql.plugin = plugin
+	mysql.lock.Unlock()
+
+	if quiet {
+		return
+	}
+
+	if buf.err != nil || version != mysqlHandshakeV10 {
+		display.PrintfWithTime(color.HiRedString("[%s-%d] invalid mysql greeting, protocol version %d\n",
+			ServerSide, id, version))
+		return
+	}
+
+	display.PrintfWithTime("[%s-%d] %s version:%s connection_id:%d charset:%s auth_plugin:%s status:%s\n%s",
+		ServerSide, id, color.HiYellowString("greeting"), serverVersion, connectionID, mysqlCharsetName(charset),
+		plugin, explainMysqlStatus(status), indent("capabilities: "+explainMysqlCapabilities(capabilities)+"\n"))
+}
+
+// dumpClientAuth dumps the packets of the client before the authentication completes,
+// the HandshakeResponse or SSLRequest, and the auth data after.
+func (mysql *mysqlInterop) dumpClientAuth(id int, quiet bool, packet *mysqlPacket) {
+	mysql.lock.Lock()
+	responded := mysql.responded
+	mysql.responded = true
+	plugin := mysql.plugin
+	mysql.lock.Unlock()
+
+	if responded {
+		if quiet {
+			return
+		}
+
+		payload := packet.payload
+		var info string
+		switch {
+		case len(payload) == 1 && payload[0] == mysqlRequestPublicKey && plugin == mysqlCachingSha2Password,
+			len(payload) == 1 && payload[0] == mysqlSha256RequestPublicKey && plugin == "sha256_password":
+			info = "request_public_key"
+		default:
+			info = fmt.Sprintf("(redacted %d bytes)", len(payload))
+		}
+		display.PrintfWithTime("[%s-%d] %s %s\n", ClientSide, id, color.HiYellowString("auth_data"), info)
+		return
+	}
+
+	buf := &mysqlBuffer{b: packet.payload}
+	capabilities := buf.uint32()
+	if capabilities&mysqlClientProtocol41 == 0 {
+		if !quiet {
+			display.PrintfWithTime(color.HiRedString("[%s-%d] handshake response of the pre-4.1 protocol, len:%d\n",
+				ClientSide, id, len(packet.payload)))
+		}
+		return
+	}
+
+	maxPacket := buf.uint32()
+	charset := buf.uint8()
+	buf.next(mysqlHandshakeFiller)
+	if len(packet.payload) == mysqlSSLRequestLen && capabilities&mysqlClientSSL != 0 {
+		mysql.lock.Lock()
+		mysql.phase = mysqlPhaseEncrypted
+		mysql.responded = false
+		mysql.conn.encrypted = true
+		mysql.lock.Unlock()
+
+		if !quiet {
+			display.PrintfWithTime("[%s-%d] %s charset:%s, the connection is encrypted since now\n%s",
+				ClientSide, id, color.HiYellowString("ssl_request"), mysqlCharsetName(charset),
+				indent("capabilities: "+explainMysqlCapabilities(capabilities)+"\n"))
+		}
+		return
+	}
+
+	user := buf.nulString()
+	var auth []byte
+	switch {
+	case capabilities&mysqlClientPluginAuthLenencData != 0:
+		auth, _ = buf.lenencBytes()
+	case capabilities&mysqlClientSecureConnection != 0:
+		auth = buf.next(int(buf.uint8()))
+	default:
+		auth = []byte(buf.nulString())
+	}
+	var database string
+	if capabilities&mysqlClientConnectWithDB != 0 {
+		database = buf.nulString()
+	}
+	if capabilities&mysqlClientPluginAuth != 0 {
+		plugin = buf.nulString()
+	}
+	var attrs string
+	if capabilities&mysqlClientConnectAttrs != 0 {
+		attrs = explainMysqlAttrs(buf)
+	}
+
+	mysql.lock.Lock()
+	mysql.capabilities = capabilities
+	if len(plugin) > 0 {
+		mysql.plugin = plugin
+	}
+	mysql.lock.Unlock()
+
+	if quiet {
+		return
+	}
+
+	if buf.err != nil {
+		display.PrintfWithTime(color.HiRedString("[%s-%d] invalid mysql handshake response: %v\n",
+			ClientSide, id, buf.err))
+		return
+	}
+
+	details := "capabilities: " + explainMysqlCapabilities(capabilities) + "\n"
+	if len(attrs) > 0 {
+		details += "attrs: " + attrs + "\n"
+	}
+	display.PrintfWithTime("[%s-%d] %s user:%s database:%s charset:%s auth_plugin:%s auth_response:(redacted %d bytes) max_packet:%d\n%s",
+		ClientSide, id, color.HiYellowString("handshake_response"), user, database, mysqlCharsetName(charset),
+		plugin, len(auth), maxPacket, indent(details))
+}
+
+// dumpChangeUser dumps COM_CHANGE_USER, which starts the authentication again.
+func (mysql *mysqlInterop) dumpChangeUser(id int, quiet bool, packet *mysqlPacket) {
+	mysql.lock.Lock()
+	mysql.phase = mysqlPhaseAuth
+	mysql.responded = true
+	capabilities := mysql.capabilities
+	mysql.lock.Unlock()
+
+	buf := &mysqlBuffer{b: packet.payload[1:]}
+	user := buf.nulString()
+	var auth []byte
+	if capabilities&mysqlClientSecureConnection != 0 {
+		auth = buf.next(int(buf.uint8()))
+	} else {
+		auth = []byte(buf.nulString())
+	}
+	database := buf.nulString()
+	var charset uint16
+	var plugin, attrs string
+	if len(buf.b) > 0 {
+		charset = buf.uint16()
+	}
+	if capabilities&mysqlClientPluginAuth != 0 && len(buf.b) > 0 {
+		plugin = buf.nulString()
+	}
+	if capabilities&mysqlClientConnectAttrs != 0 && len(buf.b) > 0 {
+		attrs = explainMysqlAttrs(buf)
+	}
+
+	if len(plugin) > 0 {
+		mysql.lock.Lock()
+		mysql.plugin = plugin
+		mysql.lock.Unlock()
+	}
+
+	if quiet {
+		return
+	}
+
+	var details string
+	if len(attrs) > 0 {
+		details = indent("attrs: " + attrs + "\n")
+	}
+	display.PrintfWithTime("[%s-%d] %s user:%s database:%s charset:%s auth_plugin:%s auth_response:(redacted %d bytes)\n%s",
+		ClientSide, id, color.HiYellowString("change_user"), user, database, mysqlCharsetName(uint8(charset)),
+		plugin, len(auth), details)
+}
+
+// dumpAuthResult dumps the packets of the server during the authentication,
+// OK and ERR end it, AuthSwitchRequest and AuthMoreData continue it.
+func (mysql *mysqlInterop) dumpAuthResult(id int, quiet bool, packet *mysqlPacket) {
+	payload := packet.payload
+	var name, info string
+	switch payload[0] {
+	case mysqlOKPacket:
+		ok, _ := parseMysqlOK(payload)
+		mysql.lock.Lock()
+		mysql.phase = mysqlPhaseCommand
+		transaction := mysql.conn.updateStatus(nil, ok.status)
+		mysql.conn.lastActive = time.Now()
+		mysql.lock.Unlock()
+		name, info = "auth_ok", explainMysqlOK(payload)+transaction
+	case mysqlErrPacket:
+		name, info = "auth_failed", color.HiRedString(explainMysqlError(payload))
+	case mysqlAuthSwitchRequest:
+		buf := &mysqlBuffer{b: payload[1:]}
+		plugin := buf.nulString()
+		data := buf.rest()
+		mysql.lock.Lock()
+		mysql.plugin = plugin
+		mysql.lock.Unlock()
+		name, info = "auth_switch", fmt.Sprintf("plugin:%s data:(redacted %d bytes)", plugin, len(data))
+	case mysqlAuthMoreData:
+		mysql.lock.Lock()
+		plugin := mysql.plugin
+		mysql.lock.Unlock()
+		data := payload[1:]
+		name = "auth_more_data"
+		switch {
+		case plugin == mysqlCachingSha2Password && len(data) == 1 && data[0] == mysqlCachingSha2FastAuthSuccess:
+			info = "fast_auth_success"
+		case plugin == mysqlCachingSha2Password && len(data) == 1 && data[0] == mysqlCachingSha2FullAuthentication:
+			info = "perform_full_authentication"
+		case strings.HasPrefix(string(data), mysqlPublicKeyPrefix):
+			info = fmt.Sprintf("public_key (%d bytes)", len(data))
+		default:
+			info = fmt.Sprintf("(%d bytes)", len(data))
+		}
+	default:
+		name, info = "auth", fmt.Sprintf("unknown packet 0x%02x len:%d", payload[0], len(payload))
+	}
+
+	if quiet {
+		return
+	}
+
+	display.PrintfWithTime("[%s-%d] %s %s\n", ServerSide, id, color.HiYellowString(name), info)
+}
+
+// explainMysqlAttrs explains the connection attributes, like _client_name and program_name.
+func explainMysqlAttrs(buf *mysqlBuffer) string {
+	size, _ := buf.lenencInt()
+	if size > uint64(len(buf.b)) {
+		buf.err = errMysqlShortPacket
+		return ""
+	}
+
+	attrs := &mysqlBuffer{b: buf.next(int(size))}
+	var pairs []string
+	for len(attrs.b) > 0 && attrs.err == nil {
+		key := attrs.lenencString()
+		value := attrs.lenencString()
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, " ")
+}
+
+func explainMysqlCapabilities(capabilities uint32) string {
+	var names []string
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if capabilities&bit != 0 {
+			names = append(names, mysqlCapabilityNames[bit])
+		}
+	}
+
+	return strings.Join(names, "|")
+}
+
+func mysqlCharsetName(charset uint8) string {
+	if name, ok := mysqlCharsetNames[charset]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", charset)
+}
@@ -0,0 +1,219 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	mysqlHeaderLen = 4
+	// a payload of 0xffffff bytes is continued by the next packet.
+	mysqlMaxPayloadLen = 1<<24 - 1
+	// the max bytes of a payload that we keep, the rest are skipped.
+	mysqlMaxPacketSize = 64 << 20
+)
+
+var errMysqlShortPacket = errors.New("short packet")
+
+type (
+	// mysqlPacket is a payload joined from the continuation packets.
+	mysqlPacket struct {
+		// the sequence ids of the first and the last packets.
+		seq     byte
+		lastSeq byte
+		payload []byte
+		// the bytes of the payload, including the skipped ones.
+		size int
+	}
+
+	mysqlReader struct {
+		r      io.Reader
+		header [mysqlHeaderLen]byte
+	}
+
+	// mysqlBuffer reads the mysql primitive types from a payload, the first error sticks,
+	// so that the decoders can be written without checking every read.
+	mysqlBuffer struct {
+		b   []byte
+		err error
+	}
+)
+
+func newMysqlReader(r io.Reader) *mysqlReader {
+	return &mysqlReader{r: r}
+}
+
+// readPacket reads a packet, with a 3-byte little-endian length and a sequence id,
+// the packets with 0xffffff bytes are joined with the following ones.
+func (r *mysqlReader) readPacket() (*mysqlPacket, error) {
+	packet := new(mysqlPacket)
+	for first := true; ; first = false {
+		if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+			if first {
+				return nil, err
+			}
+			return nil, noEOF(err)
+		}
+
+		length := int(r.header[0]) | int(r.header[1])<<8 | int(r.header[2])<<16
+		seq := r.header[3]
+		if first {
+			packet.seq = seq
+		} else if seq != packet.lastSeq+1 {
+			return nil, fmt.Errorf("continuation packet with sequence id %d, expected %d", seq, packet.lastSeq+1)
+		}
+		packet.lastSeq = seq
+
+		keep := length
+		if packet.size+keep > mysqlMaxPacketSize {
+			keep = mysqlMaxPacketSize - packet.size
+			if keep < 0 {
+				keep = 0
+			}
+		}
+		if keep > 0 {
+			buf := make([]byte, keep)
+			if _, err := io.ReadFull(r.r, buf); err != nil {
+				return nil, noEOF(err)
+			}
+			packet.payload = append(packet.payload, buf...)
+		}
+		if length > keep {
+			if _, err := io.CopyN(io.Discard, r.r, int64(length-keep)); err != nil {
+				return nil, noEOF(err)
+			}
+		}
+		packet.size += length
+
+		if length < mysqlMaxPayloadLen {
+			return packet, nil
+		}
+	}
+}
+
+// truncated tells if the payload is not kept completely.
+func (p *mysqlPacket) truncated() bool {
+	return len(p.payload) < p.size
+}
+
+func (b *mysqlBuffer) next(n int) []byte {
+	if b.err != nil {
+		return nil
+	}
+	if n < 0 || len(b.b) < n {
+		b.err = errMysqlShortPacket
+		return nil
+	}
+
+	v := b.b[:n]
+	b.b = b.b[n:]
+	return v
+}
+
+func (b *mysqlBuffer) uint8() uint8 {
+	if v := b.next(1); v != nil {
+		return v[0]
+	}
+
+	return 0
+}
+
+func (b *mysqlBuffer) uint16() uint16 {
+	if v := b.next(2); v != nil {
+		return binary.LittleEndian.Uint16(v)
+	}
+
+	return 0
+}
+
+func (b *mysqlBuffer) uint24() uint32 {
+	if v := b.next(3); v != nil {
+		return uint32(v[0]) | uint32(v[1])<<8 | uint32(v[2])<<16
+	}
+
+	return 0
+}
+
+func (b *mysqlBuffer) uint32() uint32 {
+	if v := b.next(4); v != nil {
+		return binary.LittleEndian.Uint32(v)
+	}
+
+	return 0
+}
+
+func (b *mysqlBuffer) uint64() uint64 {
+	if v := b.next(8); v != nil {
+		return binary.LittleEndian.Uint64(v)
+	}
+
+	return 0
+}
+
+// lenencInt reads a length-encoded integer, null is 0xfb.
+func (b *mysqlBuffer) lenencInt() (uint64, bool) {
+	switch first := b.uint8(); first {
+	case 0xfb:
+		return 0, true
+	case 0xfc:
+		return uint64(b.uint16()), false
+	case 0xfd:
+		return uint64(b.uint24()), false
+	case 0xfe:
+		return b.uint64(), false
+	case 0xff:
+		if b.err == nil {
+			b.err = fmt.Errorf("invalid length-encoded integer 0x%x", first)
+		}
+		return 0, false
+	default:
+		return uint64(first), false
+	}
+}
+
+func (b *mysqlBuffer) lenencBytes() ([]byte, bool) {
+	n, null := b.lenencInt()
+	if null || b.err != nil {
+		return nil, null
+	}
+	if n > uint64(len(b.b)) {
+		b.err = errMysqlShortPacket
+		return nil, false
+	}
+
+	return b.next(int(n)), false
+}
+
+func (b *mysqlBuffer) lenencString() string {
+	v, _ := b.lenencBytes()
+	return string(v)
+}
+
+// nulString reads a string terminated by 0, or till the end if not terminated.
+func (b *mysqlBuffer) nulString() string {
+	if b.err != nil {
+		return ""
+	}
+
+	index := bytes.IndexByte(b.b, 0)
+	if index < 0 {
+		return string(b.rest())
+	}
+
+	v := string(b.b[:index])
+	b.b = b.b[index+1:]
+	return v
+}
+
+func (b *mysqlBuffer) rest() []byte {
+	if b.err != nil {
+		return nil
+	}
+
+	v := b.b
+	b.b = nil
+	return v
+}
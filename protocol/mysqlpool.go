@@ -0,0 +1,281 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	mysqlComPing                = 0x0e
+	mysqlComResetConnection     = 0x1f
+	mysqlServerStatusInTrans    = 0x0001
+	mysqlServerStatusAutocommit = 0x0002
+)
+
+var (
+	mysqlPoolStatistics = new(mysqlPoolStats)
+	mysqlPoolStatsOnce  sync.Once
+)
+
+type (
+	// mysqlConnStats accumulates the statistics of a connection, to tell how the pool of the client uses it.
+	mysqlConnStats struct {
+		start    time.Time
+		commands int
+		queries  int
+		pings    int
+		resets   int
+		// the end of the last response, the time until the next command is the idle gap.
+		lastActive time.Time
+		idles      int
+		idleTime   time.Duration
+		maxIdle    time.Duration
+		// the status of the last response, tells whether in a transaction and the autocommit mode.
+		status       uint16
+		transStart   time.Time
+		transactions int
+		commits      int
+		rollbacks    int
+		transTime    time.Duration
+		maxTrans     time.Duration
+		// the client sent COM_QUIT.
+		quit bool
+		// upgraded to TLS, the statistics stop at the handshake.
+		encrypted bool
+	}
+
+	// mysqlPoolStats accumulates the statistics of the closed mysql connections.
+	mysqlPoolStats struct {
+		connections  int
+		byClient     int
+		byServer     int
+		encrypted    int
+		lifetime     time.Duration
+		maxLifetime  time.Duration
+		commands     int
+		queries      int
+		maxQueries   int
+		pings        int
+		resets       int
+		idles        int
+		idleTime     time.Duration
+		maxIdle      time.Duration
+		transactions int
+		commits      int
+		rollbacks    int
+		transTime    time.Duration
+		maxTrans     time.Duration
+		changed      bool
+		lock         sync.Mutex
+	}
+)
+
+// addCommand accounts a command sent by the client, noResponse tells the command ends without a response.
+func (s *mysqlConnStats) addCommand(cmd *mysqlCommand, noResponse bool) {
+	s.commands++
+	switch cmd.code {
+	case mysqlComQuery, mysqlComStmtExecute:
+		s.queries++
+	case mysqlComPing:
+		s.pings++
+	case mysqlComResetConnection:
+		s.resets++
+	case mysqlComQuit:
+		s.quit = true
+	}
+
+	if !s.lastActive.IsZero() {
+		idle := cmd.start.Sub(s.lastActive)
+		s.idles++
+		s.idleTime += idle
+		if idle > s.maxIdle {
+			s.maxIdle = idle
+		}
+	}
+	if noResponse {
+		s.lastActive = cmd.start
+	} else {
+		// the idle gap is only counted after the response.
+		s.lastActive = time.Time{}
+	}
+}
+
+// updateStatus follows the transactions by the status of the responses, cmd is nil on authentication,
+// returns the transaction that begins or ends if any.
+func (s *mysqlConnStats) updateStatus(cmd *mysqlCommand, status uint16) string {
+	inTrans := s.status&mysqlServerStatusInTrans != 0
+	s.status = status
+	switch {
+	case !inTrans && status&mysqlServerStatusInTrans != 0:
+		s.transactions++
+		s.transStart = time.Now()
+		if cmd != nil {
+			s.transStart = cmd.start
+		}
+		return " " + color.HiGreenString("(transaction begins)")
+	case inTrans && status&mysqlServerStatusInTrans == 0:
+		elapsed := s.endTransaction()
+		var how string
+		switch mysqlTransactionEnd(cmd) {
+		case "COMMIT":
+			s.commits++
+			how = "committed"
+		case "ROLLBACK":
+			s.rollbacks++
+			how = "rolled back"
+		default:
+			// like the implicit commits of DDL statements, or SET autocommit=1.
+			how = "ended"
+		}
+		return " " + color.HiGreenString("(transaction %s after %s)", how, elapsed)
+	default:
+		return ""
+	}
+}
+
+func (s *mysqlConnStats) endTransaction() time.Duration {
+	elapsed := time.Since(s.transStart)
+	s.transTime += elapsed
+	if elapsed > s.maxTrans {
+		s.maxTrans = elapsed
+	}
+
+	return elapsed
+}
+
+// summary ends the connection, and describes it with the info line and the details.
+func (s *mysqlConnStats) summary(closedBy string) (string, string) {
+	info := fmt.Sprintf("by:%s lifetime:%s commands:%d queries:%d pings:%d resets:%d", closedBy,
+		time.Since(s.start), s.commands, s.queries, s.pings, s.resets)
+	var builder strings.Builder
+	if s.encrypted {
+		builder.WriteString("encrypted by tls, the statistics stop at the handshake\n")
+	}
+	if s.idles > 0 {
+		builder.WriteString(fmt.Sprintf("idle avg:%s max:%s\n", s.idleTime/time.Duration(s.idles), s.maxIdle))
+	}
+	var open string
+	if s.status&mysqlServerStatusInTrans != 0 {
+		// the server rolls back the transaction that is open on close.
+		open = color.HiRedString("transaction left open for %s\n", s.endTransaction())
+	}
+	if s.transactions > 0 {
+		builder.WriteString(fmt.Sprintf("transactions:%d commits:%d rollbacks:%d time:%s max:%s\n",
+			s.transactions, s.commits, s.rollbacks, s.transTime, s.maxTrans))
+	}
+	builder.WriteString(open)
+	if s.status&mysqlServerStatusAutocommit == 0 && s.commands > 0 {
+		builder.WriteString("autocommit:off\n")
+	}
+
+	return info, builder.String()
+}
+
+// record accounts a closed connection.
+func (s *mysqlPoolStats) record(conn *mysqlConnStats, closedBy string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.changed = true
+	s.connections++
+	if closedBy == ClientSide {
+		s.byClient++
+	} else {
+		s.byServer++
+	}
+	if conn.encrypted {
+		s.encrypted++
+	}
+	lifetime := time.Since(conn.start)
+	s.lifetime += lifetime
+	if lifetime > s.maxLifetime {
+		s.maxLifetime = lifetime
+	}
+	s.commands += conn.commands
+	s.queries += conn.queries
+	if conn.queries > s.maxQueries {
+		s.maxQueries = conn.queries
+	}
+	s.pings += conn.pings
+	s.resets += conn.resets
+	s.idles += conn.idles
+	s.idleTime += conn.idleTime
+	if conn.maxIdle > s.maxIdle {
+		s.maxIdle = conn.maxIdle
+	}
+	s.transactions += conn.transactions
+	s.commits += conn.commits
+	s.rollbacks += conn.rollbacks
+	s.transTime += conn.transTime
+	if conn.maxTrans > s.maxTrans {
+		s.maxTrans = conn.maxTrans
+	}
+}
+
+func (s *mysqlPoolStats) report() (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.connections == 0 {
+		return "", false
+	}
+	changed := s.changed
+	s.changed = false
+
+	var builder strings.Builder
+	builder.WriteString(color.HiWhiteString("MySQL connection pool stats:\n"))
+	builder.WriteString(color.HiWhiteString("  Closed connections: %d by client:%d by server:%d\n",
+		s.connections, s.byClient, s.byServer))
+	if s.encrypted > 0 {
+		builder.WriteString(color.HiWhiteString("  Encrypted by tls: %d, their statistics stop at the handshake\n",
+			s.encrypted))
+	}
+	builder.WriteString(color.HiWhiteString("  Connection lifetime: avg:%s max:%s\n",
+		s.lifetime/time.Duration(s.connections), s.maxLifetime))
+	builder.WriteString(color.HiWhiteString("  Queries per connection: avg:%.1f max:%d\n",
+		float64(s.queries)/float64(s.connections), s.maxQueries))
+	builder.WriteString(color.HiWhiteString("  Commands: %d pings:%d resets:%d\n", s.commands, s.pings, s.resets))
+	if s.idles > 0 {
+		builder.WriteString(color.HiWhiteString("  Idle between commands: avg:%s max:%s\n",
+			s.idleTime/time.Duration(s.idles), s.maxIdle))
+	}
+	if s.transactions > 0 {
+		builder.WriteString(color.HiWhiteString("  Transactions: %d commits:%d rollbacks:%d avg:%s max:%s\n",
+			s.transactions, s.commits, s.rollbacks, s.transTime/time.Duration(s.transactions), s.maxTrans))
+	}
+
+	return builder.String(), changed
+}
+
+// mysqlTransactionEnd tells how the command ends a transaction, COMMIT, ROLLBACK or empty if implicitly.
+func mysqlTransactionEnd(cmd *mysqlCommand) string {
+	if cmd == nil {
+		// COM_CHANGE_USER rolls back the transaction.
+		return "ROLLBACK"
+	}
+
+	query := cmd.query
+	switch cmd.code {
+	case mysqlComResetConnection:
+		return "ROLLBACK"
+	case mysqlComStmtExecute:
+		if cmd.stmt != nil {
+			query = cmd.stmt.query
+		}
+	}
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	switch verb := strings.ToUpper(strings.TrimRight(fields[0], ";")); verb {
+	case "COMMIT", "ROLLBACK":
+		return verb
+	default:
+		return ""
+	}
+}
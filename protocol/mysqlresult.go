@@ -0,0 +1,475 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+	"github.com/olekukonko/tablewriter"
+	"github.com/olekukonko/tablewriter/tw"
+)
+
+const (
+	mysqlEOFPacket = 0xfe
+	// an EOF packet is shorter than 9 bytes, the longer ones are rows.
+	mysqlMaxEOFLen                     = 9
+	mysqlClientOptionalResultsMetadata = 1 << 25
+	// the max rows of a result set and the max bytes of a value to show.
+	mysqlMaxShowRows     = 20
+	mysqlMaxShowValueLen = 64
+	mysqlNull            = "NULL"
+
+	mysqlServerStatusCursorExists = 0x0040
+)
+
+const (
+	mysqlResultColumns mysqlResultState = iota
+	mysqlResultColumnsEOF
+	mysqlResultRows
+)
+
+var (
+	mysqlTypeNames = map[byte]string{
+		0x00: "DECIMAL",
+		0x01: "TINY",
+		0x02: "SHORT",
+		0x03: "LONG",
+		0x04: "FLOAT",
+		0x05: "DOUBLE",
+		0x06: "NULL",
+		0x07: "TIMESTAMP",
+		0x08: "LONGLONG",
+		0x09: "INT24",
+		0x0a: "DATE",
+		0x0b: "TIME",
+		0x0c: "DATETIME",
+		0x0d: "YEAR",
+		0x0e: "NEWDATE",
+		0x0f: "VARCHAR",
+		0x10: "BIT",
+		0x11: "TIMESTAMP2",
+		0x12: "DATETIME2",
+		0x13: "TIME2",
+		0xf5: "JSON",
+		0xf6: "NEWDECIMAL",
+		0xf7: "ENUM",
+		0xf8: "SET",
+		0xf9: "TINY_BLOB",
+		0xfa: "MEDIUM_BLOB",
+		0xfb: "LONG_BLOB",
+		0xfc: "BLOB",
+		0xfd: "VAR_STRING",
+		0xfe: "STRING",
+		0xff: "GEOMETRY",
+	}
+
+	mysqlColumnFlagNames = map[uint16]string{
+		0x0001: "NOT_NULL",
+		0x0002: "PRI_KEY",
+		0x0004: "UNIQUE_KEY",
+		0x0008: "MULTIPLE_KEY",
+		0x0010: "BLOB",
+		0x0020: "UNSIGNED",
+		0x0040: "ZEROFILL",
+		0x0080: "BINARY",
+		0x0100: "ENUM",
+		0x0200: "AUTO_INCREMENT",
+		0x0400: "TIMESTAMP",
+		0x0800: "SET",
+		0x1000: "NO_DEFAULT_VALUE",
+		0x2000: "ON_UPDATE_NOW",
+		0x8000: "NUM",
+	}
+)
+
+type (
+	mysqlResultState int
+
+	mysqlColumn struct {
+		name  string
+		table string
+		typ   byte
+		flags uint16
+	}
+
+	// mysqlResult is a result set being read, the rows after mysqlMaxShowRows are counted only.
+	mysqlResult struct {
+		state mysqlResultState
+		// -1 means the columns end with EOF, like the response of COM_FIELD_LIST.
+		columnCount int
+		columns     []mysqlColumn
+		rows        [][]string
+		rowCount    int
+		size        int
+		// the rows are in the binary protocol, the results of prepared statements.
+		binary bool
+	}
+)
+
+// dumpResponse dumps the response of the command, which is an OK, an ERR or a result set.
+func (mysql *mysqlInterop) dumpResponse(id int, quiet bool, packet *mysqlPacket) {
+	mysql.lock.Lock()
+	defer mysql.lock.Unlock()
+
+	if mysql.result != nil {
+		mysql.readResult(id, quiet, packet)
+		return
+	}
+	if mysql.preparing != nil {
+		mysql.readPrepare(id, quiet, packet)
+		return
+	}
+
+	payload := packet.payload
+	cmd := mysql.command
+	switch {
+	case cmd == nil:
+		// not a response, like the ERR sent before the server closes an idle connection.
+		if quiet {
+			return
+		}
+		if payload[0] == mysqlErrPacket {
+			display.PrintfWithTime("[%s-%d] %s\n", ServerSide, id, color.HiRedString(explainMysqlError(payload)))
+		} else {
+			display.PrintfWithTime("[%s-%d] unexpected packet len:%d\n%s", ServerSide, id, packet.size,
+				hexDump(payload))
+		}
+	case cmd.code == mysqlComStmtPrepare && payload[0] == mysqlOKPacket:
+		mysql.startPrepare(id, quiet, packet)
+	case payload[0] == mysqlOKPacket:
+		ok, err := parseMysqlOK(payload)
+		if err != nil {
+			mysql.complete(id, quiet, color.HiRedString("invalid OK packet: %v", err), "", 0)
+			return
+		}
+		cmd.affected += ok.affectedRows
+		mysql.complete(id, quiet, "OK "+ok.String()+mysql.conn.updateStatus(cmd, ok.status), "", ok.status)
+	case payload[0] == mysqlErrPacket:
+		cmd.failed = true
+		mysql.complete(id, quiet, color.HiRedString(explainMysqlError(payload)), "", 0)
+	case cmd.code == mysqlComStatistics:
+		mysql.complete(id, quiet, string(payload), "", 0)
+	case cmd.code == mysqlComQuery && payload[0] == mysqlLocalInfileRequest:
+		// the client sends the file, then the server replies OK or ERR.
+		mysql.infile = true
+		if !quiet {
+			display.PrintfWithTime("[%s-%d] %s %s\n", ServerSide, id, color.HiYellowString("local_infile"),
+				payload[1:])
+		}
+	case cmd.code == mysqlComFieldList:
+		mysql.result = &mysqlResult{columnCount: -1}
+		mysql.readResult(id, quiet, packet)
+	case cmd.code == mysqlComStmtFetch && cmd.stmt != nil:
+		// the rows of the cursor opened by execute.
+		mysql.result = &mysqlResult{
+			state:   mysqlResultRows,
+			columns: cmd.stmt.columns,
+			binary:  true,
+		}
+		mysql.readResult(id, quiet, packet)
+	default:
+		mysql.startResult(id, quiet, packet)
+	}
+}
+
+// startResult starts a result set with the column count.
+func (mysql *mysqlInterop) startResult(id int, quiet bool, packet *mysqlPacket) {
+	buf := &mysqlBuffer{b: packet.payload}
+	count, _ := buf.lenencInt()
+	metadata := true
+	if mysql.capabilities&mysqlClientOptionalResultsMetadata != 0 {
+		metadata = buf.uint8() != 0
+	}
+	if buf.err != nil || count == 0 {
+		mysql.complete(id, quiet, color.HiRedString("invalid result set, len:%d", packet.size), "", 0)
+		return
+	}
+
+	cmd := mysql.command
+	mysql.result = &mysqlResult{
+		columnCount: int(count),
+		size:        packet.size,
+		binary:      cmd.code == mysqlComStmtExecute,
+	}
+	if !metadata {
+		// the columns are omitted, as the client asked with resultset_metadata=NONE.
+		mysql.result.state = mysqlResultRows
+		if cmd.stmt != nil && len(cmd.stmt.columns) == int(count) {
+			mysql.result.columns = cmd.stmt.columns
+			return
+		}
+		for i := 0; i < int(count); i++ {
+			mysql.result.columns = append(mysql.result.columns, mysqlColumn{name: fmt.Sprintf("#%d", i+1)})
+		}
+	}
+}
+
+func (mysql *mysqlInterop) readResult(id int, quiet bool, packet *mysqlPacket) {
+	result := mysql.result
+	payload := packet.payload
+	result.size += packet.size
+	if payload[0] == mysqlErrPacket {
+		if mysql.command != nil {
+			mysql.command.failed = true
+		}
+		mysql.complete(id, quiet, color.HiRedString(explainMysqlError(payload)), result.String(), 0)
+		return
+	}
+
+	switch result.state {
+	case mysqlResultColumns:
+		if result.columnCount < 0 && isMysqlEOF(packet) {
+			status := parseMysqlEOF(payload)
+			mysql.complete(id, quiet, "columns:"+result.explainColumns()+mysql.conn.updateStatus(mysql.command, status),
+				"", status)
+			return
+		}
+
+		column, err := parseMysqlColumn(payload)
+		if err != nil {
+			mysql.complete(id, quiet, color.HiRedString("invalid column definition: %v", err), "", 0)
+			return
+		}
+		result.columns = append(result.columns, column)
+		if len(result.columns) == result.columnCount {
+			if mysql.capabilities&mysqlClientDeprecateEOF != 0 {
+				result.state = mysqlResultRows
+			} else {
+				result.state = mysqlResultColumnsEOF
+			}
+		}
+	case mysqlResultColumnsEOF:
+		result.state = mysqlResultRows
+		if !isMysqlEOF(packet) {
+			mysql.complete(id, quiet, color.HiRedString("missing EOF after the columns"), "", 0)
+			return
+		}
+		// the rows of a cursor are fetched later by COM_STMT_FETCH.
+		if status := parseMysqlEOF(payload); status&mysqlServerStatusCursorExists != 0 {
+			mysql.complete(id, quiet, fmt.Sprintf("cursor columns:%d status:%s%s", len(result.columns),
+				explainMysqlStatus(status), mysql.conn.updateStatus(mysql.command, status)), result.String(), status)
+		}
+	default:
+		deprecateEOF := mysql.capabilities&mysqlClientDeprecateEOF != 0
+		if payload[0] == mysqlEOFPacket && (isMysqlEOF(packet) || deprecateEOF && packet.size < mysqlMaxPayloadLen) {
+			var status uint16
+			if deprecateEOF {
+				ok, _ := parseMysqlOK(payload)
+				status = ok.status
+			} else {
+				status = parseMysqlEOF(payload)
+			}
+			mysql.complete(id, quiet, fmt.Sprintf("rows:%d columns:%d status:%s%s", result.rowCount,
+				len(result.columns), explainMysqlStatus(status), mysql.conn.updateStatus(mysql.command, status)),
+				result.String(), status)
+			return
+		}
+
+		var row []string
+		var err error
+		if result.binary {
+			row, err = parseMysqlBinaryRow(payload, result.columns)
+		} else {
+			row, err = parseMysqlTextRow(payload, len(result.columns))
+		}
+		if err != nil {
+			mysql.complete(id, quiet, color.HiRedString("invalid row: %v", err), result.String(), 0)
+			return
+		}
+		result.addRow(row)
+	}
+}
+
+// complete ends a response, or a result set of it, the command waits for more results if the status says so.
+// The status is only used to tell that, info should contain it if needed.
+func (mysql *mysqlInterop) complete(id int, quiet bool, info, details string, status uint16) {
+	cmd := mysql.command
+	size := 0
+	if mysql.result != nil {
+		size = mysql.result.size
+		if cmd != nil {
+			cmd.rows += mysql.result.rowCount
+		}
+	}
+	mysql.result = nil
+	if cmd == nil {
+		return
+	}
+
+	latency := time.Since(cmd.start)
+	slow := mysqlSlowQuery > 0 && latency >= mysqlSlowQuery && len(mysqlCommandQuery(cmd)) > 0
+	done := status&mysqlServerMoreResults == 0
+	if done {
+		mysql.command = nil
+		mysql.conn.lastActive = time.Now()
+		mysqlDigestStatistics.record(cmd, latency, slow)
+	}
+
+	if quiet {
+		if slow && done {
+			// only the slow queries are shown in quiet mode, the query is not shown before.
+			query := mysqlCommandQuery(cmd)
+			display.PrintfWithTime("[%s-%d] %s %s %s\n", ServerSide, id, color.HiRedString("slow_query"),
+				color.HiRedString("latency:%s", latency), truncateMysqlQuery(query, len(query)))
+		}
+		return
+	}
+
+	var extra string
+	if size > 0 {
+		extra = fmt.Sprintf(" len:%d", size)
+	}
+	if slow {
+		extra += " " + color.HiRedString("latency:%s (slow)", latency)
+	} else {
+		extra += fmt.Sprintf(" latency:%s", latency)
+	}
+	if len(details) > 0 {
+		details = indent(details)
+	}
+	display.PrintfWithTime("[%s-%d] %s %s%s\n%s", ServerSide, id, color.HiYellowString(mysqlCommandName(cmd.code)),
+		info, extra, details)
+}
+
+func (r *mysqlResult) addRow(row []string) {
+	r.rowCount++
+	if len(r.rows) < mysqlMaxShowRows {
+		r.rows = append(r.rows, row)
+	}
+}
+
+func (r *mysqlResult) explainColumns() string {
+	var builder strings.Builder
+	for _, column := range r.columns {
+		builder.WriteString(" " + column.String())
+	}
+
+	return builder.String()
+}
+
+// String renders the columns and the rows as a table.
+func (r *mysqlResult) String() string {
+	if len(r.columns) == 0 {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("columns:" + r.explainColumns() + "\n")
+	header := make([]string, 0, len(r.columns))
+	for _, column := range r.columns {
+		header = append(header, column.name)
+	}
+	table := tablewriter.NewTable(&builder,
+		tablewriter.WithHeaderAutoFormat(tw.Off),
+		tablewriter.WithRowAutoWrap(tw.WrapNone),
+	)
+	table.Header(header)
+	_ = table.Bulk(r.rows)
+	_ = table.Render()
+	if r.rowCount > len(r.rows) {
+		builder.WriteString(fmt.Sprintf("... %d more rows\n", r.rowCount-len(r.rows)))
+	}
+
+	return builder.String()
+}
+
+func (c mysqlColumn) String() string {
+	info := c.name + ":" + mysqlTypeName(c.typ)
+	var flags []string
+	for bit := uint16(1); bit != 0; bit <<= 1 {
+		if c.flags&bit != 0 {
+			if name, ok := mysqlColumnFlagNames[bit]; ok {
+				flags = append(flags, name)
+			}
+		}
+	}
+	if len(flags) > 0 {
+		info += "(" + strings.Join(flags, "|") + ")"
+	}
+
+	return info
+}
+
+// parseMysqlColumn parses a Protocol::ColumnDefinition41.
+func parseMysqlColumn(payload []byte) (mysqlColumn, error) {
+	var column mysqlColumn
+	buf := &mysqlBuffer{b: payload}
+	buf.lenencString() // catalog
+	buf.lenencString() // schema
+	column.table = buf.lenencString()
+	buf.lenencString() // org_table
+	column.name = buf.lenencString()
+	buf.lenencString() // org_name
+	buf.lenencInt()    // length of the fixed fields
+	buf.uint16()       // charset
+	buf.uint32()       // column length
+	column.typ = buf.uint8()
+	column.flags = buf.uint16()
+
+	return column, buf.err
+}
+
+// parseMysqlTextRow parses a row of the text protocol, each value is a length-encoded string or NULL.
+func parseMysqlTextRow(payload []byte, columns int) ([]string, error) {
+	buf := &mysqlBuffer{b: payload}
+	row := make([]string, 0, columns)
+	for i := 0; i < columns; i++ {
+		value, null := buf.lenencBytes()
+		if null {
+			row = append(row, mysqlNull)
+		} else {
+			row = append(row, explainMysqlValue(value))
+		}
+	}
+
+	return row, buf.err
+}
+
+// parseMysqlEOF returns the status of an EOF packet.
+func parseMysqlEOF(payload []byte) uint16 {
+	buf := &mysqlBuffer{b: payload[1:]}
+	buf.uint16() // warnings
+	return buf.uint16()
+}
+
+func isMysqlEOF(packet *mysqlPacket) bool {
+	return packet.payload[0] == mysqlEOFPacket && packet.size < mysqlMaxEOFLen
+}
+
+// explainMysqlValue shows the printable values as is, and the binary ones in hex, truncated if too long.
+func explainMysqlValue(value []byte) string {
+	printable := isPrintable(value)
+	limit := mysqlMaxShowValueLen
+	if !printable {
+		// two hex digits for each byte.
+		limit /= 2
+	}
+	var suffix string
+	if len(value) > limit {
+		suffix = fmt.Sprintf("...(%d bytes)", len(value))
+		end := limit
+		// not to cut a multi-byte character.
+		for printable && end > 0 && !utf8.RuneStart(value[end]) {
+			end--
+		}
+		value = value[:end]
+	}
+
+	if !printable {
+		return "0x" + hex.EncodeToString(value) + suffix
+	}
+
+	return strings.NewReplacer("\r", `\r`, "\n", `\n`, "\t", `\t`).Replace(string(value)) + suffix
+}
+
+func mysqlTypeName(typ byte) string {
+	if name, ok := mysqlTypeNames[typ]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%02x", typ)
+}
@@ -0,0 +1,428 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+const (
+	mysqlComStmtPrepare      = 0x16
+	mysqlComStmtExecute      = 0x17
+	mysqlComStmtSendLongData = 0x18
+	mysqlComStmtClose        = 0x19
+	mysqlComStmtReset        = 0x1a
+	mysqlComStmtFetch        = 0x1c
+
+	mysqlTypeTiny      = 0x01
+	mysqlTypeShort     = 0x02
+	mysqlTypeLong      = 0x03
+	mysqlTypeFloat     = 0x04
+	mysqlTypeDouble    = 0x05
+	mysqlTypeNull      = 0x06
+	mysqlTypeTimestamp = 0x07
+	mysqlTypeLongLong  = 0x08
+	mysqlTypeInt24     = 0x09
+	mysqlTypeDate      = 0x0a
+	mysqlTypeTime      = 0x0b
+	mysqlTypeDatetime  = 0x0c
+	mysqlTypeYear      = 0x0d
+
+	mysqlUnsignedFlag      = 0x0020
+	mysqlParamUnsignedFlag = 0x8000
+	// the execute flag that the parameter count is sent, with CLIENT_QUERY_ATTRIBUTES.
+	mysqlParameterCountAvailable = 0x08
+	// the null bitmap of a binary row starts from the 3rd bit.
+	mysqlBinaryRowNullOffset = 2
+)
+
+// mysqlStmt is a prepared statement, from COM_STMT_PREPARE till COM_STMT_CLOSE.
+type mysqlStmt struct {
+	id         uint32
+	query      string
+	paramCount int
+	params     []mysqlColumn
+	columns    []mysqlColumn
+	// the parameter types of the last execute, which are sent only when they change.
+	paramTypes []uint16
+	// the parameters sent by COM_STMT_SEND_LONG_DATA, with their length.
+	longData map[uint16]int
+	// the definitions of the parameters and the columns to read after PREPARE_OK.
+	pending  int
+	warnings uint16
+}
+
+// startPrepare starts reading the response of COM_STMT_PREPARE after PREPARE_OK.
+func (mysql *mysqlInterop) startPrepare(id int, quiet bool, packet *mysqlPacket) {
+	buf := &mysqlBuffer{b: packet.payload[1:]}
+	stmt := &mysqlStmt{
+		id:       buf.uint32(),
+		query:    mysql.command.query,
+		longData: make(map[uint16]int),
+	}
+	columnCount := int(buf.uint16())
+	stmt.paramCount = int(buf.uint16())
+	if len(buf.b) > 0 {
+		buf.uint8()
+		stmt.warnings = buf.uint16()
+	}
+	metadata := true
+	if mysql.capabilities&mysqlClientOptionalResultsMetadata != 0 && len(buf.b) > 0 {
+		metadata = buf.uint8() != 0
+	}
+	if buf.err != nil {
+		mysql.complete(id, quiet, color.HiRedString("invalid PREPARE_OK: %v", buf.err), "", 0)
+		return
+	}
+
+	if mysql.stmts == nil {
+		mysql.stmts = make(map[uint32]*mysqlStmt)
+	}
+	mysql.stmts[stmt.id] = stmt
+	if metadata {
+		stmt.pending = stmt.paramCount + columnCount
+		if mysql.capabilities&mysqlClientDeprecateEOF == 0 {
+			// each group of definitions ends with EOF.
+			if stmt.paramCount > 0 {
+				stmt.pending++
+			}
+			if columnCount > 0 {
+				stmt.pending++
+			}
+		}
+	}
+	for i := 0; i < columnCount && !metadata; i++ {
+		stmt.columns = append(stmt.columns, mysqlColumn{name: fmt.Sprintf("#%d", i+1)})
+	}
+
+	mysql.preparing = stmt
+	if stmt.pending == 0 {
+		mysql.completePrepare(id, quiet)
+	}
+}
+
+// readPrepare reads the definitions of the parameters and the columns of the statement being prepared.
+func (mysql *mysqlInterop) readPrepare(id int, quiet bool, packet *mysqlPacket) {
+	stmt := mysql.preparing
+	stmt.pending--
+	if packet.payload[0] == mysqlErrPacket {
+		mysql.preparing = nil
+		mysql.complete(id, quiet, color.HiRedString(explainMysqlError(packet.payload)), "", 0)
+		return
+	}
+
+	if !isMysqlEOF(packet) {
+		column, err := parseMysqlColumn(packet.payload)
+		if err != nil {
+			mysql.preparing = nil
+			mysql.complete(id, quiet, color.HiRedString("invalid column definition: %v", err), "", 0)
+			return
+		}
+		if len(stmt.params) < stmt.paramCount {
+			stmt.params = append(stmt.params, column)
+		} else {
+			stmt.columns = append(stmt.columns, column)
+		}
+	}
+
+	if stmt.pending <= 0 {
+		mysql.completePrepare(id, quiet)
+	}
+}
+
+func (mysql *mysqlInterop) completePrepare(id int, quiet bool) {
+	stmt := mysql.preparing
+	mysql.preparing = nil
+
+	var details string
+	if len(stmt.params) > 0 {
+		details += "params:" + (&mysqlResult{columns: stmt.params}).explainColumns() + "\n"
+	}
+	if len(stmt.columns) > 0 {
+		details += "columns:" + (&mysqlResult{columns: stmt.columns}).explainColumns() + "\n"
+	}
+	mysql.complete(id, quiet, fmt.Sprintf("stmt:%d params:%d columns:%d warnings:%d open_stmts:%d",
+		stmt.id, stmt.paramCount, len(stmt.columns), stmt.warnings, len(mysql.stmts)), details, 0)
+}
+
+// explainStmtCommand explains the commands on prepared statements, and keeps the statement in cmd.
+func (mysql *mysqlInterop) explainStmtCommand(cmd *mysqlCommand, buf *mysqlBuffer) string {
+	if cmd.code == mysqlComStmtPrepare {
+		cmd.query = string(buf.rest())
+		return " " + truncateMysqlQuery(cmd.query, len(cmd.query))
+	}
+
+	mysql.lock.Lock()
+	defer mysql.lock.Unlock()
+
+	stmtID := buf.uint32()
+	stmt, ok := mysql.stmts[stmtID]
+	if !ok {
+		return fmt.Sprintf(" stmt:%d (unknown)", stmtID)
+	}
+	cmd.stmt = stmt
+	cmd.query = stmt.query
+
+	switch cmd.code {
+	case mysqlComStmtExecute:
+		return fmt.Sprintf(" stmt:%d %s", stmtID, mysql.explainExecute(stmt, buf))
+	case mysqlComStmtSendLongData:
+		param := buf.uint16()
+		size := len(buf.rest())
+		stmt.longData[param] += size
+		return fmt.Sprintf(" stmt:%d param:%d len:%d", stmtID, param, size)
+	case mysqlComStmtClose:
+		delete(mysql.stmts, stmtID)
+		return fmt.Sprintf(" stmt:%d open_stmts:%d", stmtID, len(mysql.stmts))
+	case mysqlComStmtReset:
+		stmt.longData = make(map[uint16]int)
+		return fmt.Sprintf(" stmt:%d", stmtID)
+	case mysqlComStmtFetch:
+		return fmt.Sprintf(" stmt:%d rows:%d", stmtID, buf.uint32())
+	default:
+		return ""
+	}
+}
+
+// explainExecute decodes the parameters of COM_STMT_EXECUTE, and returns the query with them interpolated.
+func (mysql *mysqlInterop) explainExecute(stmt *mysqlStmt, buf *mysqlBuffer) string {
+	flags := buf.uint8()
+	buf.uint32() // iteration count, always 1
+	queryAttrs := mysql.capabilities&mysqlClientQueryAttrs != 0
+	count := stmt.paramCount
+	if queryAttrs && (count > 0 || flags&mysqlParameterCountAvailable != 0) {
+		n, _ := buf.lenencInt()
+		count = int(n)
+	}
+	if count == 0 {
+		return stmt.query
+	}
+
+	nulls := buf.next((count + 7) / 8)
+	if buf.uint8() == 1 {
+		stmt.paramTypes = stmt.paramTypes[:0]
+		for i := 0; i < count; i++ {
+			stmt.paramTypes = append(stmt.paramTypes, buf.uint16())
+			if queryAttrs {
+				buf.lenencString() // the name of the parameter
+			}
+		}
+	}
+	if buf.err != nil || len(stmt.paramTypes) < count {
+		return fmt.Sprintf("%s (invalid parameters)", stmt.query)
+	}
+
+	values := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		switch {
+		case nulls[i/8]&(1<<(i%8)) != 0:
+			values = append(values, mysqlNull)
+		case stmt.longData[uint16(i)] > 0:
+			values = append(values, fmt.Sprintf("<long data %d bytes>", stmt.longData[uint16(i)]))
+		default:
+			typ := stmt.paramTypes[i]
+			text, raw := readMysqlBinaryValue(buf, byte(typ), typ&mysqlParamUnsignedFlag != 0)
+			values = append(values, mysqlLiteral(byte(typ), text, raw))
+		}
+	}
+	// the long data is reset after execute.
+	stmt.longData = make(map[uint16]int)
+	if buf.err != nil {
+		return fmt.Sprintf("%s (invalid parameters: %v)", stmt.query, buf.err)
+	}
+
+	if count > stmt.paramCount {
+		// the rest are the query attributes.
+		return fmt.Sprintf("%s attributes:%s", interpolateMysqlQuery(stmt.query, values[:stmt.paramCount]),
+			strings.Join(values[stmt.paramCount:], ","))
+	}
+
+	return interpolateMysqlQuery(stmt.query, values)
+}
+
+// parseMysqlBinaryRow parses a row of the binary protocol, with a null bitmap and the values by column types.
+func parseMysqlBinaryRow(payload []byte, columns []mysqlColumn) ([]string, error) {
+	buf := &mysqlBuffer{b: payload[1:]}
+	nulls := buf.next((len(columns) + 7 + mysqlBinaryRowNullOffset) / 8)
+	row := make([]string, 0, len(columns))
+	for i, column := range columns {
+		bit := i + mysqlBinaryRowNullOffset
+		if buf.err == nil && nulls[bit/8]&(1<<(bit%8)) != 0 {
+			row = append(row, mysqlNull)
+			continue
+		}
+
+		text, raw := readMysqlBinaryValue(buf, column.typ, column.flags&mysqlUnsignedFlag != 0)
+		if raw != nil {
+			text = explainMysqlValue(raw)
+		}
+		row = append(row, text)
+	}
+
+	return row, buf.err
+}
+
+// readMysqlBinaryValue reads a value of the binary protocol,
+// raw is the content of the strings and the bytes, text is the formatted others.
+func readMysqlBinaryValue(buf *mysqlBuffer, typ byte, unsigned bool) (text string, raw []byte) {
+	switch typ {
+	case mysqlTypeNull:
+		return mysqlNull, nil
+	case mysqlTypeTiny:
+		v := buf.uint8()
+		if unsigned {
+			return strconv.FormatUint(uint64(v), 10), nil
+		}
+		return strconv.FormatInt(int64(int8(v)), 10), nil
+	case mysqlTypeShort, mysqlTypeYear:
+		v := buf.uint16()
+		if unsigned {
+			return strconv.FormatUint(uint64(v), 10), nil
+		}
+		return strconv.FormatInt(int64(int16(v)), 10), nil
+	case mysqlTypeLong, mysqlTypeInt24:
+		v := buf.uint32()
+		if unsigned {
+			return strconv.FormatUint(uint64(v), 10), nil
+		}
+		return strconv.FormatInt(int64(int32(v)), 10), nil
+	case mysqlTypeLongLong:
+		v := buf.uint64()
+		if unsigned {
+			return strconv.FormatUint(v, 10), nil
+		}
+		return strconv.FormatInt(int64(v), 10), nil
+	case mysqlTypeFloat:
+		return strconv.FormatFloat(float64(math.Float32frombits(buf.uint32())), 'g', -1, 32), nil
+	case mysqlTypeDouble:
+		return strconv.FormatFloat(math.Float64frombits(buf.uint64()), 'g', -1, 64), nil
+	case mysqlTypeDate, mysqlTypeDatetime, mysqlTypeTimestamp:
+		return readMysqlDatetime(buf, typ), nil
+	case mysqlTypeTime:
+		return readMysqlTime(buf), nil
+	default:
+		// decimals, strings, blobs, json, bits, enums, sets and geometries are length-encoded.
+		v, _ := buf.lenencBytes()
+		if v == nil {
+			v = []byte{}
+		}
+		return "", v
+	}
+}
+
+// readMysqlDatetime reads a date or datetime, which has 0, 4, 7 or 11 bytes.
+func readMysqlDatetime(buf *mysqlBuffer, typ byte) string {
+	b := buf.next(int(buf.uint8()))
+	var year, month, day, hour, minute, second, micro int
+	if len(b) >= 4 {
+		year, month, day = int(binary.LittleEndian.Uint16(b)), int(b[2]), int(b[3])
+	}
+	if len(b) >= 7 {
+		hour, minute, second = int(b[4]), int(b[5]), int(b[6])
+	}
+	if len(b) >= 11 {
+		micro = int(binary.LittleEndian.Uint32(b[7:]))
+	}
+
+	date := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if typ == mysqlTypeDate {
+		return date
+	}
+	if micro > 0 {
+		return fmt.Sprintf("%s %02d:%02d:%02d.%06d", date, hour, minute, second, micro)
+	}
+
+	return fmt.Sprintf("%s %02d:%02d:%02d", date, hour, minute, second)
+}
+
+// readMysqlTime reads a time, which has 0, 8 or 12 bytes.
+func readMysqlTime(buf *mysqlBuffer) string {
+	b := buf.next(int(buf.uint8()))
+	var sign string
+	var hours, minute, second, micro int
+	if len(b) >= 8 {
+		if b[0] == 1 {
+			sign = "-"
+		}
+		hours = int(binary.LittleEndian.Uint32(b[1:]))*24 + int(b[5])
+		minute, second = int(b[6]), int(b[7])
+	}
+	if len(b) >= 12 {
+		micro = int(binary.LittleEndian.Uint32(b[8:]))
+	}
+
+	if micro > 0 {
+		return fmt.Sprintf("%s%02d:%02d:%02d.%06d", sign, hours, minute, second, micro)
+	}
+
+	return fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, minute, second)
+}
+
+// mysqlLiteral returns the value as a SQL literal, the strings and the temporal values are quoted.
+func mysqlLiteral(typ byte, text string, raw []byte) string {
+	if raw == nil {
+		switch typ {
+		case mysqlTypeDate, mysqlTypeDatetime, mysqlTypeTimestamp, mysqlTypeTime:
+			return "'" + text + "'"
+		default:
+			return text
+		}
+	}
+
+	value := explainMysqlValue(raw)
+	if !isPrintable(raw) {
+		return value
+	}
+
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// interpolateMysqlQuery replaces the ? placeholders with the values,
+// the ones in quotes and comments are not placeholders.
+func interpolateMysqlQuery(query string, values []string) string {
+	var builder strings.Builder
+	var next int
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				end = len(query) - 1
+			}
+			builder.WriteString(query[i : end+1])
+			i = end
+		case c == '-' && strings.HasPrefix(query[i:], "-- "), c == '#':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			builder.WriteString(query[i : i+end+1])
+			i += end
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 4
+			}
+			builder.WriteString(query[i : i+end+4])
+			i += end + 3
+		case c == '?' && next < len(values):
+			builder.WriteString(values[next])
+			next++
+		default:
+			builder.WriteByte(c)
+		}
+	}
+
+	return builder.String()
+}
@@ -2,34 +2,536 @@ package protocol
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/fatih/color"
 	"github.com/kevwan/tproxy/display"
 )
 
-type redisInterop struct {
+const (
+	// the max length of a bulk string, the same as redis, and the max nesting of aggregates.
+	redisMaxBulkLen = 512 << 20
+	redisMaxDepth   = 32
+	// the max bytes of a string and the max elements of an aggregate to show.
+	redisMaxShowLen   = 64
+	redisMaxShowElems = 16
+)
+
+var errRedisProtocol = errors.New("invalid redis protocol")
+
+type (
+	// redisValue is a RESP2 or RESP3 value, the type is the leading byte.
+	redisValue struct {
+		kind byte
+		str  string
+		num  int64
+		null bool
+		// the elements of arrays, sets and pushes, or the key value pairs of maps and attributes.
+		elems []*redisValue
+		attrs *redisValue
+		// the bytes of the value on the wire.
+		size int
+	}
+
+	redisCommand struct {
+		name  string
+		args  []string
+		keys  []string
+		size  int
+		start time.Time
+		// the confirmations still expected by a subscribe command, 0 for unsubscribing from all.
+		confirms int
+	}
+
+	// redisInterop is shared by both directions of a connection,
+	// so that the replies can be paired with the pipelined commands in order.
+	redisInterop struct {
+		pending []*redisCommand
+		state   redisConnState
+		lock    sync.Mutex
+	}
+
+	redisReader struct {
+		*bufio.Reader
+		size int
+	}
+)
+
+func newRedisInterop() *redisInterop {
+	redisStatsOnce.Do(func() {
+		register(redisStatistics)
+	})
+
+	return &redisInterop{
+		state: newRedisConnState(),
+	}
 }
 
 func (red *redisInterop) Dump(r io.Reader, source string, id int, quiet bool) {
-	// only parse client send command
-	buf := bufio.NewReader(r)
+	reader := &redisReader{Reader: bufio.NewReader(r)}
 	for {
-		// read raw data
-		line, _, _ := buf.ReadLine()
-		lineStr := string(line)
-		if source != "SERVER" && strings.HasPrefix(lineStr, "*") {
-			cmdCount, _ := strconv.Atoi(strings.TrimLeft(lineStr, "*"))
-			var sb strings.Builder
-			for j := 0; j < cmdCount*2; j++ {
-				c, _, _ := buf.ReadLine()
-				if j&1 == 0 { // skip param length
-					continue
-				}
-				sb.WriteString(" " + string(c))
+		reader.size = 0
+		var value *redisValue
+		var err error
+		if source == ClientSide {
+			value, err = reader.readCommand()
+		} else {
+			value, err = reader.readValue(0)
+		}
+		if err != nil {
+			if err != io.EOF {
+				display.PrintfWithTime(color.HiRedString("[%s-%d] unable to read redis data: %v\n", source, id, err))
+			}
+			drain(reader)
+			return
+		}
+		value.size = reader.size
+
+		if source == ClientSide {
+			red.dumpCommand(value, source, id, quiet)
+		} else {
+			red.dumpReply(value, source, id, quiet)
+		}
+	}
+}
+
+func (red *redisInterop) dumpCommand(value *redisValue, source string, id int, quiet bool) {
+	args := value.strings()
+	if len(args) == 0 {
+		return
+	}
+
+	name := strings.ToUpper(args[0])
+	cmd := &redisCommand{
+		name:  name,
+		args:  args[1:],
+		keys:  redisKeys(name, args[1:]),
+		size:  value.size,
+		start: time.Now(),
+	}
+	red.lock.Lock()
+	if redisSubscribeCommands[name] {
+		// confirmed by pushes, but kept pending, an error reply still pairs with it.
+		red.state.subscribing = true
+		cmd.confirms = len(cmd.args)
+	}
+	red.pending = append(red.pending, cmd)
+	red.lock.Unlock()
+
+	if quiet {
+		return
+	}
+
+	display.PrintfWithTime("[%s-%d] %s%s%s\n", source, id, color.HiYellowString(cmd.name),
+		explainRedisArgs(cmd.args), explainRedisSlots(cmd.keys))
+}
+
+func (red *redisInterop) dumpReply(value *redisValue, source string, id int, quiet bool) {
+	// push messages are out of band, not replies of any command.
+	if red.isPush(value) {
+		red.dumpPush(value, source, id, quiet)
+		return
+	}
+
+	var cmd *redisCommand
+	red.lock.Lock()
+	if len(red.pending) > 0 {
+		cmd = red.pending[0]
+		red.pending = red.pending[1:]
+		if redisSubscribeCommands[cmd.name] && (value.kind == '-' || value.kind == '!') {
+			red.stopSubscribing()
+		}
+	}
+	red.lock.Unlock()
+
+	var latency time.Duration
+	var state string
+	if cmd != nil {
+		latency = time.Since(cmd.start)
+		redisStatistics.record(cmd, value, latency)
+		state = red.updateState(cmd, value)
+	}
+
+	if quiet {
+		return
+	}
+
+	name, timing := "reply", state
+	if cmd != nil {
+		name = cmd.name
+		timing = fmt.Sprintf(" latency:%s%s", latency, state)
+	}
+
+	reply, ok := explainRedisCluster(cmd, value)
+	if !ok {
+		reply = explainRedisValue(value, 0)
+	}
+	if strings.Contains(reply, "\n") {
+		display.PrintfWithTime("[%s-%d] %s len:%d%s\n%s", source, id, color.HiYellowString(name),
+			value.size, timing, indent(reply))
+	} else {
+		display.PrintfWithTime("[%s-%d] %s %s len:%d%s\n", source, id, color.HiYellowString(name),
+			reply, value.size, timing)
+	}
+}
+
+// readCommand reads a command of the client, an array of bulk strings or an inline command.
+func (r *redisReader) readCommand() (*redisValue, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == '*' {
+		return r.readValue(0)
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	value := &redisValue{kind: '*'}
+	for _, arg := range strings.Fields(line) {
+		value.elems = append(value.elems, &redisValue{kind: '$', str: arg})
+	}
+
+	return value, nil
+}
+
+func (r *redisReader) readValue(depth int) (*redisValue, error) {
+	if depth > redisMaxDepth {
+		return nil, errRedisProtocol
+	}
+
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	r.size++
+
+	line, err := r.readLine()
+	if err != nil {
+		return nil, noEOF(err)
+	}
+
+	value := &redisValue{kind: kind}
+	switch kind {
+	case '+', '-', ',', '(':
+		value.str = line
+	case ':':
+		if value.num, err = strconv.ParseInt(line, 10, 64); err != nil {
+			return nil, errRedisProtocol
+		}
+	case '_':
+		value.null = true
+	case '#':
+		value.str = strconv.FormatBool(line == "t")
+	case '$', '!', '=':
+		if line == "?" {
+			// a streamed string, with chunks till the zero length one.
+			return value, r.readChunks(value)
+		}
+		length, err := redisLength(line)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			value.null = true
+			break
+		}
+		if value.str, err = r.readBulk(length); err != nil {
+			return nil, err
+		}
+	case '*', '~', '>', '%', '|':
+		if err := r.readElems(value, line, depth); err != nil {
+			return nil, err
+		}
+		if kind == '|' {
+			// the attributes are followed by the value they describe.
+			attrs := value
+			if value, err = r.readValue(depth); err != nil {
+				return nil, noEOF(err)
 			}
-			display.PrintlnWithTime(strings.TrimSpace(sb.String()))
+			value.attrs = attrs
 		}
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", errRedisProtocol, kind)
 	}
+
+	return value, nil
+}
+
+func (r *redisReader) readElems(value *redisValue, line string, depth int) error {
+	streamed := line == "?"
+	count := -1
+	if !streamed {
+		length, err := redisLength(line)
+		if err != nil {
+			return err
+		}
+		if length < 0 {
+			value.null = true
+			return nil
+		}
+		count = length
+		// maps and attributes are sent as key value pairs.
+		if value.kind == '%' || value.kind == '|' {
+			count *= 2
+		}
+	}
+
+	for i := 0; streamed || i < count; i++ {
+		if streamed {
+			// a streamed aggregate ends with a dot.
+			b, err := r.Peek(1)
+			if err != nil {
+				return noEOF(err)
+			}
+			if b[0] == '.' {
+				_, err := r.readLine()
+				return noEOF(err)
+			}
+		}
+
+		elem, err := r.readValue(depth + 1)
+		if err != nil {
+			return noEOF(err)
+		}
+		value.elems = append(value.elems, elem)
+	}
+
+	return nil
+}
+
+func (r *redisReader) readChunks(value *redisValue) error {
+	var builder strings.Builder
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return noEOF(err)
+		}
+		if !strings.HasPrefix(line, ";") {
+			return errRedisProtocol
+		}
+
+		length, err := redisLength(line[1:])
+		if err != nil {
+			return err
+		}
+		if length <= 0 {
+			value.str = builder.String()
+			return nil
+		}
+
+		chunk, err := r.readBulk(length)
+		if err != nil {
+			return err
+		}
+		builder.WriteString(chunk)
+	}
+}
+
+// readBulk reads a binary safe string, which may contain CRLF.
+func (r *redisReader) readBulk(length int) (string, error) {
+	b := make([]byte, length+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", noEOF(err)
+	}
+	r.size += len(b)
+
+	return string(b[:length]), nil
+}
+
+func (r *redisReader) readLine() (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	r.size += len(line)
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// strings returns the value as a command, the arguments are bulk strings.
+func (v *redisValue) strings() []string {
+	var args []string
+	for _, elem := range v.elems {
+		args = append(args, elem.text())
+	}
+
+	return args
+}
+
+func explainRedisArgs(args []string) string {
+	var builder strings.Builder
+	for _, arg := range args {
+		builder.WriteString(" " + explainRedisString(arg))
+	}
+
+	return builder.String()
+}
+
+// explainRedisString shows s as is if it's a plain word, quoted otherwise, truncated if too long.
+func explainRedisString(s string) string {
+	var suffix string
+	if len(s) > redisMaxShowLen {
+		suffix = fmt.Sprintf("...(%d bytes)", len(s))
+		s = s[:redisMaxShowLen]
+	}
+
+	if len(s) == 0 || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '"' || r > '~'
+	}) >= 0 {
+		return strconv.Quote(s) + suffix
+	}
+
+	return s + suffix
+}
+
+// explainRedisValue shows the value like redis-cli, aggregates are shown in multiple lines.
+func explainRedisValue(v *redisValue, depth int) string {
+	var info string
+	switch {
+	case v.null:
+		info = "(nil)"
+	case v.kind == '+':
+		info = v.str
+	case v.kind == '-' || v.kind == '!':
+		info = color.HiRedString("(error) %s", v.str)
+	case v.kind == ':':
+		info = fmt.Sprintf("(integer) %d", v.num)
+	case v.kind == ',':
+		info = fmt.Sprintf("(double) %s", v.str)
+	case v.kind == '(':
+		info = fmt.Sprintf("(big number) %s", v.str)
+	case v.kind == '#':
+		info = fmt.Sprintf("(boolean) %s", v.str)
+	case v.kind == '$' || v.kind == '=':
+		info = strconv.Quote(truncateRedisString(v.str))
+		if len(v.str) > redisMaxShowLen {
+			info += fmt.Sprintf("...(%d bytes)", len(v.str))
+		}
+	case len(v.elems) == 0:
+		info = "(empty)"
+	default:
+		info = explainRedisElems(v, depth)
+	}
+
+	if v.attrs != nil {
+		info = fmt.Sprintf("(attributes) %s\n%s", explainRedisElems(v.attrs, depth), info)
+	}
+
+	return info
+}
+
+func explainRedisElems(v *redisValue, depth int) string {
+	step := 1
+	if v.kind == '%' || v.kind == '|' {
+		step = 2
+	}
+
+	var lines []string
+	for i := 0; i+step <= len(v.elems); i += step {
+		if i/step >= redisMaxShowElems {
+			lines = append(lines, fmt.Sprintf("... %d more", (len(v.elems)-i)/step))
+			break
+		}
+
+		var line string
+		if step == 2 {
+			line = fmt.Sprintf("%d# %s => %s", i/step+1, explainRedisValue(v.elems[i], depth+1),
+				explainRedisValue(v.elems[i+1], depth+1))
+		} else {
+			line = fmt.Sprintf("%d) %s", i+1, explainRedisValue(v.elems[i], depth+1))
+		}
+		// the nested lines are aligned under the first one.
+		lines = append(lines, strings.ReplaceAll(line, "\n", "\n   "))
+	}
+
+	switch v.kind {
+	case '~':
+		lines = append([]string{"(set)"}, lines...)
+	case '>':
+		lines = append([]string{"(push)"}, lines...)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func truncateRedisString(s string) string {
+	if len(s) > redisMaxShowLen {
+		return s[:redisMaxShowLen]
+	}
+
+	return s
+}
+
+func redisLength(line string) (int, error) {
+	length, err := strconv.Atoi(line)
+	if err != nil || length > redisMaxBulkLen {
+		return 0, fmt.Errorf("%w: invalid length %q", errRedisProtocol, line)
+	}
+
+	return length, nil
+}
+
+// noEOF reports EOF in the middle of a value as io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// redisKeys returns the keys of a command, the first argument is the key if not specified.
+func redisKeys(name string, args []string) []string {
+	if redisKeylessCommands[name] || len(args) == 0 {
+		return nil
+	}
+
+	switch name {
+	case "DEL", "UNLINK", "EXISTS", "MGET", "TOUCH", "WATCH", "RENAME", "RENAMENX", "COPY",
+		"SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE", "PFCOUNT", "PFMERGE":
+		return args
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX":
+		// the last argument is the timeout.
+		return args[:len(args)-1]
+	case "MSET", "MSETNX":
+		var keys []string
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		// the script, then the number of keys and the keys.
+		if len(args) < 2 {
+			return nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 || n > len(args)-2 {
+			return nil
+		}
+		return args[2 : 2+n]
+	default:
+		return args[:1]
+	}
+}
+
+var redisKeylessCommands = map[string]bool{
+	"AUTH": true, "BGREWRITEAOF": true, "BGSAVE": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true,
+	"CONFIG": true, "DBSIZE": true, "DISCARD": true, "ECHO": true, "EXEC": true, "FLUSHALL": true,
+	"FLUSHDB": true, "FUNCTION": true, "HELLO": true, "INFO": true, "KEYS": true, "LASTSAVE": true,
+	"MEMORY": true, "MONITOR": true, "MULTI": true, "PING": true, "PSUBSCRIBE": true, "PUBLISH": true,
+	"PUBSUB": true, "PUNSUBSCRIBE": true, "QUIT": true, "RANDOMKEY": true, "READONLY": true,
+	"READWRITE": true, "RESET": true, "ROLE": true, "SAVE": true, "SCAN": true, "SCRIPT": true,
+	"SELECT": true, "SENTINEL": true, "SHUTDOWN": true, "SLOWLOG": true, "SPUBLISH": true,
+	"SSUBSCRIBE": true, "SUBSCRIBE": true, "SUNSUBSCRIBE": true, "SWAPDB": true, "TIME": true,
+	"UNSUBSCRIBE": true, "UNWATCH": true, "WAIT": true,
 }
@@ -0,0 +1,88 @@
+package protocol
+
+import "testing"
+
+func redisTestCommand(args ...string) *redisValue {
+	value := &redisValue{kind: '*'}
+	for _, arg := range args {
+		value.elems = append(value.elems, &redisValue{kind: '$', str: arg})
+	}
+	return value
+}
+
+func redisTestPush(kind, channel string, count int64) *redisValue {
+	return &redisValue{kind: '>', elems: []*redisValue{
+		{kind: '$', str: kind},
+		{kind: '$', str: channel},
+		{kind: ':', num: count},
+	}}
+}
+
+func TestRedisSubscribePairing(t *testing.T) {
+	red := newRedisInterop()
+	red.dumpCommand(redisTestCommand("SUBSCRIBE", "a", "b"), ClientSide, 1, true)
+	red.dumpCommand(redisTestCommand("SUBSCRIBE", "c"), ClientSide, 1, true)
+	red.dumpCommand(redisTestCommand("PING"), ClientSide, 1, true)
+
+	red.dumpReply(redisTestPush("subscribe", "a", 1), ServerSide, 1, true)
+	red.dumpReply(redisTestPush("subscribe", "b", 2), ServerSide, 1, true)
+	if len(red.pending) != 2 || red.pending[0].args[0] != "c" {
+		t.Fatalf("expected SUBSCRIBE c pending, got %v", red.pending)
+	}
+
+	// the error of SUBSCRIBE c, not the reply of PING.
+	red.dumpReply(&redisValue{kind: '-', str: "ERR not allowed"}, ServerSide, 1, true)
+	if len(red.pending) != 1 || red.pending[0].name != "PING" {
+		t.Fatalf("expected PING pending, got %v", red.pending)
+	}
+	red.dumpReply(&redisValue{kind: '+', str: "PONG"}, ServerSide, 1, true)
+	if len(red.pending) != 0 {
+		t.Fatalf("expected nothing pending, got %v", red.pending)
+	}
+
+	// unsubscribe from all is confirmed for each subscription.
+	red.dumpCommand(redisTestCommand("UNSUBSCRIBE"), ClientSide, 1, true)
+	red.dumpCommand(redisTestCommand("UNSUBSCRIBE"), ClientSide, 1, true)
+	red.dumpReply(redisTestPush("unsubscribe", "a", 1), ServerSide, 1, true)
+	red.dumpReply(redisTestPush("unsubscribe", "b", 0), ServerSide, 1, true)
+	if len(red.pending) != 1 {
+		t.Fatalf("expected the second UNSUBSCRIBE pending, got %v", red.pending)
+	}
+	red.dumpReply(&redisValue{kind: '>', elems: []*redisValue{
+		{kind: '$', str: "unsubscribe"},
+		{kind: '$', null: true},
+		{kind: ':', num: 0},
+	}}, ServerSide, 1, true)
+	if len(red.pending) != 0 {
+		t.Fatalf("expected nothing pending, got %v", red.pending)
+	}
+}
+
+func TestRedisSubscribeError(t *testing.T) {
+	red := newRedisInterop()
+	red.dumpCommand(redisTestCommand("SUBSCRIBE", "a"), ClientSide, 1, true)
+	red.dumpReply(&redisValue{kind: '-', str: "NOPERM no permissions to access the 'a' channel"},
+		ServerSide, 1, true)
+	if red.state.subscribing {
+		t.Fatal("expected not subscribing after the subscribe failed")
+	}
+
+	// an array that looks like a message is the reply of LRANGE, not a push.
+	red.dumpCommand(redisTestCommand("LRANGE", "l", "0", "-1"), ClientSide, 1, true)
+	red.dumpReply(&redisValue{kind: '*', elems: []*redisValue{
+		{kind: '$', str: "message"},
+		{kind: '$', str: "a"},
+		{kind: '$', str: "b"},
+	}}, ServerSide, 1, true)
+	if len(red.pending) != 0 {
+		t.Fatalf("expected LRANGE paired, got %v pending", red.pending)
+	}
+
+	// still subscribing while another subscribe command is pending.
+	red.dumpCommand(redisTestCommand("SUBSCRIBE", "a"), ClientSide, 1, true)
+	red.dumpCommand(redisTestCommand("SUBSCRIBE", "b"), ClientSide, 1, true)
+	red.dumpReply(&redisValue{kind: '-', str: "NOPERM"}, ServerSide, 1, true)
+	if !red.state.subscribing {
+		t.Fatal("expected subscribing while SUBSCRIBE b is pending")
+	}
+}
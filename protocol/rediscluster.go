@@ -0,0 +1,227 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+const redisClusterSlots = 16384
+
+// redisSlot returns the cluster hash slot of key,
+// only the hash tag is hashed if key contains a non-empty one, like {user1000}.following.
+func redisSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key)) % redisClusterSlots
+}
+
+// crc16 is the CRC16-XMODEM used by redis cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// explainRedisSlots shows the slot of the keys, the keys in different slots are rejected by a cluster.
+func explainRedisSlots(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+
+	slot := redisSlot(keys[0])
+	slots := []string{strconv.Itoa(slot)}
+	cross := false
+	for _, key := range keys[1:] {
+		s := redisSlot(key)
+		if s != slot {
+			cross = true
+		}
+		slots = append(slots, strconv.Itoa(s))
+	}
+	if cross {
+		return color.HiRedString(" crossslot:[%s]", strings.Join(slots, " "))
+	}
+
+	return fmt.Sprintf(" slot:%d", slot)
+}
+
+// explainRedisCluster explains the redirects and the topology replies of cluster and sentinel.
+func explainRedisCluster(cmd *redisCommand, v *redisValue) (string, bool) {
+	if v.kind == '-' {
+		return explainRedisRedirect(cmd, v.str)
+	}
+	if cmd == nil || v.null || len(cmd.args) == 0 {
+		return "", false
+	}
+
+	sub := strings.ToUpper(cmd.args[0])
+	switch {
+	case cmd.name == "CLUSTER" && sub == "SLOTS":
+		return explainClusterSlots(v)
+	case cmd.name == "CLUSTER" && sub == "SHARDS":
+		return explainClusterShards(v)
+	case cmd.name == "SENTINEL" && sub == "GET-MASTER-ADDR-BY-NAME" && len(v.elems) == 2:
+		return fmt.Sprintf("master %s at %s", explainRedisString(cmd.args[len(cmd.args)-1]),
+			redisAddr(v.elems[0].text(), v.elems[1].text())), true
+	default:
+		return "", false
+	}
+}
+
+// explainRedisRedirect explains -MOVED 3999 127.0.0.1:6381 and -ASK 3999 127.0.0.1:6381.
+func explainRedisRedirect(cmd *redisCommand, msg string) (string, bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", false
+	}
+
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", false
+	}
+
+	info := fmt.Sprintf("(redirect) %s slot:%d target:%s", fields[0], slot, fields[2])
+	if cmd != nil && len(cmd.keys) > 0 {
+		info += " key:" + explainRedisString(cmd.keys[0])
+		// the client computed a different slot, usually a broken hash tag handling.
+		if s := redisSlot(cmd.keys[0]); s != slot {
+			info += fmt.Sprintf(" key_slot:%d", s)
+		}
+	}
+	if fields[0] == "ASK" {
+		// the slot is migrating, the command is retried on the target after ASKING, only once.
+		info += " (send ASKING to the target before retry)"
+	}
+
+	return color.HiMagentaString(info), true
+}
+
+// explainClusterSlots explains the reply of CLUSTER SLOTS,
+// each element is start, end, the master and the replicas, the nodes are ip, port, id and more.
+func explainClusterSlots(v *redisValue) (string, bool) {
+	if len(v.elems) == 0 {
+		return "", false
+	}
+
+	var lines []string
+	for _, elem := range v.elems {
+		if len(elem.elems) < 3 {
+			return "", false
+		}
+
+		line := fmt.Sprintf("slots %d-%d master:%s", elem.elems[0].num, elem.elems[1].num,
+			explainClusterNode(elem.elems[2]))
+		var replicas []string
+		for _, node := range elem.elems[3:] {
+			replicas = append(replicas, explainClusterNode(node))
+		}
+		if len(replicas) > 0 {
+			line += " replicas:" + strings.Join(replicas, ",")
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n"), true
+}
+
+func explainClusterNode(v *redisValue) string {
+	if len(v.elems) < 2 {
+		return "?"
+	}
+
+	addr := redisAddr(v.elems[0].text(), v.elems[1].text())
+	if len(v.elems) > 2 {
+		addr += "(" + v.elems[2].text() + ")"
+	}
+
+	return addr
+}
+
+// explainClusterShards explains the reply of CLUSTER SHARDS,
+// each shard is a map of the slot ranges and the nodes, the nodes are maps too.
+func explainClusterShards(v *redisValue) (string, bool) {
+	if len(v.elems) == 0 {
+		return "", false
+	}
+
+	var lines []string
+	for _, elem := range v.elems {
+		shard := elem.pairs()
+		slots, nodes := shard["slots"], shard["nodes"]
+		if slots == nil || nodes == nil {
+			return "", false
+		}
+
+		var ranges []string
+		for i := 0; i+1 < len(slots.elems); i += 2 {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", slots.elems[i].num, slots.elems[i+1].num))
+		}
+		line := "shard slots:" + strings.Join(ranges, ",")
+		for _, node := range nodes.elems {
+			fields := node.pairs()
+			host := fields["endpoint"].text()
+			if len(host) == 0 || host == "?" {
+				host = fields["ip"].text()
+			}
+			port := fields["port"].text()
+			if len(port) == 0 {
+				port = fields["tls-port"].text()
+			}
+			line += fmt.Sprintf(" %s:%s(%s)", fields["role"].text(), redisAddr(host, port), fields["id"].text())
+			if health := fields["health"].text(); health != "online" {
+				line += color.HiRedString(" health:%s", health)
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n"), true
+}
+
+func redisAddr(host, port string) string {
+	if strings.IndexByte(host, ':') >= 0 {
+		// ipv6
+		return fmt.Sprintf("[%s]:%s", host, port)
+	}
+
+	return fmt.Sprintf("%s:%s", host, port)
+}
+
+// pairs returns the key value pairs of a map in RESP3, or a flat array in RESP2.
+func (v *redisValue) pairs() map[string]*redisValue {
+	m := make(map[string]*redisValue)
+	for i := 0; i+1 < len(v.elems); i += 2 {
+		m[v.elems[i].text()] = v.elems[i+1]
+	}
+
+	return m
+}
+
+// text returns the value as a string, empty for the missing ones.
+func (v *redisValue) text() string {
+	if v == nil {
+		return ""
+	}
+	if v.kind == ':' {
+		return strconv.FormatInt(v.num, 10)
+	}
+
+	return v.str
+}
@@ -0,0 +1,310 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+)
+
+// the channel that invalidations are published to in RESP2 with CLIENT TRACKING REDIRECT.
+const redisInvalidateChannel = "__redis__:invalidate"
+
+// the commands that are confirmed by pushes instead of replies, one push for each channel.
+var redisSubscribeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+}
+
+// redisConnState is the state of a connection that changes how the server talks to the client.
+type redisConnState struct {
+	// the subscribed channels, patterns and shard channels.
+	channels map[string]bool
+	patterns map[string]bool
+	shards   map[string]bool
+	// a subscribe command is sent, RESP2 arrays can be pushes since then.
+	subscribing bool
+	// MONITOR is on, the server streams the commands of all clients.
+	monitor  bool
+	tracking string
+}
+
+func newRedisConnState() redisConnState {
+	return redisConnState{
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		shards:   make(map[string]bool),
+	}
+}
+
+func (s *redisConnState) subscribed() bool {
+	return len(s.channels)+len(s.patterns)+len(s.shards) > 0
+}
+
+// isPush tells if value is out of band, not the reply of any command,
+// which are RESP3 pushes, RESP2 pub/sub arrays while subscribing, and the commands streamed by MONITOR.
+func (red *redisInterop) isPush(value *redisValue) bool {
+	if value.kind == '>' {
+		return true
+	}
+
+	red.lock.Lock()
+	defer red.lock.Unlock()
+
+	switch value.kind {
+	case '*':
+		if !red.state.subscribing || len(value.elems) == 0 {
+			return false
+		}
+		switch strings.ToLower(value.elems[0].text()) {
+		case "message", "pmessage", "smessage", "subscribe", "psubscribe", "ssubscribe",
+			"unsubscribe", "punsubscribe", "sunsubscribe":
+			return true
+		}
+	case '+':
+		_, ok := parseRedisMonitor(value.str)
+		return red.state.monitor && ok
+	}
+
+	return false
+}
+
+func (red *redisInterop) dumpPush(value *redisValue, source string, id int, quiet bool) {
+	var info string
+	if value.kind == '+' {
+		line, _ := parseRedisMonitor(value.str)
+		info = fmt.Sprintf("%s %s", color.HiYellowString("monitor"), line)
+	} else {
+		info = red.explainPush(value)
+	}
+
+	if quiet {
+		return
+	}
+
+	if strings.Contains(info, "\n") {
+		display.PrintfWithTime("[%s-%d] %s len:%d\n%s", source, id, color.HiYellowString("push"),
+			value.size, indent(info))
+	} else {
+		display.PrintfWithTime("[%s-%d] %s len:%d\n", source, id, info, value.size)
+	}
+}
+
+// explainPush explains the pub/sub messages and confirmations, and the invalidations of client tracking.
+func (red *redisInterop) explainPush(value *redisValue) string {
+	elems := value.elems
+	if len(elems) == 0 {
+		return explainRedisValue(value, 0)
+	}
+
+	kind := strings.ToLower(elems[0].text())
+	name := color.HiYellowString(kind)
+	switch {
+	case kind == "invalidate" && len(elems) == 2:
+		return fmt.Sprintf("%s %s", name, explainRedisInvalidate(elems[1]))
+	case (kind == "message" || kind == "smessage") && len(elems) == 3:
+		channel := elems[1].text()
+		redisStatistics.recordMessage(channel, value.size)
+		if channel == redisInvalidateChannel {
+			return fmt.Sprintf("%s %s", color.HiYellowString("invalidate"), explainRedisInvalidate(elems[2]))
+		}
+		return fmt.Sprintf("%s channel:%s %s", name, explainRedisString(channel), explainRedisValue(elems[2], 0))
+	case kind == "pmessage" && len(elems) == 4:
+		channel := elems[2].text()
+		redisStatistics.recordMessage(channel, value.size)
+		return fmt.Sprintf("%s pattern:%s channel:%s %s", name, explainRedisString(elems[1].text()),
+			explainRedisString(channel), explainRedisValue(elems[3], 0))
+	case strings.HasSuffix(kind, "subscribe") && len(elems) == 3:
+		return fmt.Sprintf("%s %s subscriptions:%d", name, red.subscribe(kind, elems[1], elems[2].num), elems[2].num)
+	default:
+		return explainRedisValue(value, 0)
+	}
+}
+
+// subscribe updates the subscriptions on a confirmation, and returns the channel.
+func (red *redisInterop) subscribe(kind string, channel *redisValue, count int64) string {
+	red.lock.Lock()
+	defer red.lock.Unlock()
+
+	unsubscribe := strings.Contains(kind, "unsubscribe")
+	defer func() {
+		// back to the normal mode, the arrays are replies again.
+		if unsubscribe && count == 0 && !red.state.subscribed() {
+			red.state.subscribing = false
+		}
+	}()
+
+	var set map[string]bool
+	var label string
+	switch strings.Replace(kind, "un", "", 1) {
+	case "psubscribe":
+		set, label = red.state.patterns, "pattern"
+	case "ssubscribe":
+		set, label = red.state.shards, "shard_channel"
+	default:
+		set, label = red.state.channels, "channel"
+	}
+	red.confirm(kind, len(set))
+
+	// unsubscribe without any subscription is confirmed with a nil channel.
+	if channel.null {
+		return label + ":(nil)"
+	}
+
+	if unsubscribe {
+		delete(set, channel.str)
+	} else {
+		set[channel.str] = true
+	}
+
+	return fmt.Sprintf("%s:%s", label, explainRedisString(channel.str))
+}
+
+// confirm pairs a confirmation with the pending subscribe command,
+// which is done once all its channels are confirmed.
+func (red *redisInterop) confirm(kind string, subscriptions int) {
+	if len(red.pending) == 0 || !strings.EqualFold(red.pending[0].name, kind) {
+		return
+	}
+
+	cmd := red.pending[0]
+	if cmd.confirms == 0 {
+		// unsubscribe from all is confirmed for each subscription, or once with a nil channel.
+		cmd.confirms = max(subscriptions, 1)
+	}
+	cmd.confirms--
+	if cmd.confirms == 0 {
+		red.pending = red.pending[1:]
+	}
+}
+
+// stopSubscribing leaves the subscribing mode after a subscribe command failed, the arrays are replies again,
+// unless there are subscriptions or other subscribe commands pending. It's called with the lock held.
+func (red *redisInterop) stopSubscribing() {
+	if red.state.subscribed() {
+		return
+	}
+	for _, cmd := range red.pending {
+		if redisSubscribeCommands[cmd.name] {
+			return
+		}
+	}
+
+	red.state.subscribing = false
+}
+
+// updateState updates the connection state on the reply of cmd, and returns the change.
+func (red *redisInterop) updateState(cmd *redisCommand, value *redisValue) string {
+	if value.kind == '-' || value.kind == '!' {
+		return ""
+	}
+
+	red.lock.Lock()
+	defer red.lock.Unlock()
+
+	switch cmd.name {
+	case "MONITOR":
+		red.state.monitor = true
+		return " (monitor on)"
+	case "RESET":
+		red.state = newRedisConnState()
+		return " (state reset)"
+	case "CLIENT":
+		if len(cmd.args) < 2 || !strings.EqualFold(cmd.args[0], "TRACKING") {
+			return ""
+		}
+		if strings.EqualFold(cmd.args[1], "OFF") {
+			red.state.tracking = ""
+			return " (tracking off)"
+		}
+		red.state.tracking = strings.ToLower(strings.Join(cmd.args[1:], " "))
+		return fmt.Sprintf(" (tracking %s)", red.state.tracking)
+	case "PUBLISH", "SPUBLISH":
+		if len(cmd.args) > 0 && value.kind == ':' {
+			redisStatistics.recordPublish(cmd.args[0], int(value.num))
+			return fmt.Sprintf(" (receivers:%d)", value.num)
+		}
+	}
+
+	return ""
+}
+
+// explainRedisInvalidate explains the invalidated keys, nil means all keys are flushed.
+func explainRedisInvalidate(keys *redisValue) string {
+	if keys.null {
+		return "all keys (flushed)"
+	}
+	if keys.kind != '*' {
+		return "keys:" + explainRedisString(keys.text())
+	}
+
+	return "keys:" + strings.TrimPrefix(explainRedisArgs(keys.strings()), " ")
+}
+
+// parseRedisMonitor parses a MONITOR line, like 1339518083.107412 [0 127.0.0.1:60866] "keys" "*".
+func parseRedisMonitor(line string) (string, bool) {
+	fields := strings.SplitN(line, " [", 2)
+	if len(fields) != 2 {
+		return "", false
+	}
+	ts, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", false
+	}
+	end := strings.Index(fields[1], "] ")
+	if end < 0 {
+		return "", false
+	}
+
+	var db, client string
+	if index := strings.IndexByte(fields[1][:end], ' '); index > 0 {
+		db, client = fields[1][:index], fields[1][index+1:end]
+	} else {
+		db = fields[1][:end]
+	}
+
+	args := parseRedisQuoted(fields[1][end+2:])
+	if len(args) == 0 {
+		return "", false
+	}
+
+	at := time.UnixMicro(int64(ts * 1e6)).Format("15:04:05.000000")
+	return fmt.Sprintf("at:%s db:%s client:%s %s%s", at, db, client, strings.ToUpper(args[0]),
+		explainRedisArgs(args[1:])), true
+}
+
+// parseRedisQuoted parses the quoted arguments, the escapes of redis are valid in Go.
+func parseRedisQuoted(s string) []string {
+	var args []string
+	for {
+		start := strings.IndexByte(s, '"')
+		if start < 0 {
+			return args
+		}
+
+		end := start + 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return args
+		}
+
+		arg, err := strconv.Unquote(s[start : end+1])
+		if err != nil {
+			arg = s[start+1 : end]
+		}
+		args = append(args, arg)
+		s = s[end+1:]
+	}
+}
@@ -0,0 +1,313 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	// the latest latencies kept for each command to compute the percentiles.
+	redisLatencySamples = 10000
+	// the max distinct keys counted, the keys after are not counted to bound the memory.
+	redisMaxKeys = 100000
+	redisTopN    = 10
+)
+
+var (
+	redisStatistics = newRedisStats()
+	redisStatsOnce  sync.Once
+)
+
+type (
+	redisCommandStat struct {
+		count     int
+		latencies []time.Duration
+		// the next position to overwrite in latencies once it's full.
+		next int
+	}
+
+	redisBigValue struct {
+		cmd  string
+		key  string
+		op   string
+		size int
+	}
+
+	redisChannelStat struct {
+		published int
+		// the subscribers that the published messages reached, as replied by the server.
+		receivers int
+		// the messages delivered to the subscribers through tproxy.
+		delivered int
+		bytes     int
+		first     time.Time
+		last      time.Time
+	}
+
+	// redisStats accumulates the statistics of all redis connections.
+	redisStats struct {
+		commands  map[string]*redisCommandStat
+		keys      map[string]int
+		bigValues []redisBigValue
+		errors    map[string]int
+		channels  map[string]*redisChannelStat
+		changed   bool
+		lock      sync.Mutex
+	}
+)
+
+func newRedisStats() *redisStats {
+	return &redisStats{
+		commands: make(map[string]*redisCommandStat),
+		keys:     make(map[string]int),
+		errors:   make(map[string]int),
+		channels: make(map[string]*redisChannelStat),
+	}
+}
+
+// record accounts a command and its reply.
+func (s *redisStats) record(cmd *redisCommand, reply *redisValue, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.changed = true
+	stat, ok := s.commands[cmd.name]
+	if !ok {
+		stat = new(redisCommandStat)
+		s.commands[cmd.name] = stat
+	}
+	stat.count++
+	if len(stat.latencies) < redisLatencySamples {
+		stat.latencies = append(stat.latencies, latency)
+	} else {
+		stat.latencies[stat.next] = latency
+		stat.next = (stat.next + 1) % redisLatencySamples
+	}
+
+	for _, key := range cmd.keys {
+		if _, ok := s.keys[key]; ok || len(s.keys) < redisMaxKeys {
+			s.keys[key]++
+		}
+	}
+
+	// the values written are the arguments besides the keys, and the values read are the replies,
+	// but not the status replies like +OK.
+	if len(cmd.keys) > 0 {
+		key := cmd.keys[0]
+		if size := redisValueSize(cmd); size > 0 {
+			s.addBigValue(redisBigValue{cmd: cmd.name, key: key, op: "write", size: size})
+		}
+		switch reply.kind {
+		case '+', '-', '!', ':', '_':
+		default:
+			if size := redisReplySize(reply); size > 0 {
+				s.addBigValue(redisBigValue{cmd: cmd.name, key: key, op: "read", size: size})
+			}
+		}
+	}
+
+	if reply.kind == '-' || reply.kind == '!' {
+		errType := reply.str
+		if index := strings.IndexByte(errType, ' '); index > 0 {
+			errType = errType[:index]
+		}
+		s.errors[errType]++
+	}
+}
+
+// recordPublish accounts a message published to channel, and the subscribers it reached.
+func (s *redisStats) recordPublish(channel string, receivers int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stat := s.channel(channel)
+	stat.published++
+	stat.receivers += receivers
+}
+
+// recordMessage accounts a message delivered to a subscriber from channel.
+func (s *redisStats) recordMessage(channel string, size int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stat := s.channel(channel)
+	stat.delivered++
+	stat.bytes += size
+}
+
+func (s *redisStats) channel(channel string) *redisChannelStat {
+	s.changed = true
+	now := time.Now()
+	stat, ok := s.channels[channel]
+	if !ok {
+		stat = &redisChannelStat{first: now}
+		s.channels[channel] = stat
+	}
+	stat.last = now
+
+	return stat
+}
+
+func (s *redisStats) addBigValue(value redisBigValue) {
+	if len(s.bigValues) == redisTopN && value.size <= s.bigValues[redisTopN-1].size {
+		return
+	}
+
+	s.bigValues = append(s.bigValues, value)
+	sort.SliceStable(s.bigValues, func(i, j int) bool {
+		return s.bigValues[i].size > s.bigValues[j].size
+	})
+	if len(s.bigValues) > redisTopN {
+		s.bigValues = s.bigValues[:redisTopN]
+	}
+}
+
+func (s *redisStats) report() (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.commands) == 0 && len(s.channels) == 0 {
+		return "", false
+	}
+	changed := s.changed
+	s.changed = false
+
+	var builder strings.Builder
+	builder.WriteString(color.HiWhiteString("Redis stats:\n"))
+	if len(s.commands) > 0 {
+		builder.WriteString(color.HiWhiteString("  Commands:\n"))
+	}
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ci, cj := s.commands[names[i]].count, s.commands[names[j]].count
+		return ci > cj || ci == cj && names[i] < names[j]
+	})
+	for _, name := range names {
+		stat := s.commands[name]
+		latencies := append([]time.Duration(nil), stat.latencies...)
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		builder.WriteString(color.HiWhiteString("    %s count:%d p50:%s p90:%s p99:%s max:%s\n", name,
+			stat.count, percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99),
+			latencies[len(latencies)-1]))
+	}
+
+	if len(s.keys) > 0 {
+		builder.WriteString(color.HiWhiteString("  Hot keys:\n"))
+		keys := make([]string, 0, len(s.keys))
+		for key := range s.keys {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			ci, cj := s.keys[keys[i]], s.keys[keys[j]]
+			return ci > cj || ci == cj && keys[i] < keys[j]
+		})
+		if len(keys) > redisTopN {
+			keys = keys[:redisTopN]
+		}
+		for _, key := range keys {
+			builder.WriteString(color.HiWhiteString("    %s count:%d\n", explainRedisString(key), s.keys[key]))
+		}
+	}
+
+	if len(s.bigValues) > 0 {
+		builder.WriteString(color.HiWhiteString("  Big values:\n"))
+		for _, value := range s.bigValues {
+			builder.WriteString(color.HiWhiteString("    %s %s %s len:%d\n", value.cmd,
+				explainRedisString(value.key), value.op, value.size))
+		}
+	}
+
+	if len(s.errors) > 0 {
+		builder.WriteString(color.HiWhiteString("  Errors:\n"))
+		errTypes := make([]string, 0, len(s.errors))
+		for errType := range s.errors {
+			errTypes = append(errTypes, errType)
+		}
+		sort.Slice(errTypes, func(i, j int) bool {
+			ci, cj := s.errors[errTypes[i]], s.errors[errTypes[j]]
+			return ci > cj || ci == cj && errTypes[i] < errTypes[j]
+		})
+		for _, errType := range errTypes {
+			builder.WriteString(color.HiWhiteString("    %s count:%d\n", errType, s.errors[errType]))
+		}
+	}
+
+	if len(s.channels) > 0 {
+		builder.WriteString(color.HiWhiteString("  Channels:\n"))
+		channels := make([]string, 0, len(s.channels))
+		for channel := range s.channels {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+		for _, channel := range channels {
+			builder.WriteString(color.HiWhiteString("    %s %s\n", explainRedisString(channel),
+				s.channels[channel]))
+		}
+	}
+
+	return builder.String(), changed
+}
+
+func (s *redisChannelStat) String() string {
+	info := fmt.Sprintf("published:%d receivers:%d delivered:%d bytes:%d",
+		s.published, s.receivers, s.delivered, s.bytes)
+	// the rate of the messages that the subscribers got, or published if no subscribers through tproxy.
+	messages := s.delivered
+	if messages == 0 {
+		messages = s.published
+	}
+	if elapsed := s.last.Sub(s.first); elapsed > 0 {
+		info += fmt.Sprintf(" rate:%.1f/s", float64(messages)/elapsed.Seconds())
+	}
+
+	return info
+}
+
+// redisValueSize returns the bytes of the arguments besides the keys, which are the values written.
+func redisValueSize(cmd *redisCommand) int {
+	keys := make(map[string]bool, len(cmd.keys))
+	for _, key := range cmd.keys {
+		keys[key] = true
+	}
+
+	var size int
+	for _, arg := range cmd.args {
+		if keys[arg] {
+			// counted once, a value can be the same as a key.
+			delete(keys, arg)
+			continue
+		}
+		size += len(arg)
+	}
+
+	return size
+}
+
+// redisReplySize returns the bytes of the content of a reply without the framing,
+// the length of a string, or the sum of the elements of an aggregate.
+func redisReplySize(reply *redisValue) int {
+	if reply.null {
+		return 0
+	}
+
+	switch reply.kind {
+	case '*', '~', '%', '>', '|':
+		var size int
+		for _, elem := range reply.elems {
+			size += redisReplySize(elem)
+		}
+		return size
+	default:
+		return len(reply.text())
+	}
+}
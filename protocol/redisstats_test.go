@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedisStatsBigValues(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	s := newRedisStats()
+	s.record(&redisCommand{name: "SET", args: []string{"k", value}, keys: []string{"k"}, size: 130},
+		&redisValue{kind: '+', str: "OK", size: 5}, 0)
+	s.record(&redisCommand{name: "GET", args: []string{"k"}, keys: []string{"k"}, size: 20},
+		&redisValue{kind: '$', str: value, size: 107}, 0)
+	s.record(&redisCommand{name: "DEL", args: []string{"k"}, keys: []string{"k"}, size: 20},
+		&redisValue{kind: ':', num: 1, size: 4}, 0)
+	s.record(&redisCommand{name: "GET", args: []string{"missing"}, keys: []string{"missing"}, size: 26},
+		&redisValue{kind: '$', null: true, size: 5}, 0)
+	element := strings.Repeat("e", 30)
+	s.record(&redisCommand{name: "HGETALL", args: []string{"h"}, keys: []string{"h"}, size: 24},
+		&redisValue{kind: '%', elems: []*redisValue{
+			{kind: '$', str: "f1", size: 8},
+			{kind: '$', str: element, size: 37},
+			{kind: '$', str: "f2", size: 8},
+			{kind: '$', str: element, size: 37},
+		}, size: 94}, 0)
+
+	// sized by the values, not the RESP framing.
+	expect := []redisBigValue{
+		{cmd: "SET", key: "k", op: "write", size: 100},
+		{cmd: "GET", key: "k", op: "read", size: 100},
+		{cmd: "HGETALL", key: "h", op: "read", size: 64},
+	}
+	if len(s.bigValues) != len(expect) {
+		t.Fatalf("expected %v, got %v", expect, s.bigValues)
+	}
+	for i, value := range expect {
+		if s.bigValues[i] != value {
+			t.Fatalf("expected %v, got %v", expect, s.bigValues)
+		}
+	}
+}
+
+func TestRedisValueSize(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		keys []string
+		size int
+	}{
+		{name: "SET", args: []string{"k", "value"}, keys: []string{"k"}, size: 5},
+		{name: "GET", args: []string{"k"}, keys: []string{"k"}, size: 0},
+		{name: "MSET", args: []string{"a", "1", "b", "22"}, keys: []string{"a", "b"}, size: 3},
+		{name: "SET", args: []string{"k", "k"}, keys: []string{"k"}, size: 1},
+		{name: "HSET", args: []string{"h", "f1", "v1", "f2", "v2"}, keys: []string{"h"}, size: 8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			size := redisValueSize(&redisCommand{name: test.name, args: test.args, keys: test.keys})
+			if size != test.size {
+				t.Fatalf("expected %d, got %d", test.size, size)
+			}
+		})
+	}
+}
+
+func TestRedisStatsErrorsOrder(t *testing.T) {
+	s := newRedisStats()
+	for _, reply := range []string{"WRONGTYPE a", "ERR b", "NOAUTH c", "ERR d", "WRONGTYPE e", "MOVED 1 x"} {
+		s.record(&redisCommand{name: "GET"}, &redisValue{kind: '-', str: reply}, 0)
+	}
+
+	// equal counts are ordered by the error types, the same on every report.
+	expect := []string{"ERR count", "WRONGTYPE count", "MOVED count", "NOAUTH count"}
+	for i := 0; i < 10; i++ {
+		report, _ := s.report()
+		last := -1
+		for _, errType := range expect {
+			index := strings.Index(report, errType)
+			if index <= last {
+				t.Fatalf("expected the order %v, got %q", expect, report)
+			}
+			last = index
+		}
+	}
+}
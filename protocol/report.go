@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+)
+
+// reporter accumulates statistics across connections.
+type reporter interface {
+	// report returns the statistics, and whether they changed since the last report.
+	report() (string, bool)
+}
+
+var reporters struct {
+	list []reporter
+	lock sync.Mutex
+}
+
+func register(r reporter) {
+	reporters.lock.Lock()
+	defer reporters.lock.Unlock()
+	reporters.list = append(reporters.list, r)
+}
+
+// Report prints the statistics of the decoders, the periodic ones are skipped if nothing changed.
+func Report(final bool) {
+	reporters.lock.Lock()
+	defer reporters.lock.Unlock()
+
+	for _, r := range reporters.list {
+		info, changed := r.report()
+		if len(info) == 0 || (!final && !changed) {
+			continue
+		}
+
+		fmt.Println()
+		fmt.Print(info)
+	}
+}
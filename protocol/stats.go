@@ -0,0 +1,17 @@
+package protocol
+
+import "time"
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(latencies []time.Duration, p int) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	index := (len(latencies)*p+99)/100 - 1
+	if index < 0 {
+		index = 0
+	}
+
+	return latencies[index]
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	series := func(n int) []time.Duration {
+		latencies := make([]time.Duration, 0, n)
+		for i := 1; i <= n; i++ {
+			latencies = append(latencies, time.Duration(i))
+		}
+		return latencies
+	}
+
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		p         int
+		expect    time.Duration
+	}{
+		{name: "empty", p: 99, expect: 0},
+		{name: "single", latencies: series(1), p: 99, expect: 1},
+		{name: "p0", latencies: series(10), p: 0, expect: 1},
+		{name: "p50 of 10", latencies: series(10), p: 50, expect: 5},
+		{name: "p99 of 10", latencies: series(10), p: 99, expect: 10},
+		{name: "p99 of 100", latencies: series(100), p: 99, expect: 99},
+		{name: "p100 of 100", latencies: series(100), p: 100, expect: 100},
+		{name: "p99 of 1000", latencies: series(1000), p: 99, expect: 990},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if value := percentile(test.latencies, test.p); value != test.expect {
+				t.Fatalf("expected %d, got %d", test.expect, value)
+			}
+		})
+	}
+}
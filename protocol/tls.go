@@ -0,0 +1,461 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/display"
+)
+
+const (
+	tlsRecordHeaderLen    = 5
+	tlsHandshakeHeaderLen = 4
+
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordAlert            = 21
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+	tlsRecordHeartbeat        = 24
+
+	tlsHandshakeClientHello = 1
+	tlsHandshakeServerHello = 2
+	tlsHandshakeCertificate = 11
+
+	tlsExtensionServerName        = 0
+	tlsExtensionSupportedGroups   = 10
+	tlsExtensionALPN              = 16
+	tlsExtensionSupportedVersions = 43
+)
+
+var (
+	errTLSShortBuffer = errors.New("short buffer")
+
+	// the random of a HelloRetryRequest, which is sent as a ServerHello.
+	tlsHelloRetryRandom, _ = hex.DecodeString("cf21ad74e59a6111be1d8c021e65b891c2a211167abb8c5e079e09e2c8a8339c")
+
+	tlsHandshakeNames = map[byte]string{
+		0:  "hello_request",
+		1:  "client_hello",
+		2:  "server_hello",
+		4:  "new_session_ticket",
+		5:  "end_of_early_data",
+		8:  "encrypted_extensions",
+		11: "certificate",
+		12: "server_key_exchange",
+		13: "certificate_request",
+		14: "server_hello_done",
+		15: "certificate_verify",
+		16: "client_key_exchange",
+		20: "finished",
+		22: "certificate_status",
+		24: "key_update",
+	}
+
+	tlsExtensionNames = map[uint16]string{
+		0:     "server_name",
+		1:     "max_fragment_length",
+		5:     "status_request",
+		10:    "supported_groups",
+		11:    "ec_point_formats",
+		13:    "signature_algorithms",
+		16:    "alpn",
+		18:    "signed_certificate_timestamp",
+		21:    "padding",
+		22:    "encrypt_then_mac",
+		23:    "extended_master_secret",
+		27:    "compress_certificate",
+		35:    "session_ticket",
+		41:    "pre_shared_key",
+		42:    "early_data",
+		43:    "supported_versions",
+		44:    "cookie",
+		45:    "psk_key_exchange_modes",
+		49:    "post_handshake_auth",
+		50:    "signature_algorithms_cert",
+		51:    "key_share",
+		17513: "application_settings",
+		65037: "encrypted_client_hello",
+		65281: "renegotiation_info",
+	}
+
+	tlsAlertNames = map[byte]string{
+		0:   "close_notify",
+		10:  "unexpected_message",
+		20:  "bad_record_mac",
+		21:  "decryption_failed",
+		22:  "record_overflow",
+		30:  "decompression_failure",
+		40:  "handshake_failure",
+		41:  "no_certificate",
+		42:  "bad_certificate",
+		43:  "unsupported_certificate",
+		44:  "certificate_revoked",
+		45:  "certificate_expired",
+		46:  "certificate_unknown",
+		47:  "illegal_parameter",
+		48:  "unknown_ca",
+		49:  "access_denied",
+		50:  "decode_error",
+		51:  "decrypt_error",
+		60:  "export_restriction",
+		70:  "protocol_version",
+		71:  "insufficient_security",
+		80:  "internal_error",
+		86:  "inappropriate_fallback",
+		90:  "user_canceled",
+		100: "no_renegotiation",
+		109: "missing_extension",
+		110: "unsupported_extension",
+		112: "unrecognized_name",
+		113: "bad_certificate_status_response",
+		115: "unknown_psk_identity",
+		116: "certificate_required",
+		120: "no_application_protocol",
+	}
+)
+
+type (
+	tlsInterop struct{}
+
+	// tlsStream is the state of one direction of a tls connection.
+	tlsStream struct {
+		source    string
+		id        int
+		quiet     bool
+		handshake []byte
+		encrypted bool
+		appData   int
+		appBytes  int
+		firstData time.Time
+		lastData  time.Time
+	}
+)
+
+func (t *tlsInterop) Dump(r io.Reader, source string, id int, quiet bool) {
+	stream := &tlsStream{
+		source: source,
+		id:     id,
+		quiet:  quiet,
+	}
+	defer stream.summarize()
+
+	header := make([]byte, tlsRecordHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			drain(r)
+			return
+		}
+
+		recordType := header[0]
+		if recordType < tlsRecordChangeCipherSpec || recordType > tlsRecordHeartbeat {
+			display.PrintfWithTime(color.HiRedString("[%s-%d] not a tls record (type %d), stop decoding\n",
+				source, id, recordType))
+			drain(r)
+			return
+		}
+
+		fragment := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+		if _, err := io.ReadFull(r, fragment); err != nil {
+			drain(r)
+			return
+		}
+
+		stream.handleRecord(recordType, binary.BigEndian.Uint16(header[1:3]), fragment)
+	}
+}
+
+func (s *tlsStream) handleRecord(recordType byte, version uint16, fragment []byte) {
+	switch recordType {
+	case tlsRecordChangeCipherSpec:
+		s.encrypted = true
+		s.print("change_cipher_spec", "")
+	case tlsRecordAlert:
+		if s.encrypted || len(fragment) != 2 {
+			s.print("alert", fmt.Sprintf("encrypted len:%d", len(fragment)))
+			return
+		}
+		level := "warning"
+		if fragment[0] == 2 {
+			level = color.HiRedString("fatal")
+		}
+		desc, ok := tlsAlertNames[fragment[1]]
+		if !ok {
+			desc = fmt.Sprintf("alert(%d)", fragment[1])
+		}
+		s.print("alert", fmt.Sprintf("level:%s description:%s", level, desc))
+	case tlsRecordHandshake:
+		if s.encrypted {
+			s.print("handshake", fmt.Sprintf("encrypted len:%d", len(fragment)))
+			return
+		}
+		s.handshake = append(s.handshake, fragment...)
+		s.handleHandshakes(version)
+	case tlsRecordApplicationData:
+		if s.appData == 0 {
+			s.firstData = time.Now()
+			s.print("application_data", "encrypted data started")
+		}
+		s.appData++
+		s.appBytes += len(fragment)
+		s.lastData = time.Now()
+	case tlsRecordHeartbeat:
+		s.print("heartbeat", fmt.Sprintf("len:%d", len(fragment)))
+	}
+}
+
+func (s *tlsStream) handleHandshakes(version uint16) {
+	for len(s.handshake) >= tlsHandshakeHeaderLen {
+		length := int(s.handshake[1])<<16 | int(s.handshake[2])<<8 | int(s.handshake[3])
+		if len(s.handshake) < tlsHandshakeHeaderLen+length {
+			// the message continues in the next record
+			return
+		}
+
+		msgType := s.handshake[0]
+		body := s.handshake[tlsHandshakeHeaderLen : tlsHandshakeHeaderLen+length]
+		s.handshake = s.handshake[tlsHandshakeHeaderLen+length:]
+
+		name, ok := tlsHandshakeNames[msgType]
+		if !ok {
+			name = fmt.Sprintf("handshake(%d)", msgType)
+		}
+
+		var info string
+		switch msgType {
+		case tlsHandshakeClientHello:
+			info = explainTLSClientHello(body)
+		case tlsHandshakeServerHello:
+			if len(body) >= 34 && bytes.Equal(body[2:34], tlsHelloRetryRandom) {
+				name = "hello_retry_request"
+			}
+			info = explainTLSServerHello(body)
+		case tlsHandshakeCertificate:
+			info = explainTLSCertificates(body)
+		default:
+			info = fmt.Sprintf("len:%d", length)
+		}
+
+		s.print(name, fmt.Sprintf("record_version:%s %s", tls.VersionName(version), info))
+	}
+}
+
+func (s *tlsStream) print(name, info string) {
+	if s.quiet {
+		return
+	}
+
+	display.PrintfWithTime("[%s-%d] %s %s\n", s.source, s.id, color.HiYellowString("tls:%s", name), info)
+}
+
+func (s *tlsStream) summarize() {
+	if s.quiet || s.appData == 0 {
+		return
+	}
+
+	s.print("application_data", fmt.Sprintf("records:%d bytes:%d duration:%s",
+		s.appData, s.appBytes, s.lastData.Sub(s.firstData)))
+}
+
+func explainTLSClientHello(body []byte) string {
+	r := &tlsReader{b: body}
+	version := r.uint16()
+	r.next(32) // random
+	r.bytes8() // session id
+
+	var ciphers []string
+	suites := &tlsReader{b: r.bytes16()}
+	for len(suites.b) > 0 && suites.err == nil {
+		if id := suites.uint16(); !isTLSGrease(id) {
+			ciphers = append(ciphers, tls.CipherSuiteName(id))
+		}
+	}
+	r.bytes8() // compression methods
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("version:%s", tls.VersionName(version)))
+	details := explainTLSExtensions(r.bytes16(), true, &builder)
+	builder.WriteString("\n  ciphers: " + strings.Join(ciphers, ","))
+	builder.WriteString(details)
+	if r.err != nil {
+		builder.WriteString(" (truncated)")
+	}
+
+	return builder.String()
+}
+
+func explainTLSServerHello(body []byte) string {
+	r := &tlsReader{b: body}
+	version := r.uint16()
+	r.next(32) // random
+	r.bytes8() // session id
+	cipher := r.uint16()
+	r.uint8() // compression method
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("version:%s cipher:%s", tls.VersionName(version), tls.CipherSuiteName(cipher)))
+	builder.WriteString(explainTLSExtensions(r.bytes16(), false, &builder))
+	if r.err != nil {
+		builder.WriteString(" (truncated)")
+	}
+
+	return builder.String()
+}
+
+// explainTLSExtensions writes the well known extensions to builder,
+// and returns the full extension list to be shown on its own line.
+func explainTLSExtensions(b []byte, client bool, builder *strings.Builder) string {
+	var names []string
+	r := &tlsReader{b: b}
+	for len(r.b) > 0 && r.err == nil {
+		extType := r.uint16()
+		ext := &tlsReader{b: r.bytes16()}
+		if isTLSGrease(extType) {
+			continue
+		}
+
+		name, ok := tlsExtensionNames[extType]
+		if !ok {
+			name = fmt.Sprintf("%d", extType)
+		}
+		names = append(names, name)
+
+		switch extType {
+		case tlsExtensionServerName:
+			list := &tlsReader{b: ext.bytes16()}
+			for len(list.b) > 0 && list.err == nil {
+				nameType := list.uint8()
+				host := list.bytes16()
+				if nameType == 0 {
+					builder.WriteString(" sni:" + string(host))
+				}
+			}
+		case tlsExtensionALPN:
+			var protocols []string
+			list := &tlsReader{b: ext.bytes16()}
+			for len(list.b) > 0 && list.err == nil {
+				protocols = append(protocols, string(list.bytes8()))
+			}
+			builder.WriteString(" alpn:" + strings.Join(protocols, ","))
+		case tlsExtensionSupportedVersions:
+			if !client {
+				builder.WriteString(" selected_version:" + tls.VersionName(ext.uint16()))
+				continue
+			}
+			var versions []string
+			list := &tlsReader{b: ext.bytes8()}
+			for len(list.b) > 0 && list.err == nil {
+				if v := list.uint16(); !isTLSGrease(v) {
+					versions = append(versions, tls.VersionName(v))
+				}
+			}
+			builder.WriteString(" versions:" + strings.Join(versions, ","))
+		case tlsExtensionSupportedGroups:
+			var groups []string
+			list := &tlsReader{b: ext.bytes16()}
+			for len(list.b) > 0 && list.err == nil {
+				if g := list.uint16(); !isTLSGrease(g) {
+					groups = append(groups, tls.CurveID(g).String())
+				}
+			}
+			builder.WriteString(" groups:" + strings.Join(groups, ","))
+		}
+	}
+
+	return "\n  extensions: " + strings.Join(names, ",")
+}
+
+func explainTLSCertificates(body []byte) string {
+	r := &tlsReader{b: body}
+	list := &tlsReader{b: r.bytes24()}
+
+	var builder strings.Builder
+	var count int
+	for len(list.b) > 0 && list.err == nil {
+		der := list.bytes24()
+		count++
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			builder.WriteString(fmt.Sprintf("\n  #%d: %s", count, color.HiRedString("invalid certificate: %v", err)))
+			continue
+		}
+
+		expiry := fmt.Sprintf("expires in %s", time.Until(cert.NotAfter).Round(time.Hour))
+		if time.Now().After(cert.NotAfter) {
+			expiry = color.HiRedString("expired")
+		}
+		builder.WriteString(fmt.Sprintf("\n  #%d: subject:%s issuer:%s not_after:%s (%s)",
+			count, cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339), expiry))
+		if len(cert.DNSNames) > 0 {
+			builder.WriteString(" dns:" + strings.Join(cert.DNSNames, ","))
+		}
+	}
+
+	return fmt.Sprintf("certificates:%d%s", count, builder.String())
+}
+
+// isTLSGrease reports whether v is a GREASE value (RFC 8701), which is meaningless by design.
+func isTLSGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsReader reads the tls presentation language types, the first error sticks.
+type tlsReader struct {
+	b   []byte
+	err error
+}
+
+func (r *tlsReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errTLSShortBuffer
+		return nil
+	}
+
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *tlsReader) uint8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *tlsReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *tlsReader) bytes8() []byte {
+	return r.next(int(r.uint8()))
+}
+
+func (r *tlsReader) bytes16() []byte {
+	return r.next(int(r.uint16()))
+}
+
+func (r *tlsReader) bytes24() []byte {
+	b := r.next(3)
+	if b == nil {
+		return nil
+	}
+
+	return r.next(int(b[0])<<16 | int(b[1])<<8 | int(b[2]))
+}
@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureOutput returns what fn prints to stdout.
+func captureOutput(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- b
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
+
+// tlsTestClientHello returns the handshake message of a ClientHello sent by crypto/tls.
+func tlsTestClientHello(t *testing.T) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{
+			ServerName: "example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+			MinVersion: tls.VersionTLS12,
+		}).Handshake()
+	}()
+
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != tlsRecordHandshake {
+		t.Fatalf("expected a handshake record, got type %d", header[0])
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func tlsTestRecord(recordType byte, fragment []byte) []byte {
+	record := []byte{recordType, 0x03, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(record[3:], uint16(len(fragment)))
+	return append(record, fragment...)
+}
+
+func TestTLSClientHello(t *testing.T) {
+	msg := tlsTestClientHello(t)
+	info := explainTLSClientHello(msg[tlsHandshakeHeaderLen:])
+	for _, expect := range []string{
+		"version:TLS 1.2",
+		" sni:example.com",
+		" alpn:h2,http/1.1",
+		" versions:TLS 1.3,TLS 1.2",
+		"\n  extensions: ",
+	} {
+		if !strings.Contains(info, expect) {
+			t.Fatalf("expected %q in %q", expect, info)
+		}
+	}
+	if strings.Contains(info, "(truncated)") {
+		t.Fatalf("expected the whole ClientHello decoded, got %q", info)
+	}
+}
+
+func TestTLSFragmentedHandshake(t *testing.T) {
+	msg := tlsTestClientHello(t)
+	// the handshake message over 3 records, the first one splits the handshake header.
+	var stream []byte
+	for _, fragment := range [][]byte{msg[:2], msg[2 : len(msg)/2], msg[len(msg)/2:]} {
+		stream = append(stream, tlsTestRecord(tlsRecordHandshake, fragment)...)
+	}
+
+	output := captureOutput(t, func() {
+		new(tlsInterop).Dump(bytes.NewReader(stream), ClientSide, 1, false)
+	})
+	if count := strings.Count(output, "tls:client_hello"); count != 1 {
+		t.Fatalf("expected one client_hello, got %d in %q", count, output)
+	}
+	if !strings.Contains(output, "sni:example.com") {
+		t.Fatalf("expected the reassembled ClientHello, got %q", output)
+	}
+}
+
+func TestTLSAlert(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment []byte
+		expect   string
+	}{
+		{name: "fatal", fragment: []byte{2, 40}, expect: "description:handshake_failure"},
+		{name: "close", fragment: []byte{1, 0}, expect: "level:warning description:close_notify"},
+		{name: "unknown", fragment: []byte{2, 200}, expect: "description:alert(200)"},
+		{name: "encrypted", fragment: make([]byte, 26), expect: "encrypted len:26"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := captureOutput(t, func() {
+				new(tlsInterop).Dump(bytes.NewReader(tlsTestRecord(tlsRecordAlert, test.fragment)), ServerSide, 1, false)
+			})
+			if !strings.Contains(output, "tls:alert") || !strings.Contains(output, test.expect) {
+				t.Fatalf("expected %q, got %q", test.expect, output)
+			}
+		})
+	}
+}
+
+func TestTLSMalformed(t *testing.T) {
+	msg := tlsTestClientHello(t)
+	// the handshake header claims more than the records carry.
+	long := append([]byte{tlsHandshakeClientHello, 0xff, 0xff, 0xff}, msg[tlsHandshakeHeaderLen:]...)
+	tests := []struct {
+		name   string
+		stream []byte
+		expect string
+	}{
+		{name: "not tls", stream: []byte("GET / HTTP/1.1\r\n\r\n"), expect: "not a tls record"},
+		{name: "truncated header", stream: []byte{tlsRecordHandshake, 3}},
+		{name: "truncated record", stream: tlsTestRecord(tlsRecordHandshake, msg)[:100]},
+		{name: "incomplete handshake", stream: tlsTestRecord(tlsRecordHandshake, long)},
+		{name: "garbage certificate", stream: tlsTestRecord(tlsRecordHandshake,
+			[]byte{tlsHandshakeCertificate, 0, 0, 7, 0, 0, 4, 0, 0, 1, 0xff}), expect: "invalid certificate"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := captureOutput(t, func() {
+				new(tlsInterop).Dump(bytes.NewReader(test.stream), ClientSide, 1, false)
+			})
+			if !strings.Contains(output, test.expect) {
+				t.Fatalf("expected %q, got %q", test.expect, output)
+			}
+		})
+	}
+
+	// every truncated ClientHello is decoded as far as it goes.
+	body := msg[tlsHandshakeHeaderLen:]
+	for i := 0; i < len(body); i++ {
+		if info := explainTLSClientHello(body[:i]); !strings.HasSuffix(info, "(truncated)") {
+			t.Fatalf("expected %d bytes to be truncated, got %q", i, info)
+		}
+	}
+}
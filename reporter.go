@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/kevwan/tproxy/protocol"
+)
+
+// protocolReporter prints the statistics of the protocol decoders, periodically and at stop.
+type protocolReporter struct {
+	interval time.Duration
+}
+
+func NewProtocolReporter(interval time.Duration) Stater {
+	return &protocolReporter{
+		interval: interval,
+	}
+}
+
+func (r *protocolReporter) AddConn(_ string, _ *net.TCPConn) {
+}
+
+func (r *protocolReporter) DelConn(_ string) {
+}
+
+// Start doesn't block, because the staters are started one by one.
+func (r *protocolReporter) Start() {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			protocol.Report(false)
+		}
+	}()
+}
+
+func (r *protocolReporter) Stop() {
+	protocol.Report(true)
+}
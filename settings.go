@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Settings struct {
 	Remote    string
@@ -12,10 +15,23 @@ type Settings struct {
 	Quiet     bool
 	UpLimit   int64
 	DownLimit int64
+	// ProtoFiles, ProtoPaths and DescriptorSet are the schemas to decode gRPC messages.
+	ProtoFiles    []string
+	ProtoPaths    []string
+	DescriptorSet string
+	Reflection    bool
+	// WindowStream is the HTTP/2 stream to show its flow-control windows.
+	WindowStream uint32
+	Verbose      bool
+	Keepalive    bool
+	// SlowQuery is the latency over which the MySQL queries are highlighted.
+	SlowQuery time.Duration
 }
 
 func saveSettings(localHost string, localPort int, remote string, delay time.Duration,
-	protocol string, stat, quiet bool, upLimit, downLimit int64) {
+	protocol string, stat, quiet bool, upLimit, downLimit int64,
+	protoFiles, protoPaths, descriptorSet string, reflection bool, windowStream uint, verbose, keepalive bool,
+	slowQuery time.Duration) {
 	if localHost != "" {
 		settings.LocalHost = localHost
 	}
@@ -31,4 +47,23 @@ func saveSettings(localHost string, localPort int, remote string, delay time.Dur
 	settings.Quiet = quiet
 	settings.UpLimit = upLimit
 	settings.DownLimit = downLimit
+	settings.ProtoFiles = splitList(protoFiles)
+	settings.ProtoPaths = splitList(protoPaths)
+	settings.DescriptorSet = descriptorSet
+	settings.Reflection = reflection
+	settings.WindowStream = uint32(windowStream)
+	settings.Verbose = verbose
+	settings.Keepalive = keepalive
+	settings.SlowQuery = slowQuery
+}
+
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+
+	return items
 }
@@ -6,21 +6,30 @@ import (
 	"os"
 
 	"github.com/fatih/color"
+	"github.com/kevwan/tproxy/protocol"
 )
 
 var settings Settings
 
 func main() {
 	var (
-		localPort = flag.Int("p", 0, "Local port to listen on, default to pick a random port")
-		localHost = flag.String("l", "localhost", "Local address to listen on")
-		remote    = flag.String("r", "", "Remote address (host:port) to connect")
-		delay     = flag.Duration("d", 0, "the delay to relay packets")
-		protocol  = flag.String("t", "", "The type of protocol, currently support text, http2, grpc, mysql, redis, mongodb and mqtt")
-		stat      = flag.Bool("s", false, "Enable statistics")
-		quiet     = flag.Bool("q", false, "Quiet mode, only prints connection open/close and stats, default false")
-		upLimit   = flag.Int64("up", 0, "Upward speed limit(bytes/second)")
-		downLimit = flag.Int64("down", 0, "Downward speed limit(bytes/second)")
+		localPort     = flag.Int("p", 0, "Local port to listen on, default to pick a random port")
+		localHost     = flag.String("l", "localhost", "Local address to listen on")
+		remote        = flag.String("r", "", "Remote address (host:port) to connect")
+		delay         = flag.Duration("d", 0, "the delay to relay packets")
+		protoType     = flag.String("t", "", "The type of protocol, currently support text, amqp, dns, http2, grpc, kafka, memcached, mysql, redis, mongodb, mqtt and tls")
+		stat          = flag.Bool("s", false, "Enable statistics")
+		quiet         = flag.Bool("q", false, "Quiet mode, only prints connection open/close and stats, default false")
+		upLimit       = flag.Int64("up", 0, "Upward speed limit(bytes/second)")
+		downLimit     = flag.Int64("down", 0, "Downward speed limit(bytes/second)")
+		protoFiles    = flag.String("proto", "", "Comma separated .proto files to decode gRPC messages")
+		protoPaths    = flag.String("proto-path", "", "Comma separated import paths of the .proto files")
+		descriptorSet = flag.String("descriptor-set", "", "FileDescriptorSet file (protoc --descriptor_set_out) to decode gRPC messages")
+		reflection    = flag.Bool("reflect", false, "Look up gRPC schemas with the server reflection of the remote")
+		windowStream  = flag.Uint("window-stream", 0, "The HTTP/2 stream id to show its flow-control windows, for http2 and grpc")
+		verbose       = flag.Bool("v", false, "Verbose mode, shows the HTTP/2 frames of grpc instead of one line per call")
+		keepalive     = flag.Bool("keepalive", false, "Shows the keepalive pings, goaways, idle time and reconnects of http2 and grpc")
+		slowQuery     = flag.Duration("slow", 0, "Highlights the mysql queries slower than it, shown in quiet mode too, default 0 to disable")
 	)
 
 	if len(os.Args) <= 1 {
@@ -29,7 +38,9 @@ func main() {
 	}
 
 	flag.Parse()
-	saveSettings(*localHost, *localPort, *remote, *delay, *protocol, *stat, *quiet, *upLimit, *downLimit)
+	saveSettings(*localHost, *localPort, *remote, *delay, *protoType, *stat, *quiet, *upLimit, *downLimit,
+		*protoFiles, *protoPaths, *descriptorSet, *reflection, *windowStream, *verbose, *keepalive,
+		*slowQuery)
 
 	if len(settings.Remote) == 0 {
 		fmt.Fprintln(os.Stderr, color.HiRedString("[x] Remote target required"))
@@ -37,6 +48,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := protocol.Setup(protocol.Options{
+		ProtoFiles:    settings.ProtoFiles,
+		ProtoPaths:    settings.ProtoPaths,
+		DescriptorSet: settings.DescriptorSet,
+		Reflection:    settings.Reflection,
+		Remote:        settings.Remote,
+		WindowStream:  settings.WindowStream,
+		Verbose:       settings.Verbose,
+		Keepalive:     settings.Keepalive,
+		SlowQuery:     settings.SlowQuery,
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, color.HiRedString("[x] Failed to load gRPC schemas: %v", err))
+		os.Exit(1)
+	}
+
 	if err := startListener(); err != nil {
 		fmt.Fprintln(os.Stderr, color.HiRedString("[x] Failed to start listener: %v", err))
 		os.Exit(1)